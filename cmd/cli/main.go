@@ -2,80 +2,349 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/bepass-org/bepass/config"
+	"github.com/bepass-org/bepass/dialer"
 	"github.com/bepass-org/bepass/logger"
 	"github.com/bepass-org/bepass/server"
+	"github.com/bepass-org/bepass/tune"
+	"io/fs"
 	"os"
 	"os/signal"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/peterbourgon/ff/v4"
 	"github.com/peterbourgon/ff/v4/ffhelp"
+	"github.com/peterbourgon/ff/v4/ffval"
 )
 
-var configPath string
+// configPollInterval is how often the config file is checked for changes
+const configPollInterval = 2 * time.Second
+
+// envVarPrefix is the prefix of the environment variables that set flags, e.g. BEPASS_BIND_ADDRESS
+const envVarPrefix = "BEPASS"
+
+var (
+	configPath string
+	configFlag ff.Flag
+	// overrides are the config fields that can be set by flags and environment variables
+	overrides []*override
+
+	// flags of the tune command
+	tuneProfile     string
+	tuneAttempts    int
+	tuneConcurrency int
+	tuneTimeout     time.Duration
+	tuneStrategies  []string
+)
+
+// override is a flag that sets a config field on top of the config file.
+type override struct {
+	field config.Field
+	value string
+	set   bool
+}
+
+func (o *override) String() string {
+	return o.value
+}
+
+// Set checks the value right away, so mistakes are reported like other flag errors.
+func (o *override) Set(value string) error {
+	if err := (&config.Config{}).Set(o.field.Name, value); err != nil {
+		return err
+	}
+	o.value, o.set = value, true
+	return nil
+}
+
+func (o *override) IsBoolFlag() bool {
+	return o.field.IsBool
+}
 
 func main() {
-	fs := ff.NewFlags("Bepass")
-	fs.StringVar(&configPath, 'c', "config", "./config.json", "Path to configuration file")
+	rootFlags := ff.NewFlags("bepass")
+	configFlag = rootFlags.StringVar(&configPath, 'c', "config", "./config.json", "Path to configuration file, JSON, YAML or TOML")
+	for _, field := range config.Fields() {
+		o := &override{field: field}
+		flagConfig := ff.CoreFlagConfig{
+			LongName:      field.Flag,
+			Placeholder:   field.Placeholder,
+			NoPlaceholder: field.IsBool,
+			Usage:         "Override " + field.Name + " of the config file",
+			Value:         o,
+			NoDefault:     true,
+		}
+		if field.Name == "ActiveProfile" {
+			flagConfig.ShortName, flagConfig.LongName = 'p', "profile"
+			flagConfig.Placeholder = "NAME"
+			flagConfig.Usage = "Name of the profile of the config file to use"
+		}
+		if _, err := rootFlags.AddFlag(flagConfig); err != nil {
+			logger.Fatal("", err)
+		}
+		overrides = append(overrides, o)
+	}
 
-	err := ff.Parse(fs, os.Args[1:])
+	checkCmd := &ff.Command{
+		Name:      "check",
+		Usage:     "bepass config check [FLAGS]",
+		ShortHelp: "Validate the configuration file and exit",
+		Flags:     ff.NewFlags("check").SetParent(rootFlags),
+		Exec:      checkConfig,
+	}
+	configCmd := &ff.Command{
+		Name:        "config",
+		Usage:       "bepass config <SUBCOMMAND> [FLAGS]",
+		ShortHelp:   "Work with the configuration file",
+		Flags:       ff.NewFlags("config").SetParent(rootFlags),
+		Subcommands: []*ff.Command{checkCmd},
+	}
+	tuneFlags := ff.NewFlags("tune").SetParent(rootFlags)
+	tuneFlags.IntVar(&tuneAttempts, 0, "attempts", 1, "Handshakes per setting and domain")
+	tuneFlags.IntVar(&tuneConcurrency, 0, "concurrency", 4, "Settings that are tried at the same time")
+	tuneFlags.DurationVar(&tuneTimeout, 0, "timeout", 5*time.Second, "Timeout of a handshake")
+	for _, flagConfig := range []ff.CoreFlagConfig{
+		{LongName: "save-profile", Placeholder: "NAME", Usage: "Write the best settings to this profile of the config file", Value: ffval.NewValue(&tuneProfile)},
+		{LongName: "strategy", Placeholder: "STRATEGY", Usage: "Fragment strategy to try, repeatable, all by default", Value: ffval.NewUniqueList(&tuneStrategies)},
+	} {
+		if _, err := tuneFlags.AddFlag(flagConfig); err != nil {
+			logger.Fatal("", err)
+		}
+	}
+	tuneCmd := &ff.Command{
+		Name:      "tune",
+		Usage:     "bepass tune [FLAGS] DOMAIN[=IP:PORT] ...",
+		ShortHelp: "Search for fragmentation settings that complete tls handshakes",
+		Flags:     tuneFlags,
+		Exec:      runTune,
+	}
+	root := &ff.Command{
+		Name:        "bepass",
+		Usage:       "bepass [FLAGS] [<SUBCOMMAND>]",
+		Flags:       rootFlags,
+		Exec:        run,
+		Subcommands: []*ff.Command{configCmd, tuneCmd},
+	}
+
+	err := root.Parse(os.Args[1:], ff.WithEnvVarPrefix(envVarPrefix))
 	switch {
 	case errors.Is(err, ff.ErrHelp):
-		logger.Errorf("%s\n", ffhelp.Flags(fs))
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Command(root.GetSelected()))
 		os.Exit(0)
 	case err != nil:
-		logger.Errorf("error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+
+	err = root.Run(context.Background())
+	switch {
+	case errors.Is(err, ff.ErrNoExec):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Command(root.GetSelected()))
+		os.Exit(1)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, formatError(err))
 		os.Exit(1)
 	}
+}
 
+// run runs the server until a signal is received.
+func run(ctx context.Context, _ []string) error {
 	// Load and validate configuration from JSON file
-	err = loadConfig(configPath)
+	cfg, err := loadConfig(configPath)
 	if err != nil {
-		logger.Fatal("", err)
+		return err
 	}
 
-	// Run the server with the loaded configuration
-	err = server.Run(true)
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	instance, err := server.New(cfg)
 	if err != nil {
-		logger.Fatal("", err)
+		return err
 	}
+	if err := instance.Start(ctx); err != nil {
+		return err
+	}
+	go watchConfig(ctx, instance, cfg)
+	<-ctx.Done()
 
-	// HandleTCPTunnel graceful shutdown
-	handleShutdown()
+	fmt.Println("Shutting down gracefully...")
+	return instance.Stop()
 }
 
-func loadConfig(configPath string) error {
-	file, err := os.Open(configPath)
-	if err != nil {
+// checkConfig runs the same checks as starting the server, without starting it.
+func checkConfig(_ context.Context, _ []string) error {
+	if _, err := loadConfig(configPath); err != nil {
 		return err
 	}
-	defer file.Close()
+	fmt.Println("configuration is valid")
+	return nil
+}
 
-	decoder := json.NewDecoder(file)
-	err = decoder.Decode(config.G)
-	if err != nil {
-		if strings.Contains(err.Error(), "invalid character") {
-			return fmt.Errorf("configuration file is not valid JSON")
+// runTune tries fragmentation settings with handshakes to the domains in args, prints how
+// they did and saves the best one as a profile if it's asked to.
+func runTune(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("no domain to tune with, e.g. bepass tune www.google.com")
+	}
+	targets := make([]tune.Target, 0, len(args))
+	for _, arg := range args {
+		target, err := tune.ParseTarget(arg)
+		if err != nil {
+			return err
 		}
+		targets = append(targets, target)
+	}
+	candidates := tune.DefaultCandidates()
+	if len(tuneStrategies) > 0 {
+		if candidates = tune.FilterStrategies(candidates, tuneStrategies); len(candidates) == 0 {
+			return fmt.Errorf("no settings to try for the strategies %s", strings.Join(tuneStrategies, ", "))
+		}
+	}
+
+	// socket and padding settings are taken from the config, the handshakes go out directly
+	d := dialer.Dialer{}
+	cfg, err := loadConfig(configPath)
+	switch {
+	case err == nil:
+		d.EnableLowLevelSockets = cfg.EnableLowLevelSockets
+		d.TLSPaddingEnabled = cfg.TLSPaddingEnabled
+		d.TLSPaddingSize = cfg.TLSPaddingSize
+	case configFlag.IsSet() || tuneProfile != "":
 		return err
 	}
 
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	fmt.Printf("trying %d settings with %d domains\n", len(candidates), len(targets))
+	results, err := tune.Run(ctx, targets,
+		tune.WithCandidates(candidates),
+		tune.WithDialer(d),
+		tune.WithTimeout(tuneTimeout),
+		tune.WithAttempts(tuneAttempts),
+		tune.WithConcurrency(tuneConcurrency),
+		tune.WithProgress(printTuneResult),
+	)
+	if err != nil {
+		fmt.Println("interrupted, showing the settings that were tried")
+	}
+	if len(results) == 0 || results[0].Succeeded == 0 {
+		return errors.New("no settings completed a handshake")
+	}
+
+	best := results[0]
+	fmt.Println("\nbest settings:")
+	printTuneResult(best)
+	if tuneProfile == "" {
+		return nil
+	}
+	if err := config.WriteProfile(configPath, tuneProfile, tune.Settings(best.Fragment)); err != nil {
+		return err
+	}
+	fmt.Printf("saved as profile %q in %s, use it with --profile %s\n", tuneProfile, configPath, tuneProfile)
 	return nil
 }
 
-func handleShutdown() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGINT, syscall.SIGTERM)
+func printTuneResult(r tune.Result) {
+	total := r.Succeeded + r.Failed
+	if r.Succeeded == 0 {
+		fmt.Printf("fail %d/%d %8s  %s: %v\n", r.Succeeded, total, "-", tune.Describe(r.Fragment), r.Err)
+		return
+	}
+	fmt.Printf("ok   %d/%d %8s  %s\n", r.Succeeded, total, r.Latency.Round(time.Millisecond), tune.Describe(r.Fragment))
+}
 
-	// Block until a signal is received.
-	<-c
+// loadConfig decodes the config file strictly, applies the flags and environment variables
+// on top of it and validates the result. Without a config file at the default path only
+// the flags and environment variables are used.
+func loadConfig(configPath string) (*config.Config, error) {
+	source := configPath
+	cfg, err := config.LoadFile(configPath)
+	switch {
+	case errors.Is(err, fs.ErrNotExist) && !configFlag.IsSet():
+		source = "from flags and environment variables"
+		cfg = &config.Config{}
+	case err != nil:
+		return nil, err
+	}
+	for _, o := range overrides {
+		if !o.set {
+			continue
+		}
+		if err := cfg.Set(o.field.Name, o.value); err != nil {
+			return nil, err
+		}
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration %s:\n%w", source, err)
+	}
+	return cfg, nil
+}
 
-	// Perform cleanup or shutdown tasks here.
-	fmt.Println("Shutting down gracefully...")
-	os.Exit(0)
+// formatError puts every error of a joined error on its own indented line.
+func formatError(err error) string {
+	lines := strings.Split(err.Error(), "\n")
+	for i := 1; i < len(lines); i++ {
+		lines[i] = "  - " + lines[i]
+	}
+	return strings.Join(lines, "\n")
+}
+
+// watchConfig reloads the config when its file changes or on SIGHUP and reports what changed.
+// Invalid configs are reported and not applied.
+func watchConfig(ctx context.Context, instance *server.Instance, current *config.Config) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(configPollInterval)
+	defer ticker.Stop()
+
+	modTime := fileModTime(configPath)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Infof("received SIGHUP, reloading %s", configPath)
+		case <-ticker.C:
+			if fileModTime(configPath).Equal(modTime) {
+				continue
+			}
+			logger.Infof("%s changed, reloading", configPath)
+		}
+		modTime = fileModTime(configPath)
+
+		cfg, err := loadConfig(configPath)
+		if err != nil {
+			logger.Errorf("config not reloaded: %s", formatError(err))
+			continue
+		}
+		changes := config.Diff(current, cfg)
+		if len(changes) == 0 {
+			logger.Infof("config unchanged")
+			continue
+		}
+		if err := instance.Reload(cfg); err != nil {
+			logger.Errorf("config not reloaded: %v", err)
+			continue
+		}
+		for _, c := range changes {
+			logger.Infof("config changed %s", c)
+		}
+		current = cfg
+	}
+}
+
+// fileModTime returns the modification time of the file at path, or the zero time if it can't be read.
+func fileModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
 }
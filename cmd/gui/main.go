@@ -1,11 +1,10 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"github.com/bepass-org/bepass/config"
 	"github.com/bepass-org/bepass/server"
-	"io"
 
 	"fyne.io/fyne/v2"
 	"fyne.io/fyne/v2/app"
@@ -16,6 +15,9 @@ import (
 	"fyne.io/fyne/v2/widget"
 )
 
+// noProfile stands for the config without a profile in the profile selection
+const noProfile = "(none)"
+
 func main() {
 	myApp := app.New()
 	myWindow := myApp.NewWindow("Bepass GUI")
@@ -31,6 +33,8 @@ func main() {
 		ui.listenInput,
 		ui.openFileLabel,
 		ui.openFileButton,
+		ui.profileLabel,
+		ui.profileSelect,
 		layout.NewSpacer(),
 		ui.connectButton,
 	)
@@ -47,9 +51,12 @@ type UIComponents struct {
 	listenInput    *widget.Entry
 	openFileLabel  *widget.Label
 	openFileButton *widget.Button
+	profileLabel   *widget.Label
+	profileSelect  *widget.Select
 	connectButton  *widget.Button
 	isConnected    bool
 	coreConfig     *config.Config
+	instance       *server.Instance
 }
 
 func createUIComponents(myWindow *fyne.Window) *UIComponents {
@@ -76,28 +83,49 @@ func createUIComponents(myWindow *fyne.Window) *UIComponents {
 			if reader == nil {
 				return
 			}
-			data, err := io.ReadAll(reader)
+			defer reader.Close()
+			cfg, err := config.LoadFormat(reader, config.FormatOf(reader.URI().Name()))
 			if err != nil {
 				dialog.ShowError(err, *myWindow)
 				return
 			}
-			err = json.Unmarshal(data, &ui.coreConfig)
-			if err != nil {
+			if err := cfg.Validate(); err != nil {
 				dialog.ShowError(err, *myWindow)
 				return
 			}
+			ui.coreConfig = cfg
 			ui.openFileLabel.SetText(fmt.Sprintf("config: %s", reader.URI().String()))
+			ui.showProfiles()
 		}, *myWindow)
 		cwd, _ := storage.ListerForURI(storage.NewFileURI("."))
 		fd.SetLocation(cwd)
-		fd.SetFilter(storage.NewExtensionFileFilter([]string{".json"}))
+		fd.SetFilter(storage.NewExtensionFileFilter([]string{".json", ".yaml", ".yml", ".toml"}))
 		fd.Show()
 	})
 
+	ui.profileLabel = widget.NewLabel("Profile:")
+	ui.profileSelect = widget.NewSelect(nil, func(name string) {
+		if name == noProfile {
+			name = ""
+		}
+		if ui.coreConfig == nil || ui.coreConfig.ActiveProfile == name {
+			return
+		}
+		ui.coreConfig.ActiveProfile = name
+		// a running instance switches right away, new connections use the profile
+		if ui.instance != nil {
+			if err := ui.instance.SetProfile(name); err != nil {
+				dialog.ShowError(err, *myWindow)
+			}
+		}
+	})
+
 	ui.profile = widget.NewRadioGroup([]string{"Default", "Config"}, func(value string) {
 		if value == "Default" {
 			ui.openFileLabel.Hide()
 			ui.openFileButton.Hide()
+			ui.profileLabel.Hide()
+			ui.profileSelect.Hide()
 			ui.dohLabel.Show()
 			ui.dohInput.Show()
 			ui.listenLabel.Show()
@@ -110,6 +138,7 @@ func createUIComponents(myWindow *fyne.Window) *UIComponents {
 			ui.openFileLabel.Show()
 			ui.openFileButton.Show()
 			ui.coreConfig = nil
+			ui.showProfiles()
 		}
 	})
 	ui.profile.SetSelected("Default")
@@ -119,6 +148,23 @@ func createUIComponents(myWindow *fyne.Window) *UIComponents {
 	return ui
 }
 
+// showProfiles offers the profiles of the selected config, if it has any.
+func (ui *UIComponents) showProfiles() {
+	if ui.coreConfig == nil || len(ui.coreConfig.Profiles) == 0 {
+		ui.profileLabel.Hide()
+		ui.profileSelect.Hide()
+		return
+	}
+	ui.profileSelect.Options = append([]string{noProfile}, ui.coreConfig.ProfileNames()...)
+	selected := ui.coreConfig.ActiveProfile
+	if selected == "" {
+		selected = noProfile
+	}
+	ui.profileSelect.SetSelected(selected)
+	ui.profileLabel.Show()
+	ui.profileSelect.Show()
+}
+
 func (ui *UIComponents) ToggleConnection(myWindow *fyne.Window) {
 	if ui.isConnected {
 		ui.Disconnect(myWindow)
@@ -136,7 +182,7 @@ func (ui *UIComponents) Connect(myWindow *fyne.Window) {
 		ui.coreConfig = &config.Config{
 			TLSHeaderLength:       5,
 			DnsCacheTTL:           3600,
-			WorkerAddress:         "worker.example.com",
+			WorkerAddress:         "https://worker.example.com/dns-query",
 			WorkerIPPortAddress:   "192.168.0.1:8080",
 			WorkerEnabled:         true,
 			WorkerDNSOnly:         false,
@@ -146,7 +192,6 @@ func (ui *UIComponents) Connect(myWindow *fyne.Window) {
 			SniChunksLength:       [2]int{30, 40},
 			ChunksLengthAfterSni:  [2]int{50, 60},
 			DelayBetweenChunks:    [2]int{70, 80},
-			ResolveSystem:         "doh",
 		}
 	}
 
@@ -154,17 +199,21 @@ func (ui *UIComponents) Connect(myWindow *fyne.Window) {
 		dialog.ShowError(fmt.Errorf("config isn't selected"), *myWindow)
 		return
 	}
+	if err := ui.coreConfig.Validate(); err != nil {
+		dialog.ShowError(err, *myWindow)
+		return
+	}
 
-	go func() {
-		err := server.Run(true)
-		if err != nil {
-			dialog.ShowError(err, *myWindow)
-			ui.isConnected = false
-			ui.dohInput.Enable()
-			ui.listenInput.Enable()
-			ui.connectButton.SetText("Connect")
-		}
-	}()
+	instance, err := server.New(ui.coreConfig)
+	if err != nil {
+		dialog.ShowError(err, *myWindow)
+		return
+	}
+	if err := instance.Start(context.Background()); err != nil {
+		dialog.ShowError(err, *myWindow)
+		return
+	}
+	ui.instance = instance
 
 	ui.isConnected = true
 	ui.dohInput.Disable()
@@ -173,15 +222,14 @@ func (ui *UIComponents) Connect(myWindow *fyne.Window) {
 }
 
 func (ui *UIComponents) Disconnect(myWindow *fyne.Window) {
-	go func() {
-		if ui.coreConfig != nil {
-			err := server.ShutDown()
-
-			if err != nil {
+	if instance := ui.instance; instance != nil {
+		ui.instance = nil
+		go func() {
+			if err := instance.Stop(); err != nil {
 				dialog.ShowError(err, *myWindow)
 			}
-		}
-	}()
+		}()
+	}
 	ui.isConnected = false
 	ui.dohInput.Enable()
 	ui.listenInput.Enable()
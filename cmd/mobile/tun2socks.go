@@ -1,7 +1,7 @@
 package tun2socks
 
 import (
-	"encoding/json"
+	"context"
 	"errors"
 	"github.com/bepass-org/bepass/config"
 	"io"
@@ -24,21 +24,49 @@ import (
 	"github.com/songgao/water"
 )
 
+// client is the bepass instance started by StartClient
+var client *bepassCore.Instance
+
 func StartClient(cfg string) bool {
-	config := &config.Config{}
-	err := json.Unmarshal([]byte(cfg), config)
+	if client != nil {
+		return false
+	}
+	c, err := config.Load(strings.NewReader(cfg))
+	if err != nil {
+		log.Errorf("invalid config: %v", err)
+		return false
+	}
+	if err := c.Validate(); err != nil {
+		log.Errorf("invalid config: %v", err)
+		return false
+	}
+	instance, err := bepassCore.New(c)
 	if err != nil {
 		return false
 	}
-	err = bepassCore.Run(false)
+	err = instance.Start(context.Background())
 	if err != nil {
 		return false
 	}
+	client = instance
 	return true
 }
 
+// SetProfile switches the running client to the named profile of its config,
+// "" switches to the config without a profile.
+func SetProfile(name string) bool {
+	if client == nil {
+		return false
+	}
+	return client.SetProfile(name) == nil
+}
+
 func StopClient() bool {
-	err := bepassCore.ShutDown()
+	if client == nil {
+		return false
+	}
+	err := client.Stop()
+	client = nil
 	if err != nil {
 		return false
 	}
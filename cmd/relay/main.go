@@ -0,0 +1,112 @@
+// Package main runs the relay, a self-hosted replacement of the Cloudflare worker.
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/bepass/relay"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/peterbourgon/ff/v4"
+	"github.com/peterbourgon/ff/v4/ffhelp"
+)
+
+// envVarPrefix is the prefix of the environment variables that set flags, e.g. BEPASS_RELAY_LISTEN
+const envVarPrefix = "BEPASS_RELAY"
+
+// shutdownTimeout is how long open requests get to finish on shutdown
+const shutdownTimeout = 5 * time.Second
+
+var (
+	listenAddress  string
+	certFile       string
+	keyFile        string
+	plain          bool
+	dohUpstream    string
+	udpIdleTimeout time.Duration
+	token          string
+	allowPrivate   bool
+)
+
+func main() {
+	flags := ff.NewFlags("relay")
+	flags.StringVar(&listenAddress, 'l', "listen", ":443", "Address to listen on")
+	flags.StringVar(&certFile, 0, "cert", "", "TLS certificate file, a self-signed one is used if it's empty")
+	flags.StringVar(&keyFile, 0, "key", "", "TLS key file of the certificate")
+	flags.BoolVar(&plain, 0, "plain", false, "Serve without TLS, e.g. behind a reverse proxy")
+	flags.StringVar(&dohUpstream, 0, "doh-upstream", "https://1.1.1.1/dns-query", "DoH server that /dns-query is forwarded to, empty disables it")
+	flags.DurationVar(&udpIdleTimeout, 0, "udp-idle-timeout", 2*time.Minute, "How long udp bindings are kept without packets")
+	flags.StringVar(&token, 0, "token", "", "Secret that clients send as their session, required")
+	flags.BoolVar(&allowPrivate, 0, "allow-private", false, "Let clients reach loopback, private and link-local addresses")
+
+	cmd := &ff.Command{
+		Name:  "relay",
+		Usage: "relay [FLAGS]",
+		Flags: flags,
+		Exec:  run,
+	}
+	err := cmd.ParseAndRun(context.Background(), os.Args[1:], ff.WithEnvVarPrefix(envVarPrefix))
+	switch {
+	case errors.Is(err, ff.ErrHelp):
+		fmt.Fprintf(os.Stderr, "%s\n", ffhelp.Command(cmd))
+		os.Exit(0)
+	case err != nil:
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run serves the relay until a signal is received.
+func run(ctx context.Context, _ []string) error {
+	if token == "" {
+		return errors.New("--token is required")
+	}
+	if (certFile == "") != (keyFile == "") {
+		return errors.New("--cert and --key must be given together")
+	}
+	srv := &http.Server{
+		Addr: listenAddress,
+		Handler: &relay.Server{
+			DoHUpstream:    dohUpstream,
+			UDPIdleTimeout: udpIdleTimeout,
+			Token:          token,
+			AllowPrivate:   allowPrivate,
+		},
+	}
+	if !plain && certFile == "" {
+		cert, err := relay.SelfSignedCertificate()
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	errCh := make(chan error, 1)
+	go func() {
+		fmt.Printf("relay listening on %s\n", listenAddress)
+		if plain {
+			errCh <- srv.ListenAndServe()
+		} else {
+			errCh <- srv.ListenAndServeTLS(certFile, keyFile)
+		}
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+	fmt.Println("Shutting down gracefully...")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
+}
@@ -1,38 +1,86 @@
 package config
 
 import (
+	"encoding/json"
 	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/route"
+)
+
+const (
+	// UpstreamWorker stands for the worker in the list of dns upstreams
+	UpstreamWorker = "worker"
+	// ClientSubnetNone removes the client subnet of the dns queries to an upstream
+	ClientSubnetNone = "none"
 )
 
 type Config struct {
 	TLSHeaderLength        int             `mapstructure:"TLSHeaderLength"`
+	TLSRecordFragmentation bool            `mapstructure:"TLSRecordFragmentation"`
 	TLSPaddingEnabled      bool            `mapstructure:"TLSPaddingEnabled"`
 	TLSPaddingSize         [2]int          `mapstructure:"TLSPaddingSize"`
 	DnsCacheTTL            int             `mapstructure:"DnsCacheTTL"`
+	DnsCacheMinTTL         int             `mapstructure:"DnsCacheMinTTL"`
+	DnsCacheSize           int             `mapstructure:"DnsCacheSize"`
+	DnsCacheStaleTTL       int             `mapstructure:"DnsCacheStaleTTL"`
+	DnsCacheFile           string          `mapstructure:"DnsCacheFile"`
+	DnsCacheSaveInterval   int             `mapstructure:"DnsCacheSaveInterval"`
 	DnsRequestTimeout      int             `mapstructure:"DnsRequestTimeout"`
 	WorkerAddress          string          `mapstructure:"WorkerAddress"`
 	WorkerIPPortAddress    string          `mapstructure:"WorkerIPPortAddress"`
 	WorkerEnabled          bool            `mapstructure:"WorkerEnabled"`
 	WorkerDNSOnly          bool            `mapstructure:"WorkerDNSOnly"`
+	WorkerDoHAddr          string          `mapstructure:"WorkerDoHAddr"`
+	WorkerMux              bool            `mapstructure:"WorkerMux"`
+	WorkerMuxConnections   int             `mapstructure:"WorkerMuxConnections"`
+	WorkerUDPDatagrams     bool            `mapstructure:"WorkerUDPDatagrams"`
+	WorkerToken            string          `mapstructure:"WorkerToken"`
 	EnableLowLevelSockets  bool            `mapstructure:"EnableLowLevelSockets"`
 	EnableDNSFragmentation bool            `mapstructure:"EnableDNSFragmentation"`
 	RemoteDNSAddr          string          `mapstructure:"RemoteDNSAddr"`
+	DNSUpstreams           []DNSUpstream   `mapstructure:"DNSUpstreams"`
+	DNSUpstreamStrategy    string          `mapstructure:"DNSUpstreamStrategy"`
+	DNSUpstreamCooldown    int             `mapstructure:"DNSUpstreamCooldown"`
+	TrustedDNSAddr         string          `mapstructure:"TrustedDNSAddr"`
+	DNSCrossCheck          bool            `mapstructure:"DNSCrossCheck"`
+	PoisonCIDRs            []string        `mapstructure:"PoisonCIDRs"`
+	PoisonCheckPrivate     bool            `mapstructure:"PoisonCheckPrivate"`
 	BindAddress            string          `mapstructure:"BindAddress"`
+	DNSListenAddress       string          `mapstructure:"DNSListenAddress"`
 	UDPBindAddress         string          `mapstructure:"UDPBindAddress"`
 	ChunksLengthBeforeSni  [2]int          `mapstructure:"ChunksLengthBeforeSni"`
 	SniChunksLength        [2]int          `mapstructure:"SniChunksLength"`
 	ChunksLengthAfterSni   [2]int          `mapstructure:"ChunksLengthAfterSni"`
+	FragmentStrategy       string          `mapstructure:"FragmentStrategy"`
+	FragmentChunksLength   [2]int          `mapstructure:"FragmentChunksLength"`
+	FragmentOffset         int             `mapstructure:"FragmentOffset"`
 	UDPReadTimeout         int             `mapstructure:"UDPReadTimeout"`
 	UDPWriteTimeout        int             `mapstructure:"UDPWriteTimeout"`
 	UDPLinkIdleTimeout     int64           `mapstructure:"UDPLinkIdleTimeout"`
 	DelayBetweenChunks     [2]int          `mapstructure:"DelayBetweenChunks"`
 	Hosts                  []resolve.Hosts `mapstructure:"Hosts"`
-	ResolveSystem          string          `mapstructure:"-"`
-	UserSession            string          `mapstructure:"-"`
+	Rules                  []route.Rule    `mapstructure:"Rules"`
+	DefaultRoute           string          `mapstructure:"DefaultRoute"`
+	// Profiles are named sets of settings that are applied on top of the rest of the config
+	Profiles      map[string]json.RawMessage `mapstructure:"Profiles"`
+	ActiveProfile string                     `mapstructure:"ActiveProfile"`
 }
 
-var G *Config
+// DNSUpstream is a DNS upstream with its options. In JSON it's either an object or just the address.
+type DNSUpstream struct {
+	Address      string `mapstructure:"Address"`
+	Method       string `mapstructure:"Method"`       // HTTP method of DoH queries, GET or POST
+	Padding      bool   `mapstructure:"Padding"`      // Pad DoH queries
+	ClientSubnet string `mapstructure:"ClientSubnet"` // EDNS Client Subnet of DoH queries, a CIDR or "none"
+}
 
-func init() {
-	G = &Config{}
+// UnmarshalJSON accepts the address as a string as well as the whole object.
+// Unknown fields of the object are rejected like the ones of the Config.
+func (u *DNSUpstream) UnmarshalJSON(data []byte) error {
+	var address string
+	if err := json.Unmarshal(data, &address); err == nil {
+		*u = DNSUpstream{Address: address}
+		return nil
+	}
+	type plain DNSUpstream
+	return decodeStrict(data, (*plain)(u))
 }
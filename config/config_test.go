@@ -0,0 +1,339 @@
+package config
+
+import (
+	"encoding/json"
+	"github.com/bepass-org/bepass/resolve"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDNSUpstreamUnmarshalJSON(t *testing.T) {
+	var c Config
+	data := `{"DNSUpstreams": ["tls://1.1.1.1", {"Address": "https://dns.google/dns-query", "Method": "POST", "Padding": true, "ClientSubnet": "none"}]}`
+	if err := json.Unmarshal([]byte(data), &c); err != nil {
+		t.Fatal(err)
+	}
+	want := []DNSUpstream{
+		{Address: "tls://1.1.1.1"},
+		{Address: "https://dns.google/dns-query", Method: "POST", Padding: true, ClientSubnet: "none"},
+	}
+	if len(c.DNSUpstreams) != len(want) {
+		t.Fatalf("Expected %d upstreams, got %d", len(want), len(c.DNSUpstreams))
+	}
+	for i := range want {
+		if c.DNSUpstreams[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], c.DNSUpstreams[i])
+		}
+	}
+}
+
+func TestDiff(t *testing.T) {
+	a := &Config{DnsCacheTTL: 60, SniChunksLength: [2]int{1, 5}, BindAddress: "127.0.0.1:8085"}
+	b := &Config{DnsCacheTTL: 120, SniChunksLength: [2]int{2, 6}, BindAddress: "127.0.0.1:8085"}
+	changes := Diff(a, b)
+	want := []string{"DnsCacheTTL: 60 -> 120", "SniChunksLength: [1,5] -> [2,6]"}
+	if len(changes) != len(want) {
+		t.Fatalf("Expected %d changes, got %v", len(want), changes)
+	}
+	for i := range want {
+		if changes[i].String() != want[i] {
+			t.Errorf("Expected %q, got %q", want[i], changes[i])
+		}
+	}
+	if changes := Diff(a, a); len(changes) != 0 {
+		t.Errorf("Expected no changes, got %v", changes)
+	}
+
+	// profiles are compared by their settings, not by their formatting
+	a.Profiles = map[string]json.RawMessage{"fast": json.RawMessage(`{"DnsCacheTTL": 60}`)}
+	b = &Config{Profiles: map[string]json.RawMessage{"fast": json.RawMessage(`{ "DnsCacheTTL":60 }`)}}
+	b.DnsCacheTTL, b.SniChunksLength, b.BindAddress = a.DnsCacheTTL, a.SniChunksLength, a.BindAddress
+	if changes := Diff(a, b); len(changes) != 0 {
+		t.Errorf("Expected a reformatted profile to be unchanged, got %v", changes)
+	}
+	b.Profiles["fast"] = json.RawMessage(`{"DnsCacheTTL": 120}`)
+	if changes := Diff(a, b); len(changes) != 1 || changes[0].Field != "Profiles" {
+		t.Errorf("Expected the profile to be changed, got %v", changes)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	cfg, err := Load(strings.NewReader(`{"BindAddress": "127.0.0.1:8085", "SniChunksLength": [5, 10]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.SniChunksLength != [2]int{5, 10} {
+		t.Errorf("Expected [5 10], got %v", cfg.SniChunksLength)
+	}
+
+	testCases := []struct {
+		data string
+		want string
+	}{
+		{`{"SniChunkLength": [5, 10]}`, `unknown field "SniChunkLength", did you mean "SniChunksLength"?`},
+		{`{"DNSUpstreams": [{"Adress": "tls://1.1.1.1"}]}`, `unknown field "Adress", did you mean "Address"?`},
+		{`{"Frobnicate": true}`, `unknown field "Frobnicate"`},
+		{"{\n\"DnsCacheTTL\": \"60\"\n}", "line 2: DnsCacheTTL: expected int, got string"},
+		{"{\n\"DnsCacheTTL\": 60,\n}", "line 3"},
+	}
+	for _, tc := range testCases {
+		_, err := Load(strings.NewReader(tc.data))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("Expected %q for %s, got %v", tc.want, tc.data, err)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := &Config{
+		BindAddress:          "127.0.0.1:8085",
+		SniChunksLength:      [2]int{5, 10},
+		WorkerEnabled:        true,
+		WorkerAddress:        "https://example.workers.dev/dns-query",
+		WorkerIPPortAddress:  "104.17.196.93:2096",
+		DNSUpstreams:         []DNSUpstream{{Address: UpstreamWorker}, {Address: "tls://1.1.1.1", ClientSubnet: ClientSubnetNone}},
+		DNSUpstreamStrategy:  "race",
+		Hosts:                []resolve.Hosts{{Domain: "example.com", IP: "1.2.3.4"}},
+		FragmentChunksLength: [2]int{1, 1},
+	}
+	if err := valid.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+
+	invalid := &Config{
+		BindAddress:         "127.0.0.1",
+		SniChunksLength:     [2]int{20, 5},
+		WorkerEnabled:       true,
+		WorkerAddress:       "https://example.workers.dev/dns-query",
+		WorkerIPPortAddress: "example.com:2096",
+		DNSUpstreams:        []DNSUpstream{{Address: "udp://8.8.8.8", Method: "PUT"}},
+		DnsRequestTimeout:   -1,
+		TLSHeaderLength:     4,
+	}
+	err := invalid.Validate()
+	if err == nil {
+		t.Fatal("Expected an error")
+	}
+	want := []string{
+		"SniChunksLength: min 20 is greater than max 5",
+		"DnsRequestTimeout: -1 is negative",
+		"BindAddress: ",
+		"WorkerIPPortAddress: \"example.com\" is not an ip address",
+		"DNSUpstreams[0]: \"udp://8.8.8.8\" has scheme \"udp\"",
+		"DNSUpstreams[0].Method: ",
+		"TLSHeaderLength: 4 is not supported",
+	}
+	errs := err.(interface{ Unwrap() []error }).Unwrap()
+	if len(errs) != len(want) {
+		t.Fatalf("Expected %d errors, got %v", len(want), err)
+	}
+	for i := range want {
+		if !strings.HasPrefix(errs[i].Error(), want[i]) {
+			t.Errorf("Expected %q, got %q", want[i], errs[i])
+		}
+	}
+}
+
+func TestLoadFormat(t *testing.T) {
+	yamlConfig := `
+BindAddress: 127.0.0.1:8085
+SniChunksLength: [5, 10]
+DNSUpstreams:
+  - tls://1.1.1.1
+  - Address: https://dns.google/dns-query
+    Method: POST
+`
+	tomlConfig := `
+BindAddress = "127.0.0.1:8085"
+SniChunksLength = [5, 10]
+DNSUpstreams = ["tls://1.1.1.1", {Address = "https://dns.google/dns-query", Method = "POST"}]
+`
+	for format, data := range map[string]string{FormatYAML: yamlConfig, FormatTOML: tomlConfig} {
+		cfg, err := LoadFormat(strings.NewReader(data), format)
+		if err != nil {
+			t.Fatalf("%s: %v", format, err)
+		}
+		if cfg.BindAddress != "127.0.0.1:8085" || cfg.SniChunksLength != [2]int{5, 10} {
+			t.Errorf("%s: unexpected config %+v", format, cfg)
+		}
+		if len(cfg.DNSUpstreams) != 2 || cfg.DNSUpstreams[1].Method != "POST" {
+			t.Errorf("%s: unexpected upstreams %+v", format, cfg.DNSUpstreams)
+		}
+	}
+
+	_, err := LoadFormat(strings.NewReader("SniChunkLength: [5, 10]"), FormatYAML)
+	if err == nil || !strings.Contains(err.Error(), `did you mean "SniChunksLength"`) {
+		t.Errorf("Expected the unknown field to be rejected, got %v", err)
+	}
+	if FormatOf("config.yml") != FormatYAML || FormatOf("config.toml") != FormatTOML || FormatOf("config") != FormatJSON {
+		t.Errorf("Unexpected formats")
+	}
+}
+
+func TestSet(t *testing.T) {
+	var c Config
+	for _, s := range []struct{ name, value string }{
+		{"BindAddress", "127.0.0.1:8085"},
+		{"WorkerEnabled", "true"},
+		{"UDPLinkIdleTimeout", "120"},
+		{"SniChunksLength", "5,10"},
+		{"DelayBetweenChunks", "[10, 20]"},
+		{"PoisonCIDRs", "10.10.34.0/24,10.10.35.0/24"},
+		{"DNSUpstreams", "tls://1.1.1.1,https://dns.google/dns-query"},
+		{"Hosts", `[{"Domain": "example.com", "IP": "1.2.3.4"}]`},
+	} {
+		if err := c.Set(s.name, s.value); err != nil {
+			t.Fatalf("Set(%s, %s) failed: %v", s.name, s.value, err)
+		}
+	}
+	want := Config{
+		BindAddress:        "127.0.0.1:8085",
+		WorkerEnabled:      true,
+		UDPLinkIdleTimeout: 120,
+		SniChunksLength:    [2]int{5, 10},
+		DelayBetweenChunks: [2]int{10, 20},
+		PoisonCIDRs:        []string{"10.10.34.0/24", "10.10.35.0/24"},
+		DNSUpstreams:       []DNSUpstream{{Address: "tls://1.1.1.1"}, {Address: "https://dns.google/dns-query"}},
+		Hosts:              []resolve.Hosts{{Domain: "example.com", IP: "1.2.3.4"}},
+	}
+	if changes := Diff(&want, &c); len(changes) != 0 {
+		t.Errorf("Unexpected values %v", changes)
+	}
+
+	for _, s := range []struct{ name, value string }{
+		{"SniChunksLength", "5,x"},
+		{"WorkerEnabled", "maybe"},
+		{"Hosts", "example.com"},
+		{"Hosts", `[{"Domian": "example.com"}]`},
+		{"SniChunkLength", "5,10"},
+	} {
+		if err := c.Set(s.name, s.value); err == nil {
+			t.Errorf("Expected an error for Set(%s, %s)", s.name, s.value)
+		}
+	}
+
+	flags := map[string]string{}
+	for _, f := range Fields() {
+		flags[f.Name] = f.Flag
+	}
+	for name, flag := range map[string]string{
+		"SniChunksLength":     "sni-chunks-length",
+		"WorkerIPPortAddress": "worker-ip-port-address",
+		"WorkerDoHAddr":       "worker-doh-addr",
+		"PoisonCIDRs":         "poison-cidrs",
+		"DnsCacheTTL":         "dns-cache-ttl",
+	} {
+		if flags[name] != flag {
+			t.Errorf("Expected flag %s for %s, got %s", flag, name, flags[name])
+		}
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	cfg, err := Load(strings.NewReader(`{
+		"BindAddress": "127.0.0.1:8085",
+		"RemoteDNSAddr": "https://1.1.1.1/dns-query",
+		"SniChunksLength": [5, 10],
+		"PoisonCIDRs": ["10.10.34.0/24"],
+		"ActiveProfile": "home",
+		"Profiles": {
+			"home": {"SniChunksLength": [1, 3]},
+			"mobile": {"WorkerEnabled": true, "WorkerAddress": "https://example.workers.dev/dns-query", "WorkerIPPortAddress": "104.17.196.93:2096", "PoisonCIDRs": []}
+		}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Fatalf("Expected a valid config, got %v", err)
+	}
+	if names := cfg.ProfileNames(); len(names) != 2 || names[0] != "home" || names[1] != "mobile" {
+		t.Errorf("Unexpected profiles %v", names)
+	}
+
+	home, err := cfg.WithProfile("home")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if home.SniChunksLength != [2]int{1, 3} || home.BindAddress != cfg.BindAddress || home.WorkerEnabled {
+		t.Errorf("Unexpected settings of home %+v", home)
+	}
+	mobile, err := cfg.WithProfile("mobile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !mobile.WorkerEnabled || mobile.SniChunksLength != [2]int{5, 10} || len(mobile.PoisonCIDRs) != 0 || mobile.ActiveProfile != "mobile" {
+		t.Errorf("Unexpected settings of mobile %+v", mobile)
+	}
+	if len(cfg.PoisonCIDRs) != 1 || cfg.ActiveProfile != "home" {
+		t.Errorf("Expected the config to be left as it is")
+	}
+
+	if _, err := cfg.WithProfile("office"); err == nil {
+		t.Errorf("Expected an error for an unknown profile")
+	}
+	cfg.Profiles["office"] = json.RawMessage(`{"SniChunkLength": [1, 3], "ActiveProfile": "home"}`)
+	cfg.Profiles["typo"] = json.RawMessage(`{"SniChunkLength": [1, 3]}`)
+	cfg.Profiles["invalid"] = json.RawMessage(`{"SniChunksLength": [3, 1]}`)
+	err = cfg.Validate()
+	for _, want := range []string{
+		`profile "office": ActiveProfile can't be set by a profile`,
+		`profile "typo": unknown field "SniChunkLength", did you mean "SniChunksLength"?`,
+		"Profiles.invalid.SniChunksLength: min 3 is greater than max 1",
+	} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected %q, got %v", want, err)
+		}
+	}
+}
+
+func TestWriteProfile(t *testing.T) {
+	settings := map[string]interface{}{
+		"FragmentStrategy":   "sni",
+		"SniChunksLength":    [2]int{1, 1},
+		"DelayBetweenChunks": [2]int{5, 10},
+	}
+	for _, name := range []string{"config.json", "config.yaml", "config.toml"} {
+		path := filepath.Join(t.TempDir(), name)
+		if err := os.WriteFile(path, []byte(map[string]string{
+			FormatJSON: `{"BindAddress": "127.0.0.1:8085", "Profiles": {"home": {"SniChunksLength": [1, 3]}}}`,
+			FormatYAML: "BindAddress: 127.0.0.1:8085\nProfiles:\n  home:\n    SniChunksLength: [1, 3]\n",
+			FormatTOML: "BindAddress = \"127.0.0.1:8085\"\n[Profiles.home]\nSniChunksLength = [1, 3]\n",
+		}[FormatOf(path)]), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteProfile(path, "tuned", settings); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		cfg, err := LoadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cfg.BindAddress != "127.0.0.1:8085" || len(cfg.Profiles) != 2 {
+			t.Errorf("%s: Expected the rest of the file to be kept, got %+v", name, cfg)
+		}
+		tuned, err := cfg.WithProfile("tuned")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tuned.SniChunksLength != [2]int{1, 1} || tuned.DelayBetweenChunks != [2]int{5, 10} || tuned.FragmentStrategy != "sni" {
+			t.Errorf("%s: Unexpected settings of the written profile %+v", name, tuned)
+		}
+		if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0o600 {
+			t.Errorf("%s: Expected the file mode to be kept, got %v", name, info.Mode())
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "new.json")
+	if err := WriteProfile(path, "tuned", settings); err != nil {
+		t.Fatalf("Expected a missing file to be created, got %v", err)
+	}
+	if err := WriteProfile(path, "bad", map[string]interface{}{"SniChunkLength": [2]int{1, 1}}); err == nil {
+		t.Error("Expected an unknown field to be rejected")
+	}
+	if cfg, err := LoadFile(path); err != nil || len(cfg.Profiles) != 1 {
+		t.Errorf("Expected the file to be left alone by a rejected profile, got %v", err)
+	}
+}
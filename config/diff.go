@@ -0,0 +1,61 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+)
+
+// Change is a setting that differs between two configs.
+type Change struct {
+	Field string
+	Old   interface{}
+	New   interface{}
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %s -> %s", c.Field, format(c.Old), format(c.New))
+}
+
+// format formats a setting the way it's written in the config file.
+func format(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// Diff returns the settings that differ between a and b, in the order of the Config fields.
+func Diff(a, b *Config) []Change {
+	va, vb := reflect.ValueOf(a).Elem(), reflect.ValueOf(b).Elem()
+	t := va.Type()
+
+	var changes []Change
+	for i := 0; i < t.NumField(); i++ {
+		x, y := va.Field(i).Interface(), vb.Field(i).Interface()
+		if !reflect.DeepEqual(decodeRaw(x), decodeRaw(y)) {
+			changes = append(changes, Change{Field: t.Field(i).Name, Old: x, New: y})
+		}
+	}
+	return changes
+}
+
+// decodeRaw decodes the profiles, so they are compared by their settings and not by how
+// they are formatted. Other settings are returned as they are.
+func decodeRaw(v interface{}) interface{} {
+	profiles, ok := v.(map[string]json.RawMessage)
+	if !ok {
+		return v
+	}
+	decoded := make(map[string]interface{}, len(profiles))
+	for name, profile := range profiles {
+		var x interface{}
+		if err := json.Unmarshal(profile, &x); err != nil {
+			// compare what can't be decoded as it is
+			x = string(profile)
+		}
+		decoded[name] = x
+	}
+	return decoded
+}
@@ -0,0 +1,170 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// mixedCaseAcronyms are written in capitals before field names are split into words
+var mixedCaseAcronyms = strings.NewReplacer("DoH", "DOH")
+
+// Field is a setting of the Config that can be given as a string, by a command line flag
+// or an environment variable.
+type Field struct {
+	Name        string // Name of the Config field
+	Flag        string // Name of the command line flag, e.g. sni-chunks-length for SniChunksLength
+	Placeholder string // Describes the format of the value in the help
+	IsBool      bool   // Whether the field is a bool, so its flag doesn't need a value
+}
+
+// Fields returns the fields of the Config in order.
+func Fields() []Field {
+	t := reflect.TypeOf(Config{})
+	fields := make([]Field, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		fields = append(fields, Field{
+			Name:        f.Name,
+			Flag:        flagName(f.Name),
+			Placeholder: placeholder(f.Type),
+			IsBool:      f.Type.Kind() == reflect.Bool,
+		})
+	}
+	return fields
+}
+
+// Set sets the field called name from a string. Ranges are written as MIN,MAX and lists
+// as comma separated values, lists of objects and other values that have no simpler
+// form are written in JSON.
+func (c *Config) Set(name, value string) error {
+	v := reflect.ValueOf(c).Elem().FieldByName(name)
+	if !v.IsValid() {
+		return fmt.Errorf("unknown field %q", name)
+	}
+	if err := setValue(v, value); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+	return nil
+}
+
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+		return nil
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a bool", value)
+		}
+		v.SetBool(b)
+		return nil
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		v.SetInt(n)
+		return nil
+	case reflect.Array:
+		if v.Type() == reflect.TypeOf([2]int{}) && !strings.HasPrefix(value, "[") {
+			return setRange(v, value)
+		}
+	case reflect.Slice:
+		if !strings.HasPrefix(value, "[") {
+			return setList(v, value)
+		}
+	}
+	// anything else is JSON, decoded into a new value so the field is replaced, not merged
+	x := reflect.New(v.Type())
+	if err := decodeStrict([]byte(value), x.Interface()); err != nil {
+		return decodeError(nil, err)
+	}
+	v.Set(x.Elem())
+	return nil
+}
+
+// setRange sets a [2]int from "MIN,MAX", or from a single number for both.
+func setRange(v reflect.Value, value string) error {
+	parts := strings.Split(value, ",")
+	if len(parts) > 2 {
+		return fmt.Errorf("%q is not a range, expected MIN,MAX", value)
+	}
+	var r [2]int
+	for i, part := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return fmt.Errorf("%q is not a range, expected MIN,MAX", value)
+		}
+		r[i] = n
+	}
+	if len(parts) == 1 {
+		r[1] = r[0]
+	}
+	v.Set(reflect.ValueOf(r))
+	return nil
+}
+
+// setList sets a slice from comma separated values. Elements that aren't strings are
+// decoded from a JSON string, like DNSUpstream which accepts just its address.
+func setList(v reflect.Value, value string) error {
+	list := reflect.MakeSlice(v.Type(), 0, 0)
+	if value != "" {
+		for _, part := range strings.Split(value, ",") {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			part = strings.TrimSpace(part)
+			if elem.Kind() == reflect.String {
+				elem.SetString(part)
+			} else if err := json.Unmarshal([]byte(strconv.Quote(part)), elem.Addr().Interface()); err != nil {
+				return fmt.Errorf("%q: expected a JSON list of objects", value)
+			}
+			list = reflect.Append(list, elem)
+		}
+	}
+	v.Set(list)
+	return nil
+}
+
+// flagName turns a field name into a flag name, SniChunksLength becomes sni-chunks-length.
+func flagName(name string) string {
+	r := []rune(mixedCaseAcronyms.Replace(name))
+	var b strings.Builder
+	for i, c := range r {
+		if i > 0 && unicode.IsUpper(c) {
+			previousLower := unicode.IsLower(r[i-1])
+			// the last capital of an acronym starts the next word, unless it's followed
+			// by just the plural s of the acronym, like in PoisonCIDRs
+			nextLower := i+1 < len(r) && unicode.IsLower(r[i+1]) && !(r[i+1] == 's' && (i+2 == len(r) || unicode.IsUpper(r[i+2])))
+			if previousLower || (unicode.IsUpper(r[i-1]) && nextLower) {
+				b.WriteByte('-')
+			}
+		}
+		b.WriteRune(unicode.ToLower(c))
+	}
+	return b.String()
+}
+
+// placeholder describes the format of a value of type t.
+func placeholder(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "STRING"
+	case reflect.Bool:
+		return ""
+	case reflect.Int, reflect.Int64:
+		return "INT"
+	case reflect.Array:
+		if t == reflect.TypeOf([2]int{}) {
+			return "MIN,MAX"
+		}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.String || t.Elem() == reflect.TypeOf(DNSUpstream{}) {
+			return "A,B,..."
+		}
+	}
+	return "JSON"
+}
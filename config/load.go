@@ -0,0 +1,191 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// maxSuggestionDistance is the largest edit distance of a field name that's suggested for an unknown field
+const maxSuggestionDistance = 3
+
+// formats of config files
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+)
+
+// FormatOf returns the format of the config file at path by its extension, JSON is the default.
+func FormatOf(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	default:
+		return FormatJSON
+	}
+}
+
+// LoadFile loads the config file at path, its format is chosen by its extension.
+// Errors in the file are prefixed with its path.
+func LoadFile(path string) (*Config, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	cfg, err := LoadFormat(file, FormatOf(path))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Load decodes a JSON config from r, see LoadFormat.
+func Load(r io.Reader) (*Config, error) {
+	return LoadFormat(r, FormatJSON)
+}
+
+// LoadFormat decodes a config in format from r. YAML and TOML are converted to JSON first,
+// so every format is decoded the same way. Unknown fields are rejected, so a misspelled setting
+// isn't silently ignored, the error suggests the field that was probably meant.
+func LoadFormat(r io.Reader, format string) (*Config, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	// positions in converted documents don't point to the file, they're left out of the errors
+	source := data
+	var v interface{}
+	switch format {
+	case FormatJSON:
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("configuration file is not valid YAML: %w", err)
+		}
+		source = nil
+	case FormatTOML:
+		if err := toml.Unmarshal(data, &v); err != nil {
+			return nil, fmt.Errorf("configuration file is not valid TOML: %w", err)
+		}
+		source = nil
+	default:
+		return nil, fmt.Errorf("unknown config format %q", format)
+	}
+	if source == nil {
+		if data, err = json.Marshal(v); err != nil {
+			return nil, fmt.Errorf("unsupported %s config: %w", format, err)
+		}
+	}
+
+	cfg := &Config{}
+	if err := decodeStrict(data, cfg); err != nil {
+		return nil, decodeError(source, err)
+	}
+	return cfg, nil
+}
+
+// decodeStrict decodes JSON data into v and rejects unknown fields.
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
+
+// decodeError makes the errors of the JSON decoder point to where the problem is,
+// source is the decoded document or nil if the positions in it are meaningless.
+func decodeError(source []byte, err error) error {
+	line := func(offset int64) string {
+		if source == nil {
+			return ""
+		}
+		return fmt.Sprintf("line %d: ", lineOf(source, offset))
+	}
+	var syntaxErr *json.SyntaxError
+	if errors.As(err, &syntaxErr) {
+		return fmt.Errorf("not valid JSON: %s%v", line(syntaxErr.Offset), err)
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := typeErr.Field
+		if field == "" {
+			field = "value"
+		}
+		return fmt.Errorf("%s%s: expected %s, got %s", line(typeErr.Offset), field, typeErr.Type, typeErr.Value)
+	}
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		name, _ = strconv.Unquote(name)
+		if suggestion := suggestField(name); suggestion != "" {
+			return fmt.Errorf("unknown field %q, did you mean %q?", name, suggestion)
+		}
+		return fmt.Errorf("unknown field %q", name)
+	}
+	return err
+}
+
+// lineOf returns the line of the byte at offset in data.
+func lineOf(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// suggestField returns the field of the config, or of a value in it, whose name is closest to name.
+func suggestField(name string) string {
+	best, bestDistance := "", maxSuggestionDistance+1
+	for _, field := range fieldNames(reflect.TypeOf(Config{}), nil) {
+		if d := distance(strings.ToLower(name), strings.ToLower(field)); d < bestDistance {
+			best, bestDistance = field, d
+		}
+	}
+	return best
+}
+
+// fieldNames returns the names of the fields of t and of the structs it contains.
+func fieldNames(t reflect.Type, names []string) []string {
+	switch t.Kind() {
+	case reflect.Slice, reflect.Array, reflect.Pointer:
+		return fieldNames(t.Elem(), names)
+	case reflect.Struct:
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.IsExported() {
+				names = fieldNames(f.Type, append(names, f.Name))
+			}
+		}
+	}
+	return names
+}
+
+// distance returns the levenshtein distance of a and b.
+func distance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
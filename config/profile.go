@@ -0,0 +1,140 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// ProfileNames returns the names of the profiles in order.
+func (c *Config) ProfileNames() []string {
+	names := make([]string, 0, len(c.Profiles))
+	for name := range c.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// WithProfile returns a copy of the config with the settings of the named profile applied,
+// the settings that the profile leaves out are taken from the config. The profile "" is the
+// config without any profile. The copy keeps the profiles, so it can be switched again.
+func (c *Config) WithProfile(name string) (*Config, error) {
+	// copying through JSON makes sure the profile doesn't modify the slices of c
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	cfg.ActiveProfile = name
+	if name == "" {
+		return cfg, nil
+	}
+
+	profile, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile %q", name)
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(profile, &fields); err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, decodeError(nil, err))
+	}
+	for _, field := range []string{"Profiles", "ActiveProfile"} {
+		if _, ok := fields[field]; ok {
+			return nil, fmt.Errorf("profile %q: %s can't be set by a profile", name, field)
+		}
+	}
+	if err := decodeStrict(profile, cfg); err != nil {
+		return nil, fmt.Errorf("profile %q: %w", name, decodeError(nil, err))
+	}
+	return cfg, nil
+}
+
+// WriteProfile sets the profile called name of the config file at path to settings and
+// writes the file back in its format, the file is created if it doesn't exist. The rest of
+// the file is kept, but it's reformatted and comments are lost.
+func WriteProfile(path, name string, settings map[string]interface{}) error {
+	if name == "" {
+		return errors.New("missing profile name")
+	}
+	format := FormatOf(path)
+	mode := os.FileMode(0o644)
+	doc := map[string]interface{}{}
+	data, err := os.ReadFile(path)
+	switch {
+	case err == nil:
+		if info, err := os.Stat(path); err == nil {
+			mode = info.Mode().Perm()
+		}
+		if err := unmarshalFormat(data, format, &doc); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		if doc == nil {
+			doc = map[string]interface{}{}
+		}
+	case !errors.Is(err, os.ErrNotExist):
+		return err
+	}
+
+	profiles, ok := doc["Profiles"].(map[string]interface{})
+	if !ok {
+		if doc["Profiles"] != nil {
+			return fmt.Errorf("%s: Profiles is not an object", path)
+		}
+		profiles = map[string]interface{}{}
+	}
+	profiles[name] = settings
+	doc["Profiles"] = profiles
+
+	if data, err = marshalFormat(doc, format); err != nil {
+		return err
+	}
+	// the file must still load with the profile, so a bad setting doesn't break it
+	cfg, err := LoadFormat(bytes.NewReader(data), format)
+	if err != nil {
+		return fmt.Errorf("profile %q: %w", name, err)
+	}
+	if _, err := cfg.WithProfile(name); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, mode)
+}
+
+func unmarshalFormat(data []byte, format string, v interface{}) error {
+	switch format {
+	case FormatYAML:
+		return yaml.Unmarshal(data, v)
+	case FormatTOML:
+		return toml.Unmarshal(data, v)
+	default:
+		return json.Unmarshal(data, v)
+	}
+}
+
+func marshalFormat(v interface{}, format string) ([]byte, error) {
+	switch format {
+	case FormatYAML:
+		return yaml.Marshal(v)
+	case FormatTOML:
+		var b bytes.Buffer
+		if err := toml.NewEncoder(&b).Encode(v); err != nil {
+			return nil, err
+		}
+		return b.Bytes(), nil
+	default:
+		data, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(data, '\n'), nil
+	}
+}
@@ -0,0 +1,261 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bepass-org/bepass/doh"
+	"github.com/bepass-org/bepass/net/adapter/fragment"
+	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/route"
+	"github.com/bepass-org/bepass/upstream"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Validate checks the settings that would make the server fail to start or misbehave at runtime.
+// The config is checked with the active profile and with each of the other profiles applied,
+// so switching profiles at runtime can't fail. All problems are returned together, one error
+// per setting.
+func (c *Config) Validate() error {
+	active, err := c.WithProfile(c.ActiveProfile)
+	if err != nil {
+		return fmt.Errorf("ActiveProfile: %w", err)
+	}
+	var errs []error
+	// problems that the profiles share with the active config are only reported once
+	reported := map[string]bool{}
+	for _, e := range active.validate() {
+		reported[e.Error()] = true
+		errs = append(errs, prefixError(c.ActiveProfile, e))
+	}
+	for _, name := range c.ProfileNames() {
+		if name == c.ActiveProfile {
+			continue
+		}
+		cfg, err := c.WithProfile(name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, e := range cfg.validate() {
+			if !reported[e.Error()] {
+				errs = append(errs, prefixError(name, e))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// prefixError puts the profile before the field in an error of validate.
+func prefixError(profile string, err error) error {
+	if profile == "" {
+		return err
+	}
+	return fmt.Errorf("Profiles.%s.%w", profile, err)
+}
+
+// validate checks the settings of c, every error starts with the name of its field.
+func (c *Config) validate() []error {
+	var errs []error
+	check := func(field string, err error) {
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", field, err))
+		}
+	}
+
+	for _, r := range []struct {
+		field string
+		value [2]int
+	}{
+		{"TLSPaddingSize", c.TLSPaddingSize},
+		{"ChunksLengthBeforeSni", c.ChunksLengthBeforeSni},
+		{"SniChunksLength", c.SniChunksLength},
+		{"ChunksLengthAfterSni", c.ChunksLengthAfterSni},
+		{"FragmentChunksLength", c.FragmentChunksLength},
+		{"DelayBetweenChunks", c.DelayBetweenChunks},
+	} {
+		check(r.field, checkRange(r.value))
+	}
+	for _, n := range []struct {
+		field string
+		value int64
+	}{
+		{"DnsCacheTTL", int64(c.DnsCacheTTL)},
+		{"DnsCacheMinTTL", int64(c.DnsCacheMinTTL)},
+		{"DnsCacheSize", int64(c.DnsCacheSize)},
+		{"DnsCacheStaleTTL", int64(c.DnsCacheStaleTTL)},
+		{"DnsCacheSaveInterval", int64(c.DnsCacheSaveInterval)},
+		{"DnsRequestTimeout", int64(c.DnsRequestTimeout)},
+		{"DNSUpstreamCooldown", int64(c.DNSUpstreamCooldown)},
+		{"WorkerMuxConnections", int64(c.WorkerMuxConnections)},
+		{"FragmentOffset", int64(c.FragmentOffset)},
+		{"UDPReadTimeout", int64(c.UDPReadTimeout)},
+		{"UDPWriteTimeout", int64(c.UDPWriteTimeout)},
+		{"UDPLinkIdleTimeout", c.UDPLinkIdleTimeout},
+	} {
+		if n.value < 0 {
+			check(n.field, fmt.Errorf("%d is negative", n.value))
+		}
+	}
+
+	if c.BindAddress == "" {
+		check("BindAddress", errors.New("required"))
+	} else {
+		check("BindAddress", checkHostPort(c.BindAddress))
+	}
+	if c.DNSListenAddress != "" {
+		check("DNSListenAddress", checkHostPort(c.DNSListenAddress))
+	}
+	if c.UDPBindAddress != "" && net.ParseIP(c.UDPBindAddress) == nil {
+		check("UDPBindAddress", fmt.Errorf("%q is not an ip address", c.UDPBindAddress))
+	}
+
+	if c.WorkerEnabled || c.WorkerAddress != "" {
+		check("WorkerAddress", checkURL(c.WorkerAddress, "https"))
+	}
+	if c.WorkerEnabled || c.WorkerIPPortAddress != "" {
+		check("WorkerIPPortAddress", checkIPPort(c.WorkerIPPortAddress))
+	}
+
+	if len(c.DNSUpstreams) == 0 && !c.WorkerEnabled && c.RemoteDNSAddr == "" {
+		check("RemoteDNSAddr", errors.New("required if DNSUpstreams is empty"))
+	}
+	if c.RemoteDNSAddr != "" {
+		check("RemoteDNSAddr", c.checkUpstream(c.RemoteDNSAddr))
+	}
+	for i, u := range c.DNSUpstreams {
+		field := fmt.Sprintf("DNSUpstreams[%d]", i)
+		check(field, c.checkUpstream(u.Address))
+		var o doh.QueryOptions
+		check(field+".Method", doh.WithMethod(u.Method)(&o))
+		if u.ClientSubnet != "" && u.ClientSubnet != ClientSubnetNone {
+			if _, _, err := net.ParseCIDR(u.ClientSubnet); err != nil {
+				check(field+".ClientSubnet", fmt.Errorf("%q is neither a cidr nor %q", u.ClientSubnet, ClientSubnetNone))
+			}
+		}
+	}
+	switch c.DNSUpstreamStrategy {
+	case "", upstream.StrategyFallback, upstream.StrategyRace, upstream.StrategyWeighted:
+	default:
+		check("DNSUpstreamStrategy", fmt.Errorf("unknown strategy %q, expected %s, %s or %s", c.DNSUpstreamStrategy,
+			upstream.StrategyFallback, upstream.StrategyRace, upstream.StrategyWeighted))
+	}
+	if c.TrustedDNSAddr != "" {
+		check("TrustedDNSAddr", c.checkUpstream(c.TrustedDNSAddr))
+	}
+	if c.WorkerDoHAddr != "" {
+		check("WorkerDoHAddr", c.checkUpstream(c.WorkerDoHAddr))
+	}
+	_, err := resolve.NewPoisonDetector(c.PoisonCIDRs, c.PoisonCheckPrivate)
+	check("PoisonCIDRs", err)
+
+	for i, h := range c.Hosts {
+		if h.Domain == "" {
+			check(fmt.Sprintf("Hosts[%d].Domain", i), errors.New("required"))
+		}
+		if net.ParseIP(h.IP) == nil {
+			check(fmt.Sprintf("Hosts[%d].IP", i), fmt.Errorf("%q is not an ip address", h.IP))
+		}
+	}
+
+	_, err = fragment.NewStrategy(fragment.Config{Strategy: c.FragmentStrategy})
+	check("FragmentStrategy", err)
+	// the record length is read from the last 2 bytes of the header, which only tls headers have
+	if c.TLSHeaderLength != 0 && c.TLSHeaderLength != 5 {
+		check("TLSHeaderLength", fmt.Errorf("%d is not supported, tls record headers are 5 bytes", c.TLSHeaderLength))
+	}
+
+	// the default route is chosen by the server if it isn't set, any valid action will do here
+	defaultRoute := c.DefaultRoute
+	if defaultRoute == "" {
+		defaultRoute = route.ActionFragment
+	}
+	_, err = route.New(c.Rules, defaultRoute)
+	check("Rules", err)
+
+	return errs
+}
+
+// checkRange checks a [min, max] setting.
+func checkRange(r [2]int) error {
+	if r[0] < 0 {
+		return fmt.Errorf("min %d is negative", r[0])
+	}
+	if r[0] > r[1] {
+		return fmt.Errorf("min %d is greater than max %d", r[0], r[1])
+	}
+	return nil
+}
+
+// checkHostPort checks a host:port address to listen on.
+func checkHostPort(address string) error {
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	return checkPort(port)
+}
+
+// checkIPPort checks an ip:port address.
+func checkIPPort(address string) error {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if net.ParseIP(host) == nil {
+		return fmt.Errorf("%q is not an ip address", host)
+	}
+	return checkPort(port)
+}
+
+func checkPort(port string) error {
+	if n, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return fmt.Errorf("invalid port %q", port)
+	} else if n == 0 {
+		return errors.New("port 0 is not allowed")
+	}
+	return nil
+}
+
+// checkURL checks that address is a url with a host and one of the schemes.
+func checkURL(address string, schemes ...string) error {
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	if !slices.Contains(schemes, u.Scheme) {
+		return fmt.Errorf("%q has scheme %q, expected %s", address, u.Scheme, strings.Join(schemes, ", "))
+	}
+	if u.Host == "" {
+		return fmt.Errorf("%q has no host", address)
+	}
+	return nil
+}
+
+// checkUpstream checks the address of a dns upstream, see upstream.New.
+func (c *Config) checkUpstream(address string) error {
+	if address == UpstreamWorker {
+		if c.WorkerAddress == "" {
+			return fmt.Errorf("%q needs WorkerAddress", UpstreamWorker)
+		}
+		return nil
+	}
+	u, err := url.Parse(address)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case upstream.SchemeDoH, upstream.SchemeDoT, upstream.SchemeDoQ:
+		if u.Host == "" {
+			return fmt.Errorf("%q has no host", address)
+		}
+		return nil
+	case "sdns":
+		return nil
+	}
+	return fmt.Errorf("%q has scheme %q, expected %s, %s, %s or sdns", address, u.Scheme,
+		upstream.SchemeDoH, upstream.SchemeDoT, upstream.SchemeDoQ)
+}
@@ -2,6 +2,8 @@
 package dialer
 
 import (
+	"errors"
+	"github.com/bepass-org/bepass/logger"
 	"github.com/bepass-org/bepass/net/adapter/fragment"
 	"github.com/bepass-org/bepass/net/adapter/http"
 	"net"
@@ -12,10 +14,29 @@ type PlainTCPDial func(network, addr string) (net.Conn, error)
 
 // Dialer is a struct that holds various options for custom dialing.
 type Dialer struct {
-	EnableLowLevelSockets bool   // Enable low-level socket operations.
-	TLSPaddingEnabled     bool   // Enable TLS padding.
-	TLSPaddingSize        [2]int // Size of TLS padding.
-	ProxyAddress          string // Address of the proxy server.
+	EnableLowLevelSockets bool            // Enable low-level socket operations.
+	TLSPaddingEnabled     bool            // Enable TLS padding.
+	TLSPaddingSize        [2]int          // Size of TLS padding.
+	ProxyAddress          string          // Address of the proxy server.
+	Fragment              fragment.Config // Fragmentation of connections made by FragmentDial.
+}
+
+// DialAny dials the addresses in turn and returns the first connection that succeeds,
+// so that a host with several addresses stays reachable while some of them are not.
+func DialAny(dial PlainTCPDial, network string, addrs []string) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to dial")
+	}
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		conn, err = dial(network, addr)
+		if err == nil {
+			return conn, nil
+		}
+		logger.Infof("failed to dial %s: %v", addr, err)
+	}
+	return nil, err
 }
 
 func (d *Dialer) FragmentDial(network, addr string) (net.Conn, error) {
@@ -27,7 +48,7 @@ func (d *Dialer) FragmentDial(network, addr string) (net.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
-	return fragment.New(tcpConn), nil
+	return fragment.New(tcpConn, d.Fragment), nil
 }
 
 func (d *Dialer) HttpDial(network, addr string) (net.Conn, error) {
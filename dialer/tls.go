@@ -244,7 +244,6 @@ func (d *Dialer) TLSDial(plainDialer PlainTCPDial, network, addr string) (net.Co
 		utlsConn, handshakeErr := d.makeTLSHelloPacketWithPadding(plainConn, &config, sni)
 		if handshakeErr != nil {
 			_ = plainConn.Close()
-			fmt.Println(handshakeErr)
 			return nil, handshakeErr
 		}
 		return utlsConn, nil
@@ -256,13 +255,13 @@ func (d *Dialer) TLSDial(plainDialer PlainTCPDial, network, addr string) (net.Co
 
 	err = utlsClient.ApplyPreset(removeProtocolFromALPN(&spec, "h2"))
 	if err != nil {
+		_ = plainConn.Close()
 		return nil, err
 	}
 
 	err = utlsClient.Handshake()
 	if err != nil {
 		_ = plainConn.Close()
-		fmt.Println(err)
 		return nil, err
 	}
 	return utlsClient, nil
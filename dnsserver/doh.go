@@ -0,0 +1,77 @@
+package dnsserver
+
+import (
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// dohMediaType is the content type of DNS-over-HTTPS messages (RFC 8484).
+const dohMediaType = "application/dns-message"
+
+// serveHTTP answers DNS-over-HTTPS queries sent with GET or POST.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	var (
+		buf []byte
+		err error
+	)
+	switch r.Method {
+	case http.MethodGet:
+		// the parameter is unpadded base64url, padding is tolerated
+		buf, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get("dns"), "="))
+	case http.MethodPost:
+		if r.Header.Get("Content-Type") != dohMediaType {
+			http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+			return
+		}
+		buf, err = io.ReadAll(io.LimitReader(r.Body, dns.MaxMsgSize))
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	req := new(dns.Msg)
+	if err := req.Unpack(buf); err != nil {
+		http.Error(w, "invalid dns message", http.StatusBadRequest)
+		return
+	}
+
+	resp := s.exchange(req)
+	out, err := resp.Pack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", dohMediaType)
+	if ttl, ok := minTTL(resp); ok {
+		w.Header().Set("Cache-Control", "max-age="+strconv.FormatUint(uint64(ttl), 10))
+	}
+	_, _ = w.Write(out)
+}
+
+// minTTL returns the lowest ttl of the records in the response.
+func minTTL(m *dns.Msg) (uint32, bool) {
+	var (
+		ttl   uint32
+		found bool
+	)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns} {
+		for _, rr := range section {
+			if !found || rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+				found = true
+			}
+		}
+	}
+	return ttl, found
+}
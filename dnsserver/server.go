@@ -0,0 +1,204 @@
+// Package dnsserver provides a local DNS server that answers plain DNS over UDP and TCP,
+// and DNS-over-HTTPS queries on the same TCP port, by handing every query to an Exchanger.
+package dnsserver
+
+import (
+	"bufio"
+	"errors"
+	"github.com/bepass-org/bepass/logger"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DoHPath is the path that DNS-over-HTTPS queries are served on.
+const DoHPath = "/dns-query"
+
+// sniffTimeout bounds the wait for the first bytes of a tcp connection
+const sniffTimeout = 10 * time.Second
+
+// Exchanger answers DNS queries, the server.Server of bepass implements it.
+type Exchanger interface {
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+}
+
+// Server is a DNS server listening on the same address for udp and tcp.
+// Tcp connections that start with an http request are served as DNS-over-HTTPS,
+// all others as DNS over TCP.
+type Server struct {
+	addr      string
+	exchanger Exchanger
+
+	mu        sync.Mutex
+	listener  net.Listener
+	udp       *dns.Server
+	tcp       *dns.Server
+	http      *http.Server
+	dnsConns  *connListener
+	httpConns *connListener
+}
+
+// New creates a Server that answers queries on addr with exchanger.
+func New(addr string, exchanger Exchanger) *Server {
+	return &Server{addr: addr, exchanger: exchanger}
+}
+
+// ListenAndServe listens on the udp and tcp address of the server and serves
+// queries until the server is shut down.
+func (s *Server) ListenAndServe() error {
+	pc, err := net.ListenPacket("udp", s.addr)
+	if err != nil {
+		return err
+	}
+	// listen on the port that was actually bound, in case the address has port 0
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		_ = pc.Close()
+		return err
+	}
+	return s.Serve(pc, l)
+}
+
+// Serve serves queries on pc and l until the server is shut down.
+func (s *Server) Serve(pc net.PacketConn, l net.Listener) error {
+	handler := dns.HandlerFunc(s.serveDNS)
+	mux := http.NewServeMux()
+	mux.HandleFunc(DoHPath, s.serveHTTP)
+
+	s.mu.Lock()
+	s.listener = l
+	s.dnsConns = newConnListener(l.Addr())
+	s.httpConns = newConnListener(l.Addr())
+	s.udp = &dns.Server{PacketConn: pc, Handler: handler}
+	s.tcp = &dns.Server{Listener: s.dnsConns, Handler: handler}
+	s.http = &http.Server{Handler: mux, ReadHeaderTimeout: sniffTimeout}
+	s.mu.Unlock()
+
+	errCh := make(chan error, 4)
+	go func() { errCh <- s.udp.ActivateAndServe() }()
+	go func() { errCh <- s.tcp.ActivateAndServe() }()
+	go func() {
+		err := s.http.Serve(s.httpConns)
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+		errCh <- err
+	}()
+	go func() { errCh <- s.accept(l) }()
+
+	// the first of them to stop takes the others down
+	err := <-errCh
+	if err != nil {
+		_ = s.Shutdown()
+	}
+	return err
+}
+
+// Shutdown stops the server and closes its listeners.
+func (s *Server) Shutdown() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.listener == nil {
+		return nil
+	}
+
+	err := s.listener.Close()
+	if e := s.http.Close(); err == nil {
+		err = e
+	}
+	if e := s.udp.Shutdown(); err == nil {
+		err = e
+	}
+	if e := s.tcp.Shutdown(); err == nil {
+		err = e
+	}
+	s.httpConns.Close()
+	s.dnsConns.Close()
+	s.listener = nil
+	return err
+}
+
+// accept sniffs the first bytes of every tcp connection and hands it to the http or dns server.
+func (s *Server) accept(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go s.dispatch(conn)
+	}
+}
+
+func (s *Server) dispatch(conn net.Conn) {
+	br := bufio.NewReader(conn)
+	_ = conn.SetReadDeadline(time.Now().Add(sniffTimeout))
+	head, err := br.Peek(4)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	c := &bufferedConn{Conn: conn, r: br}
+	if isHTTP(head) {
+		s.httpConns.push(c)
+	} else {
+		s.dnsConns.push(c)
+	}
+}
+
+// isHTTP reports whether a connection starts with an http request. A dns over tcp
+// connection starts with the two byte message length instead, which can't be mistaken
+// for these methods unless the message is longer than 16 KB.
+func isHTTP(head []byte) bool {
+	switch string(head) {
+	case "GET ", "POST", "HEAD", "OPTI":
+		return true
+	}
+	return false
+}
+
+// serveDNS answers queries over udp and tcp.
+func (s *Server) serveDNS(w dns.ResponseWriter, req *dns.Msg) {
+	resp := s.exchange(req)
+	if _, ok := w.RemoteAddr().(*net.UDPAddr); ok {
+		resp.Truncate(udpSize(req))
+	}
+	if err := w.WriteMsg(resp); err != nil {
+		logger.Errorf("failed to write dns response to %s: %v", w.RemoteAddr(), err)
+	}
+}
+
+// exchange answers req, failures are answered with a SERVFAIL response.
+func (s *Server) exchange(req *dns.Msg) *dns.Msg {
+	if len(req.Question) != 1 {
+		resp := new(dns.Msg)
+		resp.SetRcodeFormatError(req)
+		return resp
+	}
+
+	resp, err := s.exchanger.Exchange(req)
+	if err != nil {
+		logger.Errorf("dns query for %s failed: %v", req.Question[0].Name, err)
+		resp = new(dns.Msg)
+		resp.SetRcode(req, dns.RcodeServerFailure)
+		resp.RecursionAvailable = true
+		return resp
+	}
+	resp.Id = req.Id
+	return resp
+}
+
+// udpSize returns the largest response that the client accepts over udp.
+func udpSize(req *dns.Msg) int {
+	if opt := req.IsEdns0(); opt != nil && opt.UDPSize() > dns.MinMsgSize {
+		return int(opt.UDPSize())
+	}
+	return dns.MinMsgSize
+}
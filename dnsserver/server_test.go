@@ -0,0 +1,129 @@
+package dnsserver
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// staticExchanger answers A queries for example.com and fails all others
+type staticExchanger struct{}
+
+func (staticExchanger) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	if q.Name != "example.com." || q.Qtype != dns.TypeA {
+		return nil, errors.New("no upstream")
+	}
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("93.184.216.34").To4(),
+	})
+	return resp, nil
+}
+
+func startServer(t *testing.T) string {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", pc.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := New("", staticExchanger{})
+	go func() { _ = srv.Serve(pc, l) }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+	return pc.LocalAddr().String()
+}
+
+func checkAnswer(t *testing.T, resp *dns.Msg) {
+	t.Helper()
+	if resp.Rcode != dns.RcodeSuccess || len(resp.Answer) != 1 {
+		t.Fatalf("Expected one answer, got %v", resp)
+	}
+	if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "93.184.216.34" {
+		t.Errorf("Expected 93.184.216.34, got %v", resp.Answer[0])
+	}
+}
+
+func TestServeDNS(t *testing.T) {
+	addr := startServer(t)
+
+	for _, network := range []string{"udp", "tcp"} {
+		t.Run(network, func(t *testing.T) {
+			c := &dns.Client{Net: network, Timeout: 5 * time.Second}
+
+			req := new(dns.Msg)
+			req.SetQuestion("example.com.", dns.TypeA)
+			resp, _, err := c.Exchange(req, addr)
+			if err != nil {
+				t.Fatalf("Exchange failed: %v", err)
+			}
+			if resp.Id != req.Id {
+				t.Errorf("Expected id %d, got %d", req.Id, resp.Id)
+			}
+			checkAnswer(t, resp)
+
+			req.SetQuestion("example.org.", dns.TypeMX)
+			resp, _, err = c.Exchange(req, addr)
+			if err != nil {
+				t.Fatalf("Exchange failed: %v", err)
+			}
+			if resp.Rcode != dns.RcodeServerFailure {
+				t.Errorf("Expected SERVFAIL, got %s", dns.RcodeToString[resp.Rcode])
+			}
+		})
+	}
+}
+
+func TestServeDoH(t *testing.T) {
+	addr := startServer(t)
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	buf, err := req.Pack()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func() (*http.Response, error) {
+		return client.Get("http://" + addr + DoHPath + "?dns=" + base64.RawURLEncoding.EncodeToString(buf))
+	}
+	post := func() (*http.Response, error) {
+		return client.Post("http://"+addr+DoHPath, dohMediaType, bytes.NewReader(buf))
+	}
+
+	for name, do := range map[string]func() (*http.Response, error){"GET": get, "POST": post} {
+		do := do
+		t.Run(name, func(t *testing.T) {
+			resp, err := do()
+			if err != nil {
+				t.Fatalf("DoH request failed: %v", err)
+			}
+			defer resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+			}
+			if cc := resp.Header.Get("Cache-Control"); cc != "max-age=60" {
+				t.Errorf("Expected max-age=60, got %q", cc)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			m := new(dns.Msg)
+			if err := m.Unpack(body); err != nil {
+				t.Fatalf("Unpack failed: %v", err)
+			}
+			checkAnswer(t, m)
+		})
+	}
+}
@@ -2,13 +2,19 @@
 package doh
 
 import (
+	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/base64"
 	"errors"
-	"github.com/bepass-org/bepass/config"
+	"fmt"
 	"github.com/bepass-org/bepass/dialer"
 	"github.com/bepass-org/bepass/resolve"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/miekg/dns"
@@ -19,6 +25,9 @@ type ClientOptions struct {
 	EnableDNSFragment bool                   // Enable DNS fragmentation
 	Dialer            *dialer.Dialer         // Custom dialer for HTTP requests
 	LocalResolver     *resolve.LocalResolver // Local DNS resolver
+	Upstream          string                 // DoH server used when no address is given
+	Proxy             bool                   // Send requests through the proxy of the dialer
+	BootstrapIP       string                 // IP address the host of the upstream is connected to
 }
 
 // ClientOption is a function type used for setting client options.
@@ -40,7 +49,8 @@ func WithDNSFragmentation(f bool) ClientOption {
 	}
 }
 
-// WithLocalResolver sets the local DNS resolver for the DoH client.
+// WithLocalResolver sets the local DNS resolver for the DoH client,
+// the host of a DoH server found in its hosts is connected to without a lookup.
 func WithLocalResolver(r *resolve.LocalResolver) ClientOption {
 	return func(o *ClientOptions) error {
 		o.LocalResolver = r
@@ -48,26 +58,128 @@ func WithLocalResolver(r *resolve.LocalResolver) ClientOption {
 	}
 }
 
+// WithUpstream sets the DoH server that queries are sent to when Exchange is called without an address.
+func WithUpstream(address string) ClientOption {
+	return func(o *ClientOptions) error {
+		if _, err := url.Parse(address); err != nil {
+			return err
+		}
+		o.Upstream = address
+		return nil
+	}
+}
+
+// WithProxy enables or disables sending DoH requests through the proxy of the dialer.
+func WithProxy(p bool) ClientOption {
+	return func(o *ClientOptions) error {
+		o.Proxy = p
+		return nil
+	}
+}
+
+// WithBootstrapIP sets the IP address that the host of the upstream is connected to,
+// so that it doesn't have to be looked up.
+func WithBootstrapIP(ip string) ClientOption {
+	return func(o *ClientOptions) error {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid bootstrap ip %q", ip)
+		}
+		o.BootstrapIP = ip
+		return nil
+	}
+}
+
 // Client represents a DNS-over-HTTPS (DoH) client.
 type Client struct {
-	opt *ClientOptions
+	opt          *ClientOptions
+	upstreamHost string
+	httpClient   *http.Client
 }
 
 // NewClient creates a new DoH client with the provided options.
-func NewClient(opts ...ClientOption) *Client {
+func NewClient(opts ...ClientOption) (*Client, error) {
 	o := &ClientOptions{}
 	for _, f := range opts {
-		f(o)
+		if err := f(o); err != nil {
+			return nil, err
+		}
+	}
+	if o.Dialer == nil {
+		o.Dialer = &dialer.Dialer{}
 	}
-	return &Client{
+
+	c := &Client{
 		opt: o,
 	}
+	if o.Upstream != "" {
+		u, _ := url.Parse(o.Upstream)
+		c.upstreamHost = u.Hostname()
+	}
+	if o.BootstrapIP != "" && c.upstreamHost == "" {
+		return nil, errors.New("a bootstrap ip needs an upstream")
+	}
+	c.httpClient = c.makeHTTPClient()
+	return c, nil
+}
+
+// makeHTTPClient creates the HTTP client that DoH requests are sent with.
+func (c *Client) makeHTTPClient() *http.Client {
+	d := c.opt.Dialer
+	plainDial := func(network, addr string) (net.Conn, error) {
+		addr = c.bootstrap(addr)
+		// requests through the proxy are fragmented by the proxy itself
+		if c.opt.EnableDNSFragment && !c.opt.Proxy {
+			return d.FragmentDial(network, addr)
+		}
+		return d.TCPDial(network, addr)
+	}
+	transport := &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: false,
+		DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return plainDial(network, addr)
+		},
+		DialTLSContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+			return d.TLSDial(plainDial, network, addr)
+		},
+	}
+	if c.opt.Proxy {
+		proxyURL, _ := url.Parse(d.ProxyAddress)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	return &http.Client{Transport: transport}
+}
+
+// bootstrap returns the address to connect to for addr. The host of the upstream is replaced
+// with the bootstrap ip, other hosts are looked up in the hosts of the local resolver.
+func (c *Client) bootstrap(addr string) string {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return addr
+	}
+	if c.opt.BootstrapIP != "" && host == c.upstreamHost {
+		return net.JoinHostPort(c.opt.BootstrapIP, port)
+	}
+	if c.opt.LocalResolver != nil {
+		if ip := c.opt.LocalResolver.CheckHosts(host); ip != "" {
+			return net.JoinHostPort(ip, port)
+		}
+	}
+	return addr
 }
 
 // HTTPClient performs an HTTP GET request to the given address using the configured client.
 func (c *Client) HTTPClient(address string) ([]byte, error) {
-	client := c.opt.Dialer.MakeHTTPClient(config.G.WorkerEnabled)
-	resp, err := client.Get(address)
+	req, err := http.NewRequest(http.MethodGet, address, nil)
+	if err != nil {
+		return nil, err
+	}
+	return c.do(req)
+}
+
+// do sends the DoH request and returns the body of the response.
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	resp, err := c.httpClient.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -85,35 +197,75 @@ func (c *Client) HTTPClient(address string) ([]byte, error) {
 	return content, nil
 }
 
-// Exchange performs a DNS query using DoH to the specified address.
-func (c *Client) Exchange(req *dns.Msg, address string) (r *dns.Msg, rtt time.Duration, err error) {
+// Exchange performs a DNS query using DoH to the specified address, or to the upstream of the client
+// if the address is empty.
+func (c *Client) Exchange(req *dns.Msg, address string, opts ...QueryOption) (r *dns.Msg, rtt time.Duration, err error) {
 	var (
-		buf, b64 []byte
-		begin    = time.Now()
-		origID   = req.Id
+		buf   []byte
+		begin = time.Now()
+		o     = &QueryOptions{Method: http.MethodGet}
 	)
+	for _, f := range opts {
+		if err = f(o); err != nil {
+			return
+		}
+	}
 
+	// the query is modified, the caller's message is left as it is
+	q := req.Copy()
 	// Set DNS ID as zero according to RFC8484 (cache-friendly)
-	req.Id = 0
-	buf, err = req.Pack()
+	q.Id = 0
+	if o.StripClientSubnet {
+		removeOption(q, dns.EDNS0SUBNET)
+	}
+	if o.ClientSubnet != nil {
+		setClientSubnet(q, o.ClientSubnet)
+	}
+	// padding comes last, it depends on the size of everything else
+	if o.Padding {
+		pad(q, paddingBlockSize)
+	}
+	buf, err = q.Pack()
 	if err != nil {
 		return
 	}
-	b64 = make([]byte, base64.RawURLEncoding.EncodedLen(len(buf)))
-	base64.RawURLEncoding.Encode(b64, buf)
 
-	if config.G.WorkerEnabled {
-		address = "https://8.8.4.4/dns-query"
+	if address == "" {
+		address = c.opt.Upstream
+	}
+	if address == "" {
+		err = errors.New("no DoH server")
+		return
+	}
+
+	var httpReq *http.Request
+	if o.Method == http.MethodPost {
+		httpReq, err = http.NewRequest(http.MethodPost, address, bytes.NewReader(buf))
+		if err != nil {
+			return
+		}
+		httpReq.Header.Set("Content-Type", mimeType)
+	} else {
+		// the address may already have a query, like the session of a relay
+		sep := "?"
+		if strings.Contains(address, "?") {
+			sep = "&"
+		}
+		httpReq, err = http.NewRequest(http.MethodGet, address+sep+"dns="+base64.RawURLEncoding.EncodeToString(buf), nil)
+		if err != nil {
+			return
+		}
 	}
+	httpReq.Header.Set("Accept", mimeType)
 
-	content, err := c.HTTPClient(address + "?dns=" + string(b64))
+	content, err := c.do(httpReq)
 	if err != nil {
 		return
 	}
 
 	r = new(dns.Msg)
 	err = r.Unpack(content)
-	r.Id = origID
+	r.Id = req.Id
 	rtt = time.Since(begin)
 	return
 }
@@ -0,0 +1,179 @@
+package doh
+
+import (
+	"encoding/base64"
+	"github.com/bepass-org/bepass/dialer"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchange(t *testing.T) {
+	var method string
+	var query *dns.Msg
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var buf []byte
+		var err error
+		method = r.Method
+		if r.Method == http.MethodPost {
+			buf, err = io.ReadAll(r.Body)
+		} else {
+			buf, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		query = new(dns.Msg)
+		if err := query.Unpack(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		out, _ := resp.Pack()
+		w.Header().Set("Content-Type", mimeType)
+		_, _ = w.Write(out)
+	}))
+	defer srv.Close()
+
+	c, err := NewClient(WithDialer(&dialer.Dialer{}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("203.0.113.0/24")
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("198.51.100.0").To4(),
+	})
+
+	testCases := []struct {
+		name   string
+		opts   []QueryOption
+		method string
+		subnet string
+	}{
+		{"default", nil, http.MethodGet, "198.51.100.0/24"},
+		{"post", []QueryOption{WithMethod("post")}, http.MethodPost, "198.51.100.0/24"},
+		{"set subnet", []QueryOption{WithClientSubnet(subnet)}, http.MethodGet, "203.0.113.0/24"},
+		{"strip subnet", []QueryOption{WithoutClientSubnet()}, http.MethodGet, ""},
+	}
+	for _, tc := range testCases {
+		resp, _, err := c.Exchange(req, srv.URL, tc.opts...)
+		if err != nil {
+			t.Fatalf("%s: Exchange failed: %v", tc.name, err)
+		}
+		if resp.Id != req.Id {
+			t.Errorf("%s: Expected id %d, got %d", tc.name, req.Id, resp.Id)
+		}
+		if query.Id != 0 {
+			t.Errorf("%s: Expected the query id to be zero", tc.name)
+		}
+		if method != tc.method {
+			t.Errorf("%s: Expected %s, got %s", tc.name, tc.method, method)
+		}
+		var got string
+		for _, o := range query.IsEdns0().Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok {
+				bits := 128
+				if ecs.Family == 1 {
+					bits = 32
+				}
+				got = (&net.IPNet{IP: ecs.Address, Mask: net.CIDRMask(int(ecs.SourceNetmask), bits)}).String()
+			}
+		}
+		if got != tc.subnet {
+			t.Errorf("%s: Expected client subnet %q, got %q", tc.name, tc.subnet, got)
+		}
+	}
+	// the query of an address that already has one is kept
+	if _, _, err := c.Exchange(req, srv.URL+"/dns-query?session=test"); err != nil {
+		t.Errorf("Expected the query to be added to the address, got %v", err)
+	}
+
+	if len(req.IsEdns0().Option) != 1 || req.Id == 0 {
+		t.Errorf("Expected the request to be left as it is")
+	}
+
+	if _, _, err := c.Exchange(req, srv.URL, WithMethod("PUT")); err == nil {
+		t.Errorf("Expected an error for an unsupported method")
+	}
+}
+
+func TestPadding(t *testing.T) {
+	for _, name := range []string{"a.io.", "example.com.", "a-rather-long-name-that-takes-more-space.example.com."} {
+		req := new(dns.Msg)
+		req.SetQuestion(name, dns.TypeAAAA)
+		pad(req, paddingBlockSize)
+		buf, err := req.Pack()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(buf)%paddingBlockSize != 0 {
+			t.Errorf("Expected the query for %s to be padded to a multiple of %d, got %d", name, paddingBlockSize, len(buf))
+		}
+	}
+}
+
+func TestClientUpstream(t *testing.T) {
+	var host string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host = r.Host
+		buf, _ := base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		query := new(dns.Msg)
+		if err := query.Unpack(buf); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp := new(dns.Msg)
+		resp.SetReply(query)
+		out, _ := resp.Pack()
+		_, _ = w.Write(out)
+	}))
+	defer srv.Close()
+	_, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+
+	// the host of the upstream is connected to at the bootstrap ip
+	upstream := "http://doh.example:" + port + "/dns-query"
+	c, err := NewClient(WithUpstream(upstream), WithBootstrapIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a second client with another upstream in the same process
+	other, err := NewClient(WithUpstream(srv.URL + "/dns-query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	if _, _, err := c.Exchange(req, ""); err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if host != "doh.example:"+port {
+		t.Errorf("Expected the request for doh.example, got %s", host)
+	}
+	if _, _, err := other.Exchange(req, ""); err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if host != srv.Listener.Addr().String() {
+		t.Errorf("Expected the request for %s, got %s", srv.Listener.Addr(), host)
+	}
+
+	if _, err := NewClient(WithBootstrapIP("127.0.0.1")); err == nil {
+		t.Errorf("Expected an error for a bootstrap ip without an upstream")
+	}
+	if _, err := NewClient(WithBootstrapIP("doh.example")); err == nil {
+		t.Errorf("Expected an error for an invalid bootstrap ip")
+	}
+	if _, _, err := (&Client{opt: &ClientOptions{}}).Exchange(req, ""); err == nil {
+		t.Errorf("Expected an error without a DoH server")
+	}
+}
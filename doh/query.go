@@ -0,0 +1,123 @@
+package doh
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// mimeType is the media type of DoH requests and responses (RFC 8484)
+	mimeType = "application/dns-message"
+	// paddingBlockSize is the block size queries are padded to (RFC 8467)
+	paddingBlockSize = 128
+	// ednsUDPSize is the udp payload size advertised when an OPT record is added to a query
+	ednsUDPSize = 1232
+)
+
+// QueryOptions represents options for a single DoH query.
+type QueryOptions struct {
+	Method            string     // HTTP method of the request, GET or POST
+	Padding           bool       // Pad the query so its size doesn't leak the length of the name
+	ClientSubnet      *net.IPNet // EDNS Client Subnet sent with the query
+	StripClientSubnet bool       // Remove the EDNS Client Subnet of the query
+}
+
+// QueryOption is a function type used for setting query options.
+type QueryOption func(*QueryOptions) error
+
+// WithMethod sets the HTTP method of DoH requests, GET or POST. GET is used by default.
+func WithMethod(method string) QueryOption {
+	return func(o *QueryOptions) error {
+		switch m := strings.ToUpper(method); m {
+		case "":
+		case http.MethodGet, http.MethodPost:
+			o.Method = m
+		default:
+			return fmt.Errorf("unsupported DoH method %q", method)
+		}
+		return nil
+	}
+}
+
+// WithPadding enables or disables EDNS padding of queries to a multiple of 128 bytes (RFC 7830, RFC 8467).
+func WithPadding(p bool) QueryOption {
+	return func(o *QueryOptions) error {
+		o.Padding = p
+		return nil
+	}
+}
+
+// WithClientSubnet sets the EDNS Client Subnet of queries (RFC 7871), replacing the one of the query.
+// CDNs answer with servers close to this subnet.
+func WithClientSubnet(subnet *net.IPNet) QueryOption {
+	return func(o *QueryOptions) error {
+		o.ClientSubnet = subnet
+		return nil
+	}
+}
+
+// WithoutClientSubnet removes the EDNS Client Subnet of queries, so the upstream doesn't learn it.
+func WithoutClientSubnet() QueryOption {
+	return func(o *QueryOptions) error {
+		o.StripClientSubnet = true
+		return nil
+	}
+}
+
+// edns returns the OPT record of m, it's added if m has none.
+func edns(m *dns.Msg) *dns.OPT {
+	if opt := m.IsEdns0(); opt != nil {
+		return opt
+	}
+	m.SetEdns0(ednsUDPSize, false)
+	return m.IsEdns0()
+}
+
+// removeOption removes the EDNS options with code from m.
+func removeOption(m *dns.Msg, code uint16) {
+	opt := m.IsEdns0()
+	if opt == nil {
+		return
+	}
+	options := opt.Option[:0]
+	for _, o := range opt.Option {
+		if o.Option() != code {
+			options = append(options, o)
+		}
+	}
+	opt.Option = options
+}
+
+// setClientSubnet sets the EDNS Client Subnet of m to subnet.
+func setClientSubnet(m *dns.Msg, subnet *net.IPNet) {
+	removeOption(m, dns.EDNS0SUBNET)
+	ones, _ := subnet.Mask.Size()
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		SourceNetmask: uint8(ones),
+	}
+	if ip4 := subnet.IP.To4(); ip4 != nil {
+		ecs.Family = 1
+		ecs.Address = ip4
+	} else {
+		ecs.Family = 2
+		ecs.Address = subnet.IP
+	}
+	opt := edns(m)
+	opt.Option = append(opt.Option, ecs)
+}
+
+// pad adds an EDNS padding option to m so that its packed size is a multiple of block.
+func pad(m *dns.Msg, block int) {
+	removeOption(m, dns.EDNS0PADDING)
+	padding := &dns.EDNS0_PADDING{}
+	opt := edns(m)
+	opt.Option = append(opt.Option, padding)
+	if r := m.Len() % block; r != 0 {
+		padding.Padding = make([]byte, block-r)
+	}
+}
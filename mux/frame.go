@@ -0,0 +1,66 @@
+// Package mux carries many tcp streams over one connection, like smux or yamux. Every frame
+// names the stream it belongs to, and each stream has a window of bytes that the sender may
+// have in flight, so a slow stream doesn't hold up the others.
+//
+// A frame is an 8 byte header followed by its payload:
+//
+//	version(1) command(1) length(2) stream id(4)
+//
+// all numbers are big endian. The client opens streams with odd ids and the server with even
+// ones. The payload of a SYN frame is the destination of the stream as host:port.
+package mux
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// version of the frame format
+	version = 1
+	// headerSize is the size of a frame header
+	headerSize = 8
+	// maxPayload is the largest payload of a frame
+	maxPayload = 1<<16 - 1
+)
+
+// commands of the frames
+const (
+	cmdSYN byte = iota // opens a stream, the payload is its destination
+	cmdPSH             // data of a stream
+	cmdUPD             // window update, the payload is the number of bytes that were read
+	cmdFIN             // the sender won't write to the stream anymore
+	cmdRST             // the stream is aborted, the payload is the reason
+	cmdNOP             // keeps the connection alive
+)
+
+type header [headerSize]byte
+
+func newHeader(cmd byte, length int, id uint32) header {
+	var h header
+	h[0] = version
+	h[1] = cmd
+	binary.BigEndian.PutUint16(h[2:4], uint16(length))
+	binary.BigEndian.PutUint32(h[4:8], id)
+	return h
+}
+
+func (h header) Version() byte {
+	return h[0]
+}
+
+func (h header) Cmd() byte {
+	return h[1]
+}
+
+func (h header) Length() int {
+	return int(binary.BigEndian.Uint16(h[2:4]))
+}
+
+func (h header) StreamID() uint32 {
+	return binary.BigEndian.Uint32(h[4:8])
+}
+
+func (h header) String() string {
+	return fmt.Sprintf("version %d command %d length %d stream %d", h.Version(), h.Cmd(), h.Length(), h.StreamID())
+}
@@ -0,0 +1,324 @@
+package mux
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"github.com/bepass-org/bepass/net/adapter/ws"
+	"io"
+	"net"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// pair returns the ends of a session over a loopback tcp connection.
+func pair(t *testing.T, clientOpts, serverOpts []Option) (*Session, *Session) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, server := Client(conn, clientOpts...), Server(<-accepted, serverOpts...)
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	return client, server
+}
+
+// echo echoes the streams of s back to their senders.
+func echo(s *Session) {
+	for {
+		stream, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			_, _ = io.Copy(stream, stream)
+			_ = stream.CloseWrite()
+		}()
+	}
+}
+
+func TestStreams(t *testing.T) {
+	client, server := pair(t, nil, nil)
+	go echo(server)
+
+	// every stream sends more than its window, so the windows have to be updated
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			data := make([]byte, 1<<20)
+			_, _ = rand.Read(data)
+			stream, err := client.Open("example.com:443")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer stream.Close()
+			go func() {
+				_, _ = stream.Write(data)
+				_ = stream.CloseWrite()
+			}()
+			got, err := io.ReadAll(stream)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				t.Errorf("Expected %d echoed bytes, got %d different ones", len(data), len(got))
+			}
+		}()
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(time.Second)
+	for client.NumStreams() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("Expected the closed streams to be removed, got %d", n)
+	}
+}
+
+func TestFlowControl(t *testing.T) {
+	const window = 4096
+	client, server := pair(t, []Option{WithWindowSize(window)}, []Option{WithWindowSize(window)})
+	streams := make(chan *Stream, 2)
+	go func() {
+		for {
+			stream, err := server.Accept()
+			if err != nil {
+				return
+			}
+			streams <- stream
+		}
+	}()
+
+	blocked, err := client.Open("blocked.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = blocked.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := blocked.Write(make([]byte, 3*window))
+	if n != window || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the write to stop after the window of %d bytes, got %d, %v", window, n, err)
+	}
+	blockedServer := <-streams
+	if blockedServer.Destination() != "blocked.example:443" {
+		t.Errorf("Unexpected destination %q", blockedServer.Destination())
+	}
+
+	// a stream whose reader is slow doesn't hold up the others
+	other, err := client.Open("other.example:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	otherServer := <-streams
+	buf := make([]byte, 4)
+	_ = otherServer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(otherServer, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the other stream to be read, got %q, %v", buf, err)
+	}
+
+	// reading the blocked stream opens its window again
+	_ = blocked.SetWriteDeadline(time.Time{})
+	done := make(chan error, 1)
+	go func() {
+		_, err := blocked.Write(make([]byte, 2*window))
+		done <- err
+	}()
+	if _, err := io.ReadFull(blockedServer, make([]byte, 3*window)); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("Expected the write to complete after the window update, got %v", err)
+	}
+}
+
+func TestReset(t *testing.T) {
+	client, server := pair(t, nil, nil)
+	go func() {
+		stream, err := server.Accept()
+		if err == nil {
+			_ = stream.Reset("connection refused")
+		}
+	}()
+	stream, err := client.Open("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := stream.Read(make([]byte, 1)); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("Expected the reset reason, got %v", err)
+	}
+}
+
+func TestCloseWhileWriting(t *testing.T) {
+	const window = 4096
+	client, server := pair(t, []Option{WithWindowSize(window)}, []Option{WithWindowSize(window)})
+	copied := make(chan error, 1)
+	go func() {
+		stream, err := server.Accept()
+		if err != nil {
+			copied <- err
+			return
+		}
+		// the destination keeps sending, so the window of the stream is used up
+		_, err = io.Copy(stream, rand.Reader)
+		copied <- err
+	}()
+
+	stream, err := client.Open("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(stream, make([]byte, window/4)); err != nil {
+		t.Fatal(err)
+	}
+	_ = stream.Close()
+
+	select {
+	case err := <-copied:
+		if err == nil || !strings.Contains(err.Error(), "reset by peer") {
+			t.Errorf("Expected the copy to be reset, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Expected the copy to the closed stream to return")
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	client, server := pair(t, nil, nil)
+	stream, err := client.Open("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	if _, err := stream.Write([]byte("ping")); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Expected the stream to be closed with the session, got %v", err)
+	}
+	if _, err := client.Open("example.com:443"); err == nil {
+		t.Error("Expected a closed session not to open streams")
+	}
+	select {
+	case <-server.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected the other end to be closed")
+	}
+}
+
+func TestTimeouts(t *testing.T) {
+	// the session is closed when it has no streams for the idle timeout
+	client, _ := pair(t, []Option{WithIdleTimeout(50 * time.Millisecond)}, nil)
+	stream, err := client.Open("example.com:443")
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if client.IsClosed() {
+		t.Fatal("Expected a session with a stream to stay open")
+	}
+	_ = stream.Close()
+	select {
+	case <-client.Done():
+	case <-time.After(time.Second):
+		t.Error("Expected an idle session to be closed")
+	}
+
+	// the session is closed when the other end stops sending keepalives
+	client, _ = pair(t, []Option{WithKeepAlive(10*time.Millisecond, 50*time.Millisecond)}, []Option{WithKeepAlive(0, 0)})
+	select {
+	case <-client.Done():
+		if _, err := client.Accept(); !errors.Is(err, errKeepAlive) {
+			t.Errorf("Expected a keepalive timeout, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Error("Expected a session without keepalives to be closed")
+	}
+}
+
+func TestHandler(t *testing.T) {
+	// the destination echoes what it receives
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	srv := httptest.NewServer(&Handler{})
+	defer srv.Close()
+
+	wsConn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/mux", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := Client(ws.New(wsConn))
+	defer client.Close()
+
+	stream, err := client.Open(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the echo of the destination, got %q, %v", buf, err)
+	}
+
+	// a destination that can't be reached resets the stream
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = closed.Close()
+	refused, err := client.Open(closed.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = refused.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := refused.Read(buf); err == nil || !strings.Contains(err.Error(), "reset") {
+		t.Errorf("Expected the stream to be reset, got %v", err)
+	}
+}
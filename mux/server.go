@@ -0,0 +1,80 @@
+package mux
+
+import (
+	"github.com/bepass-org/bepass/logger"
+	"github.com/bepass-org/bepass/net/adapter/ws"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// dialTimeout limits how long the reference server tries to connect to a destination
+const dialTimeout = 10 * time.Second
+
+// Handler is the reference implementation of the worker end. It upgrades requests to
+// WebSocket connections, runs a server session on each of them and connects every stream
+// to its destination.
+type Handler struct {
+	// Dial connects to the destinations of the streams, net.Dialer is used if it's nil
+	Dial func(network, addr string) (net.Conn, error)
+	// Options are the options of the sessions
+	Options []Option
+
+	upgrader websocket.Upgrader
+}
+
+// ServeHTTP serves a session over the WebSocket connection of the request until it's closed.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Errorf("mux: upgrade failed: %v", err)
+		return
+	}
+	h.Serve(ws.New(conn))
+}
+
+// Serve runs a server session on conn until it's closed.
+func (h *Handler) Serve(conn net.Conn) {
+	s := Server(conn, h.Options...)
+	defer s.Close()
+	for {
+		stream, err := s.Accept()
+		if err != nil {
+			return
+		}
+		go h.serveStream(stream)
+	}
+}
+
+// serveStream connects stream to its destination and copies in both directions,
+// each direction is closed on its own so half closed connections keep working.
+func (h *Handler) serveStream(stream *Stream) {
+	defer stream.Close()
+	dial := h.Dial
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: dialTimeout}).Dial
+	}
+	conn, err := dial("tcp", stream.Destination())
+	if err != nil {
+		_ = stream.Reset(err.Error())
+		return
+	}
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(conn, stream)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		}
+	}()
+	_, _ = io.Copy(stream, conn)
+	_ = stream.CloseWrite()
+	wg.Wait()
+}
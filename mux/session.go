@@ -0,0 +1,344 @@
+package mux
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultWindowSize is the number of bytes a stream may have in flight
+	defaultWindowSize = 256 * 1024
+	// maxFrameSize is the largest data frame that's written
+	maxFrameSize = 32 * 1024
+	// acceptBacklog is the number of opened streams that wait for Accept
+	acceptBacklog = 128
+)
+
+var (
+	// ErrSessionClosed is returned by the streams of a closed session
+	ErrSessionClosed = errors.New("mux: session closed")
+	// errKeepAlive closes sessions whose peer didn't send anything for too long
+	errKeepAlive = errors.New("mux: keepalive timeout")
+)
+
+// Options represents options for a session, both ends must use the same window size.
+type Options struct {
+	WindowSize        int           // Bytes a stream may have in flight
+	KeepAliveInterval time.Duration // How often keepalives are sent, 0 disables them
+	KeepAliveTimeout  time.Duration // The session is closed if nothing is received for that long
+	IdleTimeout       time.Duration // The session is closed after being without streams for that long, 0 keeps it
+}
+
+// Option is a function type used for setting session options.
+type Option func(*Options)
+
+// WithWindowSize sets the bytes a stream may have in flight, it's 256KiB by default.
+func WithWindowSize(n int) Option {
+	return func(o *Options) {
+		if n > 0 {
+			o.WindowSize = n
+		}
+	}
+}
+
+// WithKeepAlive sets how often keepalives are sent and how long the session waits for any
+// frame before it's closed, they're 10 and 30 seconds by default. An interval of 0 disables them.
+func WithKeepAlive(interval, timeout time.Duration) Option {
+	return func(o *Options) {
+		o.KeepAliveInterval = interval
+		o.KeepAliveTimeout = timeout
+	}
+}
+
+// WithIdleTimeout closes the session when it had no streams for d.
+func WithIdleTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		o.IdleTimeout = d
+	}
+}
+
+// Session multiplexes streams over a connection.
+type Session struct {
+	conn net.Conn
+	opts Options
+
+	mu        sync.Mutex
+	streams   map[uint32]*Stream
+	nextID    uint32
+	idleTimer *time.Timer
+
+	accept   chan *Stream
+	writeMu  sync.Mutex
+	lastRecv atomic.Int64
+
+	die     chan struct{}
+	dieOnce sync.Once
+	err     error
+}
+
+// Client starts the client end of a session on conn.
+func Client(conn net.Conn, opts ...Option) *Session {
+	return newSession(conn, 1, opts)
+}
+
+// Server starts the server end of a session on conn.
+func Server(conn net.Conn, opts ...Option) *Session {
+	return newSession(conn, 2, opts)
+}
+
+func newSession(conn net.Conn, firstID uint32, opts []Option) *Session {
+	o := Options{
+		WindowSize:        defaultWindowSize,
+		KeepAliveInterval: 10 * time.Second,
+		KeepAliveTimeout:  30 * time.Second,
+	}
+	for _, f := range opts {
+		f(&o)
+	}
+	s := &Session{
+		conn:    conn,
+		opts:    o,
+		streams: make(map[uint32]*Stream),
+		nextID:  firstID,
+		accept:  make(chan *Stream, acceptBacklog),
+		die:     make(chan struct{}),
+	}
+	s.lastRecv.Store(time.Now().UnixNano())
+	if o.IdleTimeout > 0 {
+		s.idleTimer = time.AfterFunc(o.IdleTimeout, s.closeIfIdle)
+	}
+	go s.recvLoop()
+	if o.KeepAliveInterval > 0 {
+		go s.keepAlive()
+	}
+	return s
+}
+
+// Open opens a stream to addr, written as host:port, on the other end.
+func (s *Session) Open(addr string) (*Stream, error) {
+	if len(addr) > maxPayload {
+		return nil, fmt.Errorf("mux: destination too long")
+	}
+	s.mu.Lock()
+	if s.IsClosed() {
+		s.mu.Unlock()
+		return nil, s.err
+	}
+	id := s.nextID
+	s.nextID += 2
+	stream := newStream(s, id, addr)
+	s.add(stream)
+	s.mu.Unlock()
+
+	if err := s.writeFrame(cmdSYN, id, []byte(addr)); err != nil {
+		s.remove(id)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// Accept waits for the next stream opened by the other end.
+func (s *Session) Accept() (*Stream, error) {
+	select {
+	case stream := <-s.accept:
+		return stream, nil
+	case <-s.die:
+		return nil, s.err
+	}
+}
+
+// NumStreams returns the number of open streams.
+func (s *Session) NumStreams() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.streams)
+}
+
+// IsClosed reports whether the session is closed.
+func (s *Session) IsClosed() bool {
+	select {
+	case <-s.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// Done returns a channel that's closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.die
+}
+
+// Close closes the session and all its streams.
+func (s *Session) Close() error {
+	s.closeWith(ErrSessionClosed)
+	return nil
+}
+
+func (s *Session) closeWith(err error) {
+	s.dieOnce.Do(func() {
+		s.err = err
+		close(s.die)
+		_ = s.conn.Close()
+		if s.idleTimer != nil {
+			s.idleTimer.Stop()
+		}
+		s.mu.Lock()
+		streams := s.streams
+		s.streams = make(map[uint32]*Stream)
+		s.mu.Unlock()
+		for _, stream := range streams {
+			stream.fail(err)
+		}
+	})
+}
+
+// add registers a stream, s.mu must be held.
+func (s *Session) add(stream *Stream) {
+	s.streams[stream.id] = stream
+	if s.idleTimer != nil {
+		s.idleTimer.Stop()
+	}
+}
+
+func (s *Session) remove(id uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.streams, id)
+	if s.idleTimer != nil && len(s.streams) == 0 {
+		s.idleTimer.Reset(s.opts.IdleTimeout)
+	}
+}
+
+func (s *Session) stream(id uint32) *Stream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.streams[id]
+}
+
+func (s *Session) closeIfIdle() {
+	if s.NumStreams() == 0 {
+		s.closeWith(ErrSessionClosed)
+	}
+}
+
+// writeFrame writes a frame in one write, so the frames of the streams don't interleave.
+func (s *Session) writeFrame(cmd byte, id uint32, payload []byte) error {
+	if s.IsClosed() {
+		return s.err
+	}
+	h := newHeader(cmd, len(payload), id)
+	frame := append(h[:], payload...)
+
+	s.writeMu.Lock()
+	_, err := s.conn.Write(frame)
+	s.writeMu.Unlock()
+	if err != nil {
+		err = fmt.Errorf("mux: connection lost: %w", err)
+		s.closeWith(err)
+		return err
+	}
+	return nil
+}
+
+func (s *Session) recvLoop() {
+	var h header
+	for {
+		if _, err := io.ReadFull(s.conn, h[:]); err != nil {
+			s.closeWith(fmt.Errorf("mux: connection lost: %w", err))
+			return
+		}
+		if h.Version() != version {
+			s.closeWith(fmt.Errorf("mux: unsupported frame %s", h))
+			return
+		}
+		var payload []byte
+		if h.Length() > 0 {
+			payload = make([]byte, h.Length())
+			if _, err := io.ReadFull(s.conn, payload); err != nil {
+				s.closeWith(fmt.Errorf("mux: connection lost: %w", err))
+				return
+			}
+		}
+		s.lastRecv.Store(time.Now().UnixNano())
+
+		id := h.StreamID()
+		switch h.Cmd() {
+		case cmdSYN:
+			s.handleSYN(id, string(payload))
+		case cmdPSH:
+			if stream := s.stream(id); stream != nil {
+				stream.pushData(payload)
+			} else {
+				s.unknownStream(id)
+			}
+		case cmdUPD:
+			if stream := s.stream(id); stream == nil {
+				s.unknownStream(id)
+			} else if len(payload) == 4 {
+				stream.addSendWindow(binary.BigEndian.Uint32(payload))
+			}
+		case cmdFIN:
+			if stream := s.stream(id); stream != nil {
+				stream.remoteFIN()
+			}
+		case cmdRST:
+			if stream := s.stream(id); stream != nil {
+				stream.remoteReset(string(payload))
+			}
+		case cmdNOP:
+		default:
+			s.closeWith(fmt.Errorf("mux: unsupported frame %s", h))
+			return
+		}
+	}
+}
+
+// handleSYN registers a stream opened by the other end and queues it for Accept.
+func (s *Session) handleSYN(id uint32, addr string) {
+	s.mu.Lock()
+	if _, ok := s.streams[id]; ok || s.IsClosed() {
+		s.mu.Unlock()
+		_ = s.writeFrame(cmdRST, id, []byte("duplicate stream id"))
+		return
+	}
+	stream := newStream(s, id, addr)
+	s.add(stream)
+	s.mu.Unlock()
+
+	select {
+	case s.accept <- stream:
+	default:
+		s.remove(id)
+		_ = s.writeFrame(cmdRST, id, []byte("too many streams waiting"))
+	}
+}
+
+// unknownStream resets a stream the other end uses after it was closed here, so the other end
+// doesn't wait for window updates that never come.
+func (s *Session) unknownStream(id uint32) {
+	_ = s.writeFrame(cmdRST, id, []byte("unknown stream"))
+}
+
+func (s *Session) keepAlive() {
+	ticker := time.NewTicker(s.opts.KeepAliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.die:
+			return
+		case <-ticker.C:
+			if s.opts.KeepAliveTimeout > 0 && time.Since(time.Unix(0, s.lastRecv.Load())) > s.opts.KeepAliveTimeout {
+				s.closeWith(errKeepAlive)
+				return
+			}
+			_ = s.writeFrame(cmdNOP, 0, nil)
+		}
+	}
+}
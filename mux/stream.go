@@ -0,0 +1,300 @@
+package mux
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Stream is a connection carried by a session, it implements net.Conn.
+type Stream struct {
+	id   uint32
+	sess *Session
+	addr string
+
+	writeMu sync.Mutex
+
+	mu         sync.Mutex
+	buf        bytes.Buffer // received data that wasn't read yet
+	consumed   int          // bytes read since the last window update
+	sendWindow int          // bytes that may be sent before the next window update
+	finRecv    bool
+	finSent    bool
+	closed     bool
+	err        error // why the stream was reset
+
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readEvent     chan struct{}
+	writeEvent    chan struct{}
+}
+
+func newStream(s *Session, id uint32, addr string) *Stream {
+	return &Stream{
+		id:         id,
+		sess:       s,
+		addr:       addr,
+		sendWindow: s.opts.WindowSize,
+		readEvent:  make(chan struct{}, 1),
+		writeEvent: make(chan struct{}, 1),
+	}
+}
+
+// ID returns the id of the stream.
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+// Destination returns the address the stream was opened to.
+func (st *Stream) Destination() string {
+	return st.addr
+}
+
+// Read reads data received on the stream, it returns io.EOF after the other end closed it.
+func (st *Stream) Read(b []byte) (int, error) {
+	for {
+		st.mu.Lock()
+		if st.buf.Len() > 0 {
+			n, _ := st.buf.Read(b)
+			st.consumed += n
+			// the window is refilled once half of it was read
+			update := 0
+			if st.consumed >= st.sess.opts.WindowSize/2 && !st.finRecv {
+				update, st.consumed = st.consumed, 0
+			}
+			st.mu.Unlock()
+			if update > 0 {
+				var payload [4]byte
+				binary.BigEndian.PutUint32(payload[:], uint32(update))
+				_ = st.sess.writeFrame(cmdUPD, st.id, payload[:])
+			}
+			return n, nil
+		}
+		switch {
+		case st.closed:
+			st.mu.Unlock()
+			return 0, net.ErrClosed
+		case st.finRecv:
+			st.mu.Unlock()
+			return 0, io.EOF
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.readDeadline
+		st.mu.Unlock()
+		if err := wait(st.readEvent, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Write sends b on the stream, it waits while the window of the stream is used up.
+func (st *Stream) Write(b []byte) (int, error) {
+	st.writeMu.Lock()
+	defer st.writeMu.Unlock()
+
+	written := 0
+	for len(b) > 0 {
+		st.mu.Lock()
+		switch {
+		case st.closed || st.finSent:
+			st.mu.Unlock()
+			return written, net.ErrClosed
+		case st.err != nil:
+			err := st.err
+			st.mu.Unlock()
+			return written, err
+		}
+		if st.sendWindow == 0 {
+			deadline := st.writeDeadline
+			st.mu.Unlock()
+			if err := wait(st.writeEvent, deadline); err != nil {
+				return written, err
+			}
+			continue
+		}
+		n := min(len(b), maxFrameSize, st.sendWindow)
+		st.sendWindow -= n
+		st.mu.Unlock()
+
+		if err := st.sess.writeFrame(cmdPSH, st.id, b[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		b = b[n:]
+	}
+	return written, nil
+}
+
+// CloseWrite tells the other end that nothing more is written, it can still be read from.
+func (st *Stream) CloseWrite() error {
+	st.mu.Lock()
+	if st.finSent || st.closed || st.err != nil {
+		st.mu.Unlock()
+		return nil
+	}
+	st.finSent = true
+	st.mu.Unlock()
+	notify(st.writeEvent)
+	return st.sess.writeFrame(cmdFIN, st.id, nil)
+}
+
+// Close closes both directions of the stream. The other end gets a reset instead of EOF if
+// it hasn't finished writing.
+func (st *Stream) Close() error {
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	// the data the other end still sends would be dropped, it's reset so it stops writing
+	sendRST := !st.finRecv && st.err == nil
+	sendFIN := !sendRST && !st.finSent && st.err == nil
+	st.finSent = true
+	st.mu.Unlock()
+
+	notify(st.readEvent)
+	notify(st.writeEvent)
+	st.sess.remove(st.id)
+	switch {
+	case sendRST:
+		return st.sess.writeFrame(cmdRST, st.id, []byte("stream closed"))
+	case sendFIN:
+		return st.sess.writeFrame(cmdFIN, st.id, nil)
+	}
+	return nil
+}
+
+// pushData adds data received from the other end.
+func (st *Stream) pushData(data []byte) {
+	st.mu.Lock()
+	if st.closed || st.err != nil {
+		st.mu.Unlock()
+		return
+	}
+	if st.buf.Len()+st.consumed+len(data) > st.sess.opts.WindowSize {
+		st.mu.Unlock()
+		st.reset("window exceeded")
+		return
+	}
+	st.buf.Write(data)
+	st.mu.Unlock()
+	notify(st.readEvent)
+}
+
+func (st *Stream) addSendWindow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(n)
+	st.mu.Unlock()
+	notify(st.writeEvent)
+}
+
+func (st *Stream) remoteFIN() {
+	st.mu.Lock()
+	st.finRecv = true
+	st.mu.Unlock()
+	notify(st.readEvent)
+}
+
+func (st *Stream) remoteReset(reason string) {
+	st.fail(fmt.Errorf("mux: stream reset by peer: %s", reason))
+	st.sess.remove(st.id)
+}
+
+// reset aborts the stream and tells the other end why.
+func (st *Stream) reset(reason string) {
+	st.fail(fmt.Errorf("mux: stream reset: %s", reason))
+	st.sess.remove(st.id)
+	_ = st.sess.writeFrame(cmdRST, st.id, []byte(reason))
+}
+
+// Reset aborts the stream, the other end gets reason as the error of the stream.
+func (st *Stream) Reset(reason string) error {
+	if len(reason) > maxPayload {
+		reason = reason[:maxPayload]
+	}
+	st.reset(reason)
+	return nil
+}
+
+func (st *Stream) fail(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readEvent)
+	notify(st.writeEvent)
+}
+
+// LocalAddr returns the local address of the connection of the session.
+func (st *Stream) LocalAddr() net.Addr {
+	return st.sess.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the connection of the session.
+func (st *Stream) RemoteAddr() net.Addr {
+	return st.sess.conn.RemoteAddr()
+}
+
+// SetDeadline sets the read and write deadlines of the stream.
+func (st *Stream) SetDeadline(t time.Time) error {
+	if err := st.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return st.SetWriteDeadline(t)
+}
+
+// SetReadDeadline sets the read deadline of the stream.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.readDeadline = t
+	st.mu.Unlock()
+	notify(st.readEvent)
+	return nil
+}
+
+// SetWriteDeadline sets the write deadline of the stream.
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.mu.Lock()
+	st.writeDeadline = t
+	st.mu.Unlock()
+	notify(st.writeEvent)
+	return nil
+}
+
+// notify wakes up a waiting read or write without blocking.
+func notify(event chan struct{}) {
+	select {
+	case event <- struct{}{}:
+	default:
+	}
+}
+
+// wait waits for event until deadline, a zero deadline waits forever.
+func wait(event chan struct{}, deadline time.Time) error {
+	if deadline.IsZero() {
+		<-event
+		return nil
+	}
+	d := time.Until(deadline)
+	if d <= 0 {
+		return os.ErrDeadlineExceeded
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-event:
+		return nil
+	case <-timer.C:
+		return os.ErrDeadlineExceeded
+	}
+}
@@ -2,9 +2,8 @@ package fragment
 
 import (
 	"bytes"
-	"github.com/bepass-org/bepass/config"
+	"github.com/bepass-org/bepass/logger"
 	"github.com/bepass-org/bepass/sni"
-	"math/rand"
 	"net"
 	"sync"
 	"time"
@@ -16,121 +15,59 @@ type Adapter struct {
 	readMutex    sync.Mutex
 	writeMutex   sync.Mutex
 	isFirstWrite bool
-	// search for sni and if sni was found, initially split client hello packet to 3 packets
-	// first chunk is contents of original tls hello packet before reaching sni
-	// second packet is sni itself
-	// and third package is contents of original tls hello packet after sni
-	// we fragment each part separately BSL indicates each fragment's size(a range) for
-	// original packet contents before reaching the sni
-	// SL indicates each fragment's size(a range) for the sni itself
-	// ASL indicates each fragment's size(a range) for remaining contents of original packet that comes after sni
-	// and delay indicates how much delay system should take before sending next fragment as a separate packet
-	BSL   [2]int
-	SL    [2]int
-	ASL   [2]int
+	// Strategy splits the first packet written to the connection into fragments
+	Strategy FragmentStrategy
+	// Delay indicates how much delay(a range in milliseconds) system should take
+	// before sending next fragment as a separate packet
 	Delay [2]int
 }
 
-// New creates a new Adapter from a net.Conn connection.
-func New(conn net.Conn) *Adapter {
+// New creates a new Adapter from a net.Conn connection that fragments as configured by c.
+func New(conn net.Conn, c Config) *Adapter {
+	strategy, err := NewStrategy(c)
+	if err != nil {
+		logger.Errorf("%v, falling back to %s strategy", err, StrategySNI)
+		strategy = &SNISplit{BSL: c.BSL, SL: c.SL, ASL: c.ASL}
+	}
 	return &Adapter{
 		conn:         conn,
 		isFirstWrite: true,
-		BSL:          config.G.ChunksLengthBeforeSni,
-		SL:           config.G.SniChunksLength,
-		ASL:          config.G.ChunksLengthBeforeSni,
-		Delay:        config.G.DelayBetweenChunks,
+		Strategy:     strategy,
+		Delay:        c.Delay,
 	}
 }
 
-// it will search for sni or host in package and if found then chunks Write writes data to the net.Conn connection.
-func (a *Adapter) writeFragments(b []byte, index int) (int, error) {
-	nw := 0
-	position := 0
-	lengthMin, lengthMax := 0, 0
-	if index == 0 {
-		lengthMin, lengthMax = a.BSL[0], a.BSL[1]
-	} else if index == 1 { // if its sni
-		lengthMin, lengthMax = a.SL[0], a.SL[1]
-	} else { // if its after sni
-		lengthMin, lengthMax = a.ASL[0], a.ASL[1]
+// writeFragment writes a single fragment, fragments marked as disorder are sent with a
+// minimal ttl so that they are retransmitted after the following ones.
+func (a *Adapter) writeFragment(f Fragment) (int, error) {
+	if !f.Disorder {
+		return a.conn.Write(f.Data)
 	}
-	for position < len(b) {
-		var fragmentLength int
-		if lengthMax-lengthMin > 0 {
-			fragmentLength = rand.Intn(lengthMax-lengthMin) + lengthMin
-		} else {
-			fragmentLength = lengthMin
-		}
-
-		if fragmentLength > len(b)-position {
-			fragmentLength = len(b) - position
-		}
-
-		var delay int
-		if a.Delay[1]-a.Delay[0] > 0 {
-			delay = rand.Intn(a.Delay[1]-a.Delay[0]) + a.Delay[0]
-		} else {
-			delay = a.Delay[0]
-		}
-
-		tnw, ew := a.conn.Write(b[position : position+fragmentLength])
-		if ew != nil {
-			return 0, ew
-		}
-
-		nw += tnw
-
-		position += fragmentLength
-		time.Sleep(time.Duration(delay) * time.Millisecond)
+	restore, err := setTTL(a.conn, disorderTTL)
+	if err != nil {
+		logger.Errorf("unable to change ttl for disorder fragment: %v", err)
+		return a.conn.Write(f.Data)
 	}
-
-	return nw, nil
+	defer restore()
+	return a.conn.Write(f.Data)
 }
 
-// it will search for sni or host in package and if found then chunks Write writes data to the net.Conn connection.
+// fragmentAndWriteFirstPacket parses the tls client hello of the first packet if there is one,
+// splits the packet according to the strategy and writes the fragments with a delay between them.
 func (a *Adapter) fragmentAndWriteFirstPacket(b []byte) (int, error) {
 	hello, err := sni.ReadClientHello(bytes.NewReader(b))
 	if err != nil {
-		return a.conn.Write(b)
-	}
-	helloPacketSni := []byte(hello.ServerName)
-	chunks := make(map[int][]byte)
-
-	/*
-		splitting original hello packet to BeforeSNI, SNI, AfterSNI chunks
-	*/
-	// search for sni through original tls client hello
-	index := bytes.Index(b, helloPacketSni)
-	if index == -1 {
-		return a.conn.Write(b)
+		hello = nil
 	}
-	// before helloPacketSni
-	chunks[0] = make([]byte, index)
-	copy(chunks[0], b[:index])
-	// helloPacketSni
-	chunks[1] = make([]byte, len(helloPacketSni))
-	copy(chunks[1], b[index:index+len(helloPacketSni)])
-	// after helloPacketSni
-	chunks[2] = make([]byte, len(b)-index-len(helloPacketSni))
-	copy(chunks[2], b[index+len(helloPacketSni):])
-
-	/*
-		sending fragments
-	*/
-	// number of written packets
-	nw := 0
-	var ew error = nil
-
-	for i := 0; i < 3; i++ {
-		tnw, ew := a.writeFragments(chunks[i], i)
-		nw += tnw
-		if ew != nil {
-			return 0, ew
+
+	for _, f := range a.Strategy.Split(b, hello) {
+		if _, err := a.writeFragment(f); err != nil {
+			return 0, err
 		}
+		time.Sleep(time.Duration(randomInRange(a.Delay)) * time.Millisecond)
 	}
 
-	return nw, ew
+	return len(b), nil
 }
 
 // Write writes data to the net.Conn connection.
@@ -0,0 +1,73 @@
+package fragment
+
+import (
+	"crypto/tls"
+	"github.com/bepass-org/bepass/net/dpitest"
+	"net"
+	"testing"
+	"time"
+)
+
+const blockedDomain = "blocked.example"
+
+func TestAdapterThroughMiddlebox(t *testing.T) {
+	server, err := dpitest.NewTLSServer(blockedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	whole := [2]int{2000, 2000}
+	sni := Config{Strategy: StrategySNI, BSL: whole, SL: [2]int{1, 1}, ASL: whole, Delay: [2]int{5, 5}}
+	tests := []struct {
+		name    string
+		depth   int
+		config  *Config
+		blocked bool
+	}{
+		{name: "unfragmented", depth: 1, blocked: true},
+		{name: "sni", depth: 1, config: &sni},
+		{name: "chunk", depth: 1, config: &Config{Strategy: StrategyChunk, ChunkLength: [2]int{50, 50}, Delay: [2]int{5, 5}}},
+		{name: "offset", depth: 1, config: &Config{Strategy: StrategyOffset, Offset: 50, Delay: [2]int{5, 5}}},
+		{name: "sni reassembled", depth: 64, config: &sni, blocked: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := dpitest.New(server.Addr(), dpitest.WithBlocked(blockedDomain), dpitest.WithDepth(tt.depth))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer m.Close()
+
+			tcpConn, err := net.Dial("tcp", m.Addr())
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = tcpConn.(*net.TCPConn).SetNoDelay(true)
+			var conn net.Conn = tcpConn
+			if tt.config != nil {
+				conn = New(tcpConn, *tt.config)
+			}
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			client := tls.Client(conn, &tls.Config{ServerName: blockedDomain, InsecureSkipVerify: true})
+			defer client.Close()
+
+			err = client.Handshake()
+			if tt.blocked {
+				if err == nil || m.Blocked() != 1 {
+					t.Errorf("Expected the connection to be reset, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected the handshake to get through, got %v", err)
+			}
+			if _, err := client.Write([]byte("ping")); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := client.Read(make([]byte, 4)); err != nil {
+				t.Errorf("Expected the echo through the adapter, got %v", err)
+			}
+		})
+	}
+}
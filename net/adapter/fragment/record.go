@@ -0,0 +1,92 @@
+package fragment
+
+import (
+	"encoding/binary"
+	"github.com/bepass-org/bepass/sni"
+)
+
+// RecordSplit rewrites the client hello into several valid tls records, so the sni is split
+// at the tls layer and a middlebox that reassembles tcp segments still can't read it from
+// a single record. Records cuts the handshake message into the payloads of the new records,
+// each record then is fragmented by Strategy or written on its own if Strategy is nil.
+// Records that Strategy leaves whole, like the sni strategy does as no record holds the whole
+// sni, are written as their header and their payload, so no record arrives in one segment.
+type RecordSplit struct {
+	// HeaderLength is the length of the tls record header, only 5 is supported and 0 means 5
+	HeaderLength int
+	Records      FragmentStrategy
+	Strategy     FragmentStrategy
+}
+
+// Split implements FragmentStrategy.
+func (s *RecordSplit) Split(b []byte, hello *sni.ClientHelloMsg) []Fragment {
+	records, rest := s.rewrite(b, hello)
+	if records == nil {
+		if s.Strategy == nil {
+			return []Fragment{{Data: b}}
+		}
+		return s.Strategy.Split(b, hello)
+	}
+
+	// disorder marks the first fragment of the packet, not the first one of every record
+	strategy := s.Strategy
+	disorder, ok := strategy.(*Disorder)
+	if ok {
+		strategy = disorder.Strategy
+	}
+	var fragments []Fragment
+	for _, record := range records {
+		if strategy == nil {
+			fragments = append(fragments, Fragment{Data: record})
+			continue
+		}
+		// every record is a part of the client hello, the strategies that need it still get it
+		parts := strategy.Split(record, hello)
+		if len(parts) < 2 {
+			parts = splitAt(record, recordHeaderLength)
+		}
+		fragments = append(fragments, parts...)
+	}
+	if ok && len(fragments) > 1 {
+		fragments[0].Disorder = true
+	}
+	// anything after the client hello record is passed through untouched
+	if len(rest) > 0 {
+		fragments = append(fragments, Fragment{Data: rest})
+	}
+	return fragments
+}
+
+// rewrite splits the handshake message of the first record into several records and returns
+// them with what follows that record, the records are nil if b doesn't hold the whole client
+// hello in its first record.
+func (s *RecordSplit) rewrite(b []byte, hello *sni.ClientHelloMsg) ([][]byte, []byte) {
+	// the length is the last 2 bytes of the header, other header lengths aren't tls
+	if s.HeaderLength != 0 && s.HeaderLength != recordHeaderLength {
+		return nil, nil
+	}
+	if hello == nil || len(b) < recordHeaderLength {
+		return nil, nil
+	}
+	header := b[:recordHeaderLength]
+	payloadLength := int(binary.BigEndian.Uint16(header[recordHeaderLength-2:]))
+	if payloadLength != len(hello.Raw) || len(b) < recordHeaderLength+payloadLength {
+		return nil, nil
+	}
+	payload := b[recordHeaderLength : recordHeaderLength+payloadLength]
+
+	parts := s.Records.Split(payload, hello)
+	if len(parts) < 2 {
+		return nil, nil
+	}
+
+	records := make([][]byte, 0, len(parts))
+	for _, part := range parts {
+		record := make([]byte, recordHeaderLength+len(part.Data))
+		copy(record, header)
+		binary.BigEndian.PutUint16(record[recordHeaderLength-2:recordHeaderLength], uint16(len(part.Data)))
+		copy(record[recordHeaderLength:], part.Data)
+		records = append(records, record)
+	}
+	return records, b[recordHeaderLength+payloadLength:]
+}
@@ -0,0 +1,202 @@
+package fragment
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/bepass-org/bepass/sni"
+	"math/rand"
+)
+
+// names of the built-in fragmentation strategies
+const (
+	StrategySNI      = "sni"
+	StrategyChunk    = "chunk"
+	StrategyOffset   = "offset"
+	StrategyHeader   = "header"
+	StrategyDisorder = "disorder"
+)
+
+// tls record header length, the header strategy splits somewhere inside it
+const recordHeaderLength = 5
+
+// Fragment is a part of the first packet which is written to the connection by a single Write call.
+type Fragment struct {
+	Data []byte
+	// Disorder asks the adapter to send this fragment with a ttl that is too small to reach the
+	// destination, so it is delivered by a tcp retransmission after the fragments that follow it.
+	Disorder bool
+}
+
+// FragmentStrategy decides how the first packet of a connection is split into fragments.
+// hello is the parsed tls client hello contained in b, or nil if b is not a client hello.
+type FragmentStrategy interface {
+	Split(b []byte, hello *sni.ClientHelloMsg) []Fragment
+}
+
+// Config holds the settings that are used to build a FragmentStrategy and to pace its fragments.
+type Config struct {
+	// Strategy is the name of one of the built-in strategies, defaults to StrategySNI
+	Strategy string
+	// BSL, SL and ASL are the fragment size ranges of the sni strategy
+	BSL [2]int
+	SL  [2]int
+	ASL [2]int
+	// ChunkLength is the fragment size range of the chunk strategy
+	ChunkLength [2]int
+	// Offset is the split position of the offset and header strategies
+	Offset int
+	// Delay is the range of milliseconds to wait after writing each fragment
+	Delay [2]int
+	// RecordSplit rewrites the client hello into several tls records cut at the BSL, SL and ASL
+	// boundaries before the selected strategy fragments each record
+	RecordSplit bool
+	// HeaderLength is the tls record header length used by RecordSplit
+	HeaderLength int
+}
+
+// NewStrategy builds the built-in strategy selected by c.Strategy, wrapped in a RecordSplit
+// if c.RecordSplit is set.
+func NewStrategy(c Config) (FragmentStrategy, error) {
+	strategy, err := newStrategy(c)
+	if err != nil || !c.RecordSplit {
+		return strategy, err
+	}
+	return &RecordSplit{
+		HeaderLength: c.HeaderLength,
+		Records:      &SNISplit{BSL: c.BSL, SL: c.SL, ASL: c.ASL},
+		Strategy:     strategy,
+	}, nil
+}
+
+func newStrategy(c Config) (FragmentStrategy, error) {
+	switch c.Strategy {
+	case "", StrategySNI:
+		return &SNISplit{BSL: c.BSL, SL: c.SL, ASL: c.ASL}, nil
+	case StrategyChunk:
+		return &FixedChunks{Length: c.ChunkLength}, nil
+	case StrategyOffset:
+		return &OffsetSplit{Offset: c.Offset}, nil
+	case StrategyHeader:
+		return &RecordHeaderSplit{Offset: c.Offset}, nil
+	case StrategyDisorder:
+		return &Disorder{Strategy: &SNISplit{BSL: c.BSL, SL: c.SL, ASL: c.ASL}}, nil
+	}
+	return nil, fmt.Errorf("unknown fragment strategy %q", c.Strategy)
+}
+
+// randomInRange returns a random number in [r[0], r[1]), or r[0] if the range is empty.
+func randomInRange(r [2]int) int {
+	if r[1]-r[0] > 0 {
+		return rand.Intn(r[1]-r[0]) + r[0]
+	}
+	return r[0]
+}
+
+// chunk splits b into fragments whose sizes are randomly chosen from lengthRange.
+func chunk(b []byte, lengthRange [2]int) []Fragment {
+	var fragments []Fragment
+	for position := 0; position < len(b); {
+		fragmentLength := randomInRange(lengthRange)
+		if fragmentLength <= 0 || fragmentLength > len(b)-position {
+			fragmentLength = len(b) - position
+		}
+		fragments = append(fragments, Fragment{Data: b[position : position+fragmentLength]})
+		position += fragmentLength
+	}
+	return fragments
+}
+
+// splitAt splits b into two fragments at offset, or returns b as a single fragment
+// if offset is not inside b.
+func splitAt(b []byte, offset int) []Fragment {
+	if offset <= 0 || offset >= len(b) {
+		return []Fragment{{Data: b}}
+	}
+	return []Fragment{{Data: b[:offset]}, {Data: b[offset:]}}
+}
+
+// SNISplit is the original bepass strategy. It splits the client hello packet into 3 parts,
+// the contents before the sni, the sni itself and the contents after the sni,
+// and fragments each part separately.
+// BSL indicates each fragment's size(a range) for the contents before reaching the sni,
+// SL indicates each fragment's size(a range) for the sni itself and
+// ASL indicates each fragment's size(a range) for the remaining contents that come after the sni.
+type SNISplit struct {
+	BSL [2]int
+	SL  [2]int
+	ASL [2]int
+}
+
+// Split implements FragmentStrategy.
+func (s *SNISplit) Split(b []byte, hello *sni.ClientHelloMsg) []Fragment {
+	if hello == nil || hello.ServerName == "" {
+		return []Fragment{{Data: b}}
+	}
+	// search for sni through original tls client hello
+	index := bytes.Index(b, []byte(hello.ServerName))
+	if index == -1 {
+		return []Fragment{{Data: b}}
+	}
+	end := index + len(hello.ServerName)
+
+	fragments := chunk(b[:index], s.BSL)
+	fragments = append(fragments, chunk(b[index:end], s.SL)...)
+	return append(fragments, chunk(b[end:], s.ASL)...)
+}
+
+// FixedChunks splits the whole first packet into chunks whose sizes are chosen from Length,
+// regardless of where the sni is.
+type FixedChunks struct {
+	Length [2]int
+}
+
+// Split implements FragmentStrategy.
+func (s *FixedChunks) Split(b []byte, _ *sni.ClientHelloMsg) []Fragment {
+	return chunk(b, s.Length)
+}
+
+// OffsetSplit splits the first packet into two fragments at a fixed byte offset.
+type OffsetSplit struct {
+	Offset int
+}
+
+// Split implements FragmentStrategy.
+func (s *OffsetSplit) Split(b []byte, _ *sni.ClientHelloMsg) []Fragment {
+	return splitAt(b, s.Offset)
+}
+
+// RecordHeaderSplit splits the client hello inside its 5 bytes tls record header,
+// so the record type, version and length never arrive in a single segment.
+// Offset is the number of header bytes sent in the first fragment, values outside
+// of [1, 4] fall back to 1.
+type RecordHeaderSplit struct {
+	Offset int
+}
+
+// Split implements FragmentStrategy.
+func (s *RecordHeaderSplit) Split(b []byte, hello *sni.ClientHelloMsg) []Fragment {
+	if hello == nil {
+		return []Fragment{{Data: b}}
+	}
+	offset := s.Offset
+	if offset < 1 || offset >= recordHeaderLength {
+		offset = 1
+	}
+	return splitAt(b, offset)
+}
+
+// Disorder wraps another strategy and sends its first fragment with a minimal ttl.
+// That fragment is dropped before reaching the dpi box and gets retransmitted by the
+// kernel after the rest of the packet, so the middlebox sees the fragments in reverse order.
+type Disorder struct {
+	Strategy FragmentStrategy
+}
+
+// Split implements FragmentStrategy.
+func (s *Disorder) Split(b []byte, hello *sni.ClientHelloMsg) []Fragment {
+	fragments := s.Strategy.Split(b, hello)
+	if len(fragments) > 1 {
+		fragments[0].Disorder = true
+	}
+	return fragments
+}
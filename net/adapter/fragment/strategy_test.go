@@ -0,0 +1,187 @@
+package fragment
+
+import (
+	"bytes"
+	"crypto/tls"
+	"github.com/bepass-org/bepass/sni"
+	"net"
+	"testing"
+)
+
+// clientHello captures the first packet a tls client sends for serverName.
+func clientHello(t *testing.T, serverName string) ([]byte, *sni.ClientHelloMsg) {
+	t.Helper()
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		_ = tls.Client(client, &tls.Config{ServerName: serverName}).Handshake()
+	}()
+	buf := make([]byte, 32*1024)
+	n, err := server.Read(buf)
+	if err != nil {
+		t.Fatalf("reading client hello failed: %v", err)
+	}
+	_ = client.Close()
+	hello, err := sni.ReadClientHello(bytes.NewReader(buf[:n]))
+	if err != nil {
+		t.Fatalf("parsing client hello failed: %v", err)
+	}
+	return buf[:n], hello
+}
+
+func join(fragments []Fragment) []byte {
+	var b []byte
+	for _, f := range fragments {
+		b = append(b, f.Data...)
+	}
+	return b
+}
+
+func TestStrategies(t *testing.T) {
+	packet, hello := clientHello(t, "blocked.example.com")
+	sniIndex := bytes.Index(packet, []byte(hello.ServerName))
+
+	testCases := []struct {
+		name      string
+		config    Config
+		fragments int
+		check     func(t *testing.T, fragments []Fragment)
+	}{
+		{
+			name:   "sni",
+			config: Config{Strategy: StrategySNI, BSL: [2]int{2000, 2000}, SL: [2]int{1, 1}, ASL: [2]int{2000, 2000}},
+			// before sni, one fragment per sni byte and after sni
+			fragments: 2 + len(hello.ServerName),
+			check: func(t *testing.T, fragments []Fragment) {
+				if len(fragments[0].Data) != sniIndex {
+					t.Errorf("Expected first fragment to end at sni index %d, got %d", sniIndex, len(fragments[0].Data))
+				}
+			},
+		},
+		{
+			name:      "chunk",
+			config:    Config{Strategy: StrategyChunk, ChunkLength: [2]int{100, 100}},
+			fragments: (len(packet) + 99) / 100,
+		},
+		{
+			name:      "offset",
+			config:    Config{Strategy: StrategyOffset, Offset: 10},
+			fragments: 2,
+			check: func(t *testing.T, fragments []Fragment) {
+				if len(fragments[0].Data) != 10 {
+					t.Errorf("Expected a 10 bytes first fragment, got %d", len(fragments[0].Data))
+				}
+			},
+		},
+		{
+			name:      "header",
+			config:    Config{Strategy: StrategyHeader, Offset: 3},
+			fragments: 2,
+			check: func(t *testing.T, fragments []Fragment) {
+				if len(fragments[0].Data) != 3 {
+					t.Errorf("Expected a 3 bytes first fragment, got %d", len(fragments[0].Data))
+				}
+			},
+		},
+		{
+			name:      "disorder",
+			config:    Config{Strategy: StrategyDisorder, BSL: [2]int{2000, 2000}, SL: [2]int{50, 50}, ASL: [2]int{2000, 2000}},
+			fragments: 3,
+			check: func(t *testing.T, fragments []Fragment) {
+				if !fragments[0].Disorder || fragments[1].Disorder {
+					t.Errorf("Expected only the first fragment to be disordered")
+				}
+			},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			strategy, err := NewStrategy(tc.config)
+			if err != nil {
+				t.Fatalf("NewStrategy failed: %v", err)
+			}
+			fragments := strategy.Split(packet, hello)
+			if len(fragments) != tc.fragments {
+				t.Fatalf("Expected %d fragments, got %d", tc.fragments, len(fragments))
+			}
+			if !bytes.Equal(join(fragments), packet) {
+				t.Errorf("Fragments do not add up to the original packet")
+			}
+			if tc.check != nil {
+				tc.check(t, fragments)
+			}
+		})
+	}
+}
+
+func TestUnknownStrategy(t *testing.T) {
+	if _, err := NewStrategy(Config{Strategy: "nope"}); err == nil {
+		t.Errorf("Expected an error for an unknown strategy")
+	}
+}
+
+func TestRecordSplit(t *testing.T) {
+	packet, hello := clientHello(t, "blocked.example.com")
+
+	for _, name := range []string{StrategySNI, StrategyChunk, StrategyHeader, StrategyDisorder} {
+		strategy, err := NewStrategy(Config{
+			Strategy:     name,
+			BSL:          [2]int{2000, 2000},
+			SL:           [2]int{4, 4},
+			ASL:          [2]int{2000, 2000},
+			ChunkLength:  [2]int{50, 50},
+			Offset:       2,
+			RecordSplit:  true,
+			HeaderLength: 5,
+		})
+		if err != nil {
+			t.Fatalf("NewStrategy failed: %v", err)
+		}
+		fragments := strategy.Split(packet, hello)
+		rewritten := join(fragments)
+
+		// before sni, one record per 4 sni bytes and after sni
+		records := 2 + (len(hello.ServerName)+3)/4
+		if len(rewritten) != len(packet)+(records-1)*5 {
+			t.Errorf("%s: Expected each extra record to add a 5 bytes header", name)
+		}
+		if bytes.Contains(rewritten, []byte(hello.ServerName)) {
+			t.Errorf("%s: Expected the sni to be split across records", name)
+		}
+
+		// every record is cut by at least one of the writes
+		cuts := map[int]bool{}
+		position := 0
+		for _, f := range fragments {
+			position += len(f.Data)
+			cuts[position] = true
+		}
+		var found int
+		for start := 0; start < len(rewritten); found++ {
+			end := start + 5 + int(rewritten[start+3])<<8 + int(rewritten[start+4])
+			split := false
+			for i := start + 1; i < end; i++ {
+				split = split || cuts[i]
+			}
+			if !split {
+				t.Errorf("%s: Expected record %d to take more than one write", name, found)
+			}
+			start = end
+		}
+		if found != records {
+			t.Errorf("%s: Expected %d records, got %d", name, records, found)
+		}
+		if disorder := fragments[0].Disorder; disorder != (name == StrategyDisorder) {
+			t.Errorf("%s: Expected disorder of the first fragment to be %v", name, !disorder)
+		}
+
+		parsed, err := sni.ReadClientHello(bytes.NewReader(rewritten))
+		if err != nil {
+			t.Fatalf("%s: Rewritten client hello is not valid: %v", name, err)
+		}
+		if parsed.ServerName != hello.ServerName {
+			t.Errorf("%s: Expected server name %s, got %s", name, hello.ServerName, parsed.ServerName)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package fragment
+
+import (
+	"net"
+
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+// disorderTTL is small enough to make the packet expire at the first hop
+const disorderTTL = 1
+
+// setTTL changes the ttl (hop limit for ipv6) of the packets sent over conn and
+// returns a function that restores the previous value.
+func setTTL(conn net.Conn, ttl int) (func(), error) {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() == nil {
+		c := ipv6.NewConn(conn)
+		old, err := c.HopLimit()
+		if err != nil {
+			return nil, err
+		}
+		if err := c.SetHopLimit(ttl); err != nil {
+			return nil, err
+		}
+		return func() { _ = c.SetHopLimit(old) }, nil
+	}
+
+	c := ipv4.NewConn(conn)
+	old, err := c.TTL()
+	if err != nil {
+		return nil, err
+	}
+	if err := c.SetTTL(ttl); err != nil {
+		return nil, err
+	}
+	return func() { _ = c.SetTTL(old) }, nil
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"context"
+	"github.com/bepass-org/bepass/net/dpitest"
+	"net"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+const blockedDomain = "blocked.example"
+
+func TestAdapterThroughMiddlebox(t *testing.T) {
+	server := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		_, _ = w.Write([]byte(r.Host))
+	}))
+	defer server.Close()
+	m, err := dpitest.New(server.Listener.Addr().String(), dpitest.WithBlocked(blockedDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	get := func(adapt bool) (*nethttp.Response, error) {
+		client := &nethttp.Client{
+			Timeout: 5 * time.Second,
+			Transport: &nethttp.Transport{
+				DisableKeepAlives: true,
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					conn, err := (&net.Dialer{}).DialContext(ctx, network, m.Addr())
+					if err != nil || !adapt {
+						return conn, err
+					}
+					return New(conn), nil
+				},
+			},
+		}
+		return client.Get("http://" + blockedDomain + "/")
+	}
+
+	if resp, err := get(false); err == nil {
+		_ = resp.Body.Close()
+		t.Error("Expected a plain request for a blocked host to be reset")
+	}
+	resp, err := get(true)
+	if err != nil {
+		t.Fatalf("Expected the request through the adapter to get through, got %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		t.Errorf("Expected status code %d, got %d", nethttp.StatusOK, resp.StatusCode)
+	}
+	if m.Blocked() != 1 || m.Passed() != 1 {
+		t.Errorf("Expected 1 blocked and 1 passed connection, got %d and %d", m.Blocked(), m.Passed())
+	}
+}
@@ -0,0 +1,223 @@
+// Package dpitest provides an in-process DPI middlebox for tests. The middlebox sits between
+// a client and an upstream server and resets connections whose tls client hello or http
+// request asks for a blocked domain. Like simple DPI boxes it only looks at the first segments
+// of a connection, so fragmenting them gets the connection through.
+package dpitest
+
+import (
+	"bytes"
+	"errors"
+	"github.com/bepass-org/bepass/sni"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxInspected limits the bytes of a connection that are inspected
+const maxInspected = 64 * 1024
+
+// Options represents options for the middlebox.
+type Options struct {
+	Blocked []string      // Domains that are blocked, with their subdomains
+	Depth   int           // Segments that are reassembled before the connection is let through
+	Timeout time.Duration // How long the middlebox waits for the next segment while reassembling
+}
+
+// Option is a function type used for setting middlebox options.
+type Option func(*Options)
+
+// WithBlocked adds domains that are blocked, their subdomains are blocked too.
+func WithBlocked(domains ...string) Option {
+	return func(o *Options) {
+		o.Blocked = append(o.Blocked, domains...)
+	}
+}
+
+// WithDepth sets the number of segments that are reassembled before a connection whose
+// hello or request is still incomplete is let through, it's 1 by default.
+func WithDepth(segments int) Option {
+	return func(o *Options) {
+		if segments > 0 {
+			o.Depth = segments
+		}
+	}
+}
+
+// WithTimeout sets how long the middlebox waits for the next segment while reassembling, a
+// connection that sends nothing for that long is let through. It's 100ms by default.
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		if d > 0 {
+			o.Timeout = d
+		}
+	}
+}
+
+// Middlebox is a DPI middlebox listening on a local address that forwards the
+// connections it lets through to an upstream server.
+type Middlebox struct {
+	opts     Options
+	upstream string
+	ln       net.Listener
+	wg       sync.WaitGroup
+	blocked  atomic.Int64
+	passed   atomic.Int64
+}
+
+// New starts a middlebox in front of the upstream address.
+func New(upstream string, opts ...Option) (*Middlebox, error) {
+	o := Options{Depth: 1, Timeout: 100 * time.Millisecond}
+	for _, f := range opts {
+		f(&o)
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	m := &Middlebox{opts: o, upstream: upstream, ln: ln}
+	m.wg.Add(1)
+	go m.serve()
+	return m, nil
+}
+
+// Addr returns the address the middlebox listens on.
+func (m *Middlebox) Addr() string {
+	return m.ln.Addr().String()
+}
+
+// Blocked returns the number of connections that were reset.
+func (m *Middlebox) Blocked() int {
+	return int(m.blocked.Load())
+}
+
+// Passed returns the number of connections that were let through.
+func (m *Middlebox) Passed() int {
+	return int(m.passed.Load())
+}
+
+// Close stops the middlebox, the connections it forwards are closed by their ends.
+func (m *Middlebox) Close() error {
+	err := m.ln.Close()
+	m.wg.Wait()
+	return err
+}
+
+func (m *Middlebox) serve() {
+	defer m.wg.Done()
+	for {
+		conn, err := m.ln.Accept()
+		if err != nil {
+			return
+		}
+		go m.handle(conn.(*net.TCPConn))
+	}
+}
+
+// handle reassembles the first segments of conn, resets it if they ask for a blocked
+// domain and forwards it to the upstream otherwise.
+func (m *Middlebox) handle(conn *net.TCPConn) {
+	defer conn.Close()
+	data, err := m.reassemble(conn)
+	if err != nil {
+		return
+	}
+	if m.isBlocked(data) {
+		m.blocked.Add(1)
+		// a linger of 0 makes close send a reset instead of a fin
+		_ = conn.SetLinger(0)
+		return
+	}
+	m.passed.Add(1)
+
+	server, err := net.Dial("tcp", m.upstream)
+	if err != nil {
+		return
+	}
+	defer server.Close()
+	if _, err := server.Write(data); err != nil {
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		_, _ = io.Copy(conn, server)
+		_ = conn.CloseWrite()
+		close(done)
+	}()
+	_, _ = io.Copy(server, conn)
+	_ = server.(*net.TCPConn).CloseWrite()
+	<-done
+}
+
+// reassemble reads segments until the hello or request in them is complete, Depth
+// segments were read or no segment arrives within Timeout.
+func (m *Middlebox) reassemble(conn net.Conn) ([]byte, error) {
+	var data []byte
+	buf := make([]byte, maxInspected)
+	for segments := 0; segments < m.opts.Depth && len(data) < maxInspected; segments++ {
+		if segments > 0 {
+			_ = conn.SetReadDeadline(time.Now().Add(m.opts.Timeout))
+		}
+		n, err := conn.Read(buf[:maxInspected-len(data)])
+		data = append(data, buf[:n]...)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, complete := inspect(data); complete {
+			break
+		}
+	}
+	return data, conn.SetReadDeadline(time.Time{})
+}
+
+// isBlocked reports whether the hello or request in data asks for a blocked domain.
+func (m *Middlebox) isBlocked(data []byte) bool {
+	host, _ := inspect(data)
+	if host == "" {
+		return false
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range m.opts.Blocked {
+		domain = strings.ToLower(domain)
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// inspect returns the server name of the tls client hello or the host of the http request
+// in data, and whether the hello or the request headers are complete.
+func inspect(data []byte) (host string, complete bool) {
+	if hello, err := sni.ReadClientHello(bytes.NewReader(data)); err == nil {
+		return hello.ServerName, true
+	}
+	return httpHost(data)
+}
+
+// httpHost finds the Host header of an http request. The header name is matched
+// case-sensitively, like DPI boxes that don't parse http do.
+func httpHost(data []byte) (host string, complete bool) {
+	head, _, complete := bytes.Cut(data, []byte("\r\n\r\n"))
+	lines := strings.Split(string(head), "\r\n")
+	if !complete {
+		// the last line may be cut off
+		lines = lines[:len(lines)-1]
+	}
+	for _, line := range lines {
+		if value, ok := strings.CutPrefix(line, "Host:"); ok {
+			host = strings.TrimSpace(value)
+			if h, _, err := net.SplitHostPort(host); err == nil {
+				host = h
+			}
+			return host, true
+		}
+	}
+	return "", complete
+}
@@ -0,0 +1,130 @@
+package dpitest
+
+import (
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+const blockedDomain = "blocked.example"
+
+// splitConn writes the first write in two segments, split at offset with a pause between them.
+type splitConn struct {
+	net.Conn
+	offset int
+	pause  time.Duration
+	split  bool
+}
+
+func (c *splitConn) Write(b []byte) (int, error) {
+	if c.split || len(b) <= c.offset {
+		return c.Conn.Write(b)
+	}
+	c.split = true
+	if _, err := c.Conn.Write(b[:c.offset]); err != nil {
+		return 0, err
+	}
+	time.Sleep(c.pause)
+	if _, err := c.Conn.Write(b[c.offset:]); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func setup(t *testing.T, opts ...Option) *Middlebox {
+	t.Helper()
+	server, err := NewTLSServer(blockedDomain, "allowed.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Close() })
+	m, err := New(server.Addr(), append([]Option{WithBlocked(blockedDomain)}, opts...)...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+	return m
+}
+
+// handshake does a tls handshake with serverName through m, the first write is split at
+// offset if it's not 0, and sends a message that's echoed back.
+func handshake(m *Middlebox, serverName string, offset int, pause time.Duration) error {
+	conn, err := net.Dial("tcp", m.Addr())
+	if err != nil {
+		return err
+	}
+	_ = conn.(*net.TCPConn).SetNoDelay(true)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if offset > 0 {
+		conn = &splitConn{Conn: conn, offset: offset, pause: pause}
+	}
+	client := tls.Client(conn, &tls.Config{ServerName: serverName, InsecureSkipVerify: true})
+	defer client.Close()
+	if err := client.Handshake(); err != nil {
+		return err
+	}
+	if _, err := client.Write([]byte("ping")); err != nil {
+		return err
+	}
+	_, err = client.Read(make([]byte, 4))
+	return err
+}
+
+func TestMiddleboxTLS(t *testing.T) {
+	m := setup(t)
+	if err := handshake(m, "allowed.example", 0, 0); err != nil {
+		t.Errorf("Expected an allowed domain to get through, got %v", err)
+	}
+	if err := handshake(m, blockedDomain, 0, 0); err == nil {
+		t.Error("Expected a blocked domain to be reset")
+	}
+	if err := handshake(m, "www."+blockedDomain, 0, 0); err == nil {
+		t.Error("Expected a subdomain of a blocked domain to be reset")
+	}
+	if err := handshake(m, blockedDomain, 10, 20*time.Millisecond); err != nil {
+		t.Errorf("Expected a split hello to get through without reassembly, got %v", err)
+	}
+	if m.Blocked() != 2 || m.Passed() != 2 {
+		t.Errorf("Expected 2 blocked and 2 passed connections, got %d and %d", m.Blocked(), m.Passed())
+	}
+}
+
+func TestMiddleboxReassembly(t *testing.T) {
+	m := setup(t, WithDepth(2), WithTimeout(100*time.Millisecond))
+	if err := handshake(m, blockedDomain, 10, 20*time.Millisecond); err == nil {
+		t.Error("Expected a hello split in two to be reassembled and reset")
+	}
+	if err := handshake(m, "allowed.example", 0, 0); err != nil {
+		t.Errorf("Expected a complete hello to be let through right away, got %v", err)
+	}
+	// the second segment comes after the middlebox stopped waiting for it
+	if err := handshake(m, blockedDomain, 10, 300*time.Millisecond); err != nil {
+		t.Errorf("Expected a hello whose second segment comes after the timeout to get through, got %v", err)
+	}
+}
+
+func TestMiddleboxHTTP(t *testing.T) {
+	m := setup(t)
+	request := func(header string) {
+		conn, err := net.Dial("tcp", m.Addr())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Write([]byte("GET / HTTP/1.1\r\n" + header + ": " + blockedDomain + "\r\n\r\n")); err != nil {
+			t.Fatal(err)
+		}
+		// the tls server answers with an alert if the request gets through
+		_, _ = conn.Read(make([]byte, 64))
+	}
+	request("Host")
+	if m.Blocked() != 1 {
+		t.Errorf("Expected a request for a blocked host to be reset")
+	}
+	request("hOSt")
+	if m.Passed() != 1 {
+		t.Errorf("Expected a request whose host header isn't matched to get through")
+	}
+}
@@ -0,0 +1,76 @@
+package dpitest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/big"
+	"net"
+	"time"
+)
+
+// TLSServer is a tls server with a self-signed certificate that echoes what it receives,
+// it's the upstream that middleboxes are put in front of.
+type TLSServer struct {
+	ln net.Listener
+}
+
+// NewTLSServer starts a tls server with a certificate for names.
+func NewTLSServer(names ...string) (*TLSServer, error) {
+	cert, err := certificate(names)
+	if err != nil {
+		return nil, err
+	}
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		return nil, err
+	}
+	s := &TLSServer{ln: ln}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *TLSServer) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server.
+func (s *TLSServer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *TLSServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+}
+
+// certificate returns a self-signed certificate for names.
+func certificate(names []string) (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,260 @@
+// Package relay is the worker end of the tunnel written in Go. It speaks the same protocol
+// as the Cloudflare worker, so it can be self-hosted on a server or used in tests:
+//
+//   - /connect?host=&port=&net=tcp&session= carries a tcp connection over a WebSocket
+//   - /connect?host=&port=&net=udp&session= carries udp packets, each WebSocket message is
+//     the client id, a 2 byte channel and the packet, replies are the channel and the packet
+//   - /connect?net=udp2&session= carries udp packets to any destination, the packets and the
+//     replies are socks5 udp datagrams, which carry the destination or the source of the packet
+//   - /mux carries tcp streams multiplexed by the mux package
+//   - /dns-query forwards DoH queries to an upstream DoH server
+//
+// The endpoints only serve clients whose session is the token of the server, and the tunnels
+// don't connect to loopback, private and link-local addresses unless that's allowed.
+package relay
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/bepass/logger"
+	"github.com/bepass-org/bepass/mux"
+	"github.com/bepass-org/bepass/net/adapter/ws"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// dialTimeout limits how long connecting to a destination may take
+	dialTimeout = 10 * time.Second
+	// defaultUDPIdleTimeout is how long udp bindings are kept without packets if UDPIdleTimeout isn't set
+	defaultUDPIdleTimeout = 2 * time.Minute
+	// dohTimeout limits how long a forwarded DoH query may take
+	dohTimeout = 10 * time.Second
+	// maxDoHBody limits the size of a forwarded DoH query
+	maxDoHBody = 64 << 10
+)
+
+// errForbidden is returned for destinations that the clients aren't allowed to reach
+var errForbidden = errors.New("destination not allowed")
+
+// Server serves the endpoints of the worker.
+type Server struct {
+	// Dial connects to the destinations, net.Dialer is used if it's nil
+	Dial func(network, addr string) (net.Conn, error)
+	// DoHUpstream is the DoH server that /dns-query is forwarded to, /dns-query isn't served if it's empty
+	DoHUpstream string
+	// UDPIdleTimeout is how long a udp binding is kept without packets
+	UDPIdleTimeout time.Duration
+	// Token is the secret that clients send as their session, every client is refused
+	// if it's empty
+	Token string
+	// AllowPrivate lets the clients reach loopback, private and link-local addresses
+	AllowPrivate bool
+
+	upgrader  websocket.Upgrader
+	mux       *mux.Handler
+	dohClient *http.Client
+	once      sync.Once
+}
+
+func (s *Server) init() {
+	s.once.Do(func() {
+		s.mux = &mux.Handler{Dial: s.dial}
+		s.dohClient = &http.Client{Timeout: dohTimeout}
+	})
+}
+
+// ServeHTTP serves the endpoint of the request path.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.init()
+	switch r.URL.Path {
+	case "/connect", "/mux", "/dns-query":
+		if !s.authorized(r) {
+			http.Error(w, "invalid session", http.StatusForbidden)
+			return
+		}
+		switch r.URL.Path {
+		case "/connect":
+			s.connect(w, r)
+		case "/mux":
+			s.mux.ServeHTTP(w, r)
+		default:
+			s.dnsQuery(w, r)
+		}
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// authorized reports whether the session of r is the token.
+func (s *Server) authorized(r *http.Request) bool {
+	session := r.URL.Query().Get("session")
+	return s.Token != "" && subtle.ConstantTimeCompare([]byte(session), []byte(s.Token)) == 1
+}
+
+// dial connects to a destination, the address is checked after it's resolved.
+func (s *Server) dial(network, addr string) (net.Conn, error) {
+	if s.Dial != nil {
+		return s.dialChecked(network, addr)
+	}
+	d := &net.Dialer{Timeout: dialTimeout}
+	if !s.AllowPrivate {
+		d.Control = func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			return s.checkIP(net.ParseIP(host))
+		}
+	}
+	return d.Dial(network, addr)
+}
+
+// dialChecked dials addr with s.Dial. Its host is resolved and checked here, and the checked
+// addresses are dialed, so the host can't resolve to another address in between.
+func (s *Server) dialChecked(network, addr string) (net.Conn, error) {
+	if s.AllowPrivate {
+		return s.Dial(network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupIP(context.Background(), "ip", host)
+	if err != nil {
+		return nil, err
+	}
+	for _, ip := range ips {
+		if err := s.checkIP(ip); err != nil {
+			return nil, err
+		}
+	}
+	for _, ip := range ips {
+		var conn net.Conn
+		if conn, err = s.Dial(network, net.JoinHostPort(ip.String(), port)); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, err
+}
+
+// checkIP returns errForbidden for loopback, private, link-local and unspecified addresses,
+// unless they are allowed.
+func (s *Server) checkIP(ip net.IP) error {
+	if s.AllowPrivate {
+		return nil
+	}
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return fmt.Errorf("%s: %w", ip, errForbidden)
+	}
+	return nil
+}
+
+// connect serves /connect, the destination is given by the query parameters.
+func (s *Server) connect(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("net") == "udp2" {
+		s.connectUDP(w, r, "", true)
+		return
+	}
+	host, port := strings.Trim(q.Get("host"), "[]"), q.Get("port")
+	if host == "" || port == "" {
+		http.Error(w, "missing host or port", http.StatusBadRequest)
+		return
+	}
+	addr := net.JoinHostPort(host, port)
+
+	switch q.Get("net") {
+	case "tcp", "":
+		s.connectTCP(w, r, addr)
+	case "udp":
+		s.connectUDP(w, r, addr, false)
+	default:
+		http.Error(w, "unsupported network", http.StatusBadRequest)
+	}
+}
+
+// connectTCP connects to addr before upgrading, so the client sees when it's unreachable.
+func (s *Server) connectTCP(w http.ResponseWriter, r *http.Request, addr string) {
+	conn, err := s.dial("tcp", addr)
+	if err != nil {
+		logger.Infof("relay: unable to connect to %s: %v", addr, err)
+		status := http.StatusBadGateway
+		if errors.Is(err, errForbidden) {
+			status = http.StatusForbidden
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer conn.Close()
+
+	wsConn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Errorf("relay: upgrade failed: %v", err)
+		return
+	}
+	tunnel := ws.New(wsConn)
+	defer tunnel.Close()
+
+	errCh := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(conn, tunnel)
+		errCh <- err
+	}()
+	go func() {
+		_, err := io.Copy(tunnel, conn)
+		errCh <- err
+	}()
+	<-errCh
+}
+
+// dnsQuery forwards a DoH query to the DoH upstream and its answer back.
+func (s *Server) dnsQuery(w http.ResponseWriter, r *http.Request) {
+	if s.DoHUpstream == "" {
+		http.NotFound(w, r)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxDoHBody))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	}
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, s.DoHUpstream, bytes.NewReader(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// the token isn't passed on to the upstream
+	q := r.URL.Query()
+	q.Del("session")
+	req.URL.RawQuery = q.Encode()
+	for _, header := range []string{"Accept", "Content-Type"} {
+		if v := r.Header.Get(header); v != "" {
+			req.Header.Set(header, v)
+		}
+	}
+	resp, err := s.dohClient.Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, header := range []string{"Content-Type", "Cache-Control"} {
+		if v := resp.Header.Get(header); v != "" {
+			w.Header().Set(header, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
@@ -0,0 +1,301 @@
+package relay
+
+import (
+	"errors"
+	"github.com/bepass-org/bepass/socks5/statute"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// echoTCP starts a tcp server that echoes what it receives.
+func echoTCP(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// echoUDP starts a udp server that echoes the packets it receives and where they came from.
+func echoUDP(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(append(buf[:n], " "+addr.String()...), addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// connect opens /connect of srv to addr with the session test.
+func connect(t *testing.T, srv *httptest.Server, addr, network string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	return connectSession(t, srv, addr, network, "test")
+}
+
+func connectSession(t *testing.T, srv *httptest.Server, addr, network, session string) (*websocket.Conn, *http.Response, error) {
+	t.Helper()
+	host, port, _ := net.SplitHostPort(addr)
+	u := "ws" + strings.TrimPrefix(srv.URL, "http") + "/connect?host=" + host + "&port=" + port + "&net=" + network + "&session=" + session
+	conn, resp, err := websocket.DefaultDialer.Dial(u, nil)
+	if err == nil {
+		t.Cleanup(func() { _ = conn.Close() })
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	}
+	return conn, resp, err
+}
+
+func TestConnectTCP(t *testing.T) {
+	srv := httptest.NewServer(&Server{Token: "test", AllowPrivate: true})
+	defer srv.Close()
+
+	conn, _, err := connect(t, srv, echoTCP(t), "tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the clients start with an empty message
+	for _, msg := range []string{"", "ping"} {
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, msg, err := conn.ReadMessage(); err != nil || string(msg) != "ping" {
+		t.Errorf("Expected the echo of the destination, got %q, %v", msg, err)
+	}
+
+	// a destination that can't be reached fails the upgrade
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = closed.Close()
+	if _, resp, err := connect(t, srv, closed.Addr().String(), "tcp"); err == nil || resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected a bad gateway response, got %v", err)
+	}
+	if _, resp, err := connect(t, srv, closed.Addr().String(), "icmp"); err == nil || resp == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected a bad request response, got %v", err)
+	}
+}
+
+func TestConnectUDP(t *testing.T) {
+	srv := httptest.NewServer(&Server{Token: "test", AllowPrivate: true, UDPIdleTimeout: 100 * time.Millisecond})
+	defer srv.Close()
+
+	conn, _, err := connect(t, srv, echoUDP(t), "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the replies come back on the channel of their packet, every channel has its own socket
+	exchange := func(channel string) string {
+		t.Helper()
+		if err := conn.WriteMessage(websocket.BinaryMessage, []byte("abcdef"+channel+"ping")); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		reply, source, _ := strings.Cut(string(msg), " ")
+		if want := channel + "ping"; reply != want {
+			t.Errorf("Expected %q, got %q", want, reply)
+		}
+		return source
+	}
+	first, second := exchange("\x00\x01"), exchange("\x00\x02")
+	if first == second {
+		t.Errorf("Expected the channels to use different sockets, both used %s", first)
+	}
+	if again := exchange("\x00\x01"); again != first {
+		t.Errorf("Expected the channel to keep its socket %s, got %s", first, again)
+	}
+
+	// idle bindings are removed, so the next packet gets a new socket
+	time.Sleep(300 * time.Millisecond)
+	if again := exchange("\x00\x01"); again == first {
+		t.Errorf("Expected the idle socket %s to be replaced", first)
+	}
+}
+
+func TestConnectUDPDatagrams(t *testing.T) {
+	srv := httptest.NewServer(&Server{Token: "test", AllowPrivate: true})
+	defer srv.Close()
+
+	conn, _, err := connect(t, srv, "", "udp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// one channel sends to several destinations, the replies carry where they came from
+	for _, dest := range []string{echoUDP(t), echoUDP(t)} {
+		pk, err := statute.NewDatagram(dest, []byte("ping"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte("abcdef\x00\x01"), pk.Bytes()...)); err != nil {
+			t.Fatal(err)
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(msg[:2]) != "\x00\x01" {
+			t.Errorf("Expected the reply on channel 1, got %q", msg[:2])
+		}
+		reply, err := statute.ParseDatagram(msg[2:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if reply.DstAddr.String() != dest || !strings.HasPrefix(string(reply.Data), "ping ") {
+			t.Errorf("Expected the echo of %s, got %q from %s", dest, reply.Data, reply.DstAddr.String())
+		}
+	}
+}
+
+func TestSession(t *testing.T) {
+	srv := httptest.NewServer(&Server{Token: "secret", AllowPrivate: true})
+	defer srv.Close()
+
+	for _, session := range []string{"", "test"} {
+		if _, resp, err := connectSession(t, srv, echoTCP(t), "tcp", session); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected the session %q to be refused, got %v", session, err)
+		}
+	}
+	resp, err := http.Get(srv.URL + "/mux?session=test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected the mux session to be refused, got %d", resp.StatusCode)
+	}
+	if _, _, err := connectSession(t, srv, echoTCP(t), "tcp", "secret"); err != nil {
+		t.Errorf("Expected the token to be accepted, got %v", err)
+	}
+
+	// without a token nobody is served
+	empty := httptest.NewServer(&Server{AllowPrivate: true})
+	defer empty.Close()
+	if _, resp, err := connectSession(t, empty, echoTCP(t), "tcp", ""); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected a relay without a token to refuse clients, got %v", err)
+	}
+}
+
+func TestPrivateDestinations(t *testing.T) {
+	srv := httptest.NewServer(&Server{Token: "test", UDPIdleTimeout: time.Second})
+	defer srv.Close()
+
+	for _, addr := range []string{echoTCP(t), "169.254.169.254:80", "10.0.0.1:80", "[::1]:80"} {
+		if _, resp, err := connect(t, srv, addr, "tcp"); err == nil || resp == nil || resp.StatusCode != http.StatusForbidden {
+			t.Errorf("Expected %s to be refused, got %v", addr, err)
+		}
+	}
+
+	// the packets of datagram tunnels are dropped
+	conn, _, err := connect(t, srv, "", "udp2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pk, err := statute.NewDatagram(echoUDP(t), []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, append([]byte("abcdef\x00\x01"), pk.Bytes()...)); err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+	if _, msg, err := conn.ReadMessage(); err == nil {
+		t.Errorf("Expected no reply from a loopback destination, got %q", msg)
+	}
+}
+
+func TestDialChecked(t *testing.T) {
+	var dialed []string
+	s := &Server{Dial: func(network, addr string) (net.Conn, error) {
+		dialed = append(dialed, addr)
+		return nil, errors.New("unreachable")
+	}}
+	if _, err := s.dial("tcp", "localhost:80"); !errors.Is(err, errForbidden) {
+		t.Errorf("Expected localhost to be refused, got %v", err)
+	}
+	if len(dialed) != 0 {
+		t.Errorf("Expected a refused destination not to be dialed, got %v", dialed)
+	}
+	// an allowed address is dialed as it was checked
+	_, _ = s.dial("tcp", "[2001:db8::1]:80")
+	if len(dialed) != 1 || dialed[0] != "[2001:db8::1]:80" {
+		t.Errorf("Expected the checked address to be dialed, got %v", dialed)
+	}
+}
+
+func TestDNSQuery(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(append([]byte(r.Method+" "+r.URL.RawQuery+" "+r.Header.Get("Content-Type")+" "), body...))
+	}))
+	defer upstream.Close()
+	srv := httptest.NewServer(&Server{Token: "test", DoHUpstream: upstream.URL + "/dns-query"})
+	defer srv.Close()
+
+	// the session isn't passed on to the upstream
+	resp, err := http.Post(srv.URL+"/dns-query?x=1&session=test", "application/dns-message", strings.NewReader("query"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if want := "POST x=1 application/dns-message query"; string(body) != want {
+		t.Errorf("Expected %q, got %q", want, body)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/dns-message" {
+		t.Errorf("Expected the content type of the upstream, got %q", ct)
+	}
+
+	for _, tc := range []struct {
+		session, body string
+		status        int
+	}{
+		{"", "query", http.StatusForbidden},
+		{"secret", "query", http.StatusForbidden},
+		{"test", strings.Repeat("x", maxDoHBody+1), http.StatusRequestEntityTooLarge},
+	} {
+		resp, err := http.Post(srv.URL+"/dns-query?session="+tc.session, "application/dns-message", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.status {
+			t.Errorf("Expected %d for session %q with %d bytes, got %d", tc.status, tc.session, len(tc.body), resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package relay
+
+import (
+	"errors"
+	"github.com/bepass-org/bepass/logger"
+	"github.com/bepass-org/bepass/socks5/statute"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// clientIDLength is the length of the client id that prefixes the udp messages of a client
+	clientIDLength = 6
+	// channelLength is the length of the channel that follows the client id
+	channelLength = 2
+	// maxDatagramSize is the largest udp packet that's read from a destination
+	maxDatagramSize = 64 * 1024
+)
+
+// errFragmented is returned for fragmented datagrams, which aren't supported
+var errFragmented = errors.New("fragmented datagram")
+
+// udpTunnel relays the udp packets of a WebSocket connection, every client id and channel
+// pair gets its own udp socket, so replies can be sent back on the channel they belong to.
+type udpTunnel struct {
+	conn        *websocket.Conn
+	addr        string // the destination of all packets, unless datagrams is set
+	datagrams   bool   // the packets are socks5 udp datagrams that carry their own destination
+	dial        func(network, addr string) (net.Conn, error)
+	checkIP     func(ip net.IP) error
+	idleTimeout time.Duration
+
+	writeMu  sync.Mutex
+	mu       sync.Mutex
+	bindings map[string]*udpBinding
+}
+
+// udpBinding is the udp socket of a channel.
+type udpBinding struct {
+	conn       net.Conn
+	packetConn net.PacketConn // the unconnected socket of datagram tunnels
+	channel    []byte
+	timer      *time.Timer
+}
+
+// connectUDP relays the udp packets sent over the WebSocket to addr, or to the destination of
+// every packet if datagrams is set.
+func (s *Server) connectUDP(w http.ResponseWriter, r *http.Request, addr string, datagrams bool) {
+	wsConn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		logger.Errorf("relay: upgrade failed: %v", err)
+		return
+	}
+	idleTimeout := s.UDPIdleTimeout
+	if idleTimeout <= 0 {
+		idleTimeout = defaultUDPIdleTimeout
+	}
+	t := &udpTunnel{
+		conn:        wsConn,
+		addr:        addr,
+		datagrams:   datagrams,
+		dial:        s.dial,
+		checkIP:     s.checkIP,
+		idleTimeout: idleTimeout,
+		bindings:    make(map[string]*udpBinding),
+	}
+	t.serve()
+}
+
+// serve reads the messages of the client until the WebSocket is closed.
+func (t *udpTunnel) serve() {
+	defer t.close()
+	for {
+		_, msg, err := t.conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if len(msg) < clientIDLength+channelLength {
+			continue
+		}
+		key := string(msg[:clientIDLength+channelLength])
+		b, err := t.binding(key)
+		if err != nil {
+			logger.Infof("relay: unable to open udp socket: %v", err)
+			continue
+		}
+		b.timer.Reset(t.idleTimeout)
+		if err := t.send(b, msg[clientIDLength+channelLength:]); err != nil {
+			logger.Infof("relay: unable to send udp packet: %v", err)
+		}
+	}
+}
+
+// send sends the payload of a message to its destination.
+func (t *udpTunnel) send(b *udpBinding, payload []byte) error {
+	if !t.datagrams {
+		_, err := b.conn.Write(payload)
+		return err
+	}
+	pk, err := statute.ParseDatagram(payload)
+	if err != nil {
+		return err
+	}
+	if pk.Frag != 0 {
+		return errFragmented
+	}
+	addr, err := net.ResolveUDPAddr("udp", pk.DstAddr.String())
+	if err != nil {
+		return err
+	}
+	if err := t.checkIP(addr.IP); err != nil {
+		return err
+	}
+	_, err = b.packetConn.WriteTo(pk.Data, addr)
+	return err
+}
+
+// binding returns the udp socket of key, it's opened on the first packet of the channel.
+func (t *udpTunnel) binding(key string) (*udpBinding, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if b, ok := t.bindings[key]; ok {
+		return b, nil
+	}
+	b := &udpBinding{channel: []byte(key[clientIDLength:])}
+	if t.datagrams {
+		conn, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+		b.conn, b.packetConn = conn, conn
+	} else {
+		conn, err := t.dial("udp", t.addr)
+		if err != nil {
+			return nil, err
+		}
+		b.conn = conn
+	}
+	b.timer = time.AfterFunc(t.idleTimeout, func() { t.remove(key, b) })
+	t.bindings[key] = b
+	go t.reply(key, b)
+	return b, nil
+}
+
+// reply sends the packets received on the socket of b back on its channel, the packets of
+// datagram tunnels are wrapped in datagrams with the address they came from.
+func (t *udpTunnel) reply(key string, b *udpBinding) {
+	defer t.remove(key, b)
+	buf := make([]byte, maxDatagramSize)
+	for {
+		var payload []byte
+		if t.datagrams {
+			n, from, err := b.packetConn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pk, err := statute.NewDatagram(from.String(), buf[:n])
+			if err != nil {
+				continue
+			}
+			payload = pk.Bytes()
+		} else {
+			n, err := b.conn.Read(buf)
+			if err != nil {
+				return
+			}
+			payload = buf[:n]
+		}
+		b.timer.Reset(t.idleTimeout)
+		if err := t.write(b.channel, payload); err != nil {
+			_ = t.conn.Close()
+			return
+		}
+	}
+}
+
+// write sends payload to the client as one message, prefixed with channel.
+func (t *udpTunnel) write(channel, payload []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	w, err := t.conn.NextWriter(websocket.BinaryMessage)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(channel); err != nil {
+		return err
+	}
+	if _, err := w.Write(payload); err != nil {
+		return err
+	}
+	return w.Close()
+}
+
+// remove closes the socket of b when it's idle or failed.
+func (t *udpTunnel) remove(key string, b *udpBinding) {
+	t.mu.Lock()
+	if t.bindings[key] == b {
+		delete(t.bindings, key)
+	}
+	t.mu.Unlock()
+	b.timer.Stop()
+	_ = b.conn.Close()
+}
+
+func (t *udpTunnel) close() {
+	_ = t.conn.Close()
+	t.mu.Lock()
+	bindings := t.bindings
+	t.bindings = make(map[string]*udpBinding)
+	t.mu.Unlock()
+	for _, b := range bindings {
+		b.timer.Stop()
+		_ = b.conn.Close()
+	}
+}
@@ -0,0 +1,99 @@
+// Package resolve provides DNS resolution and host file management functionality.
+package resolve
+
+import (
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxChain limits the number of CNAME and DNAME records followed for a name.
+	maxChain = 16
+	// defaultNegativeTTL is the ttl of negative responses without an SOA record.
+	defaultNegativeTTL = 60
+)
+
+// Address is a resolved address of a host with the ttl of its record in seconds.
+type Address struct {
+	IP  net.IP
+	TTL uint32
+}
+
+func (a Address) String() string {
+	return a.IP.String()
+}
+
+// FromMsg returns the A and AAAA addresses of name in the answer section of m.
+// CNAME and DNAME records in the answer are followed, target is the name the chain ends at.
+// If the response has no addresses for the end of the chain, target has to be queried again.
+// The ttl of an address is capped by the ttl of the aliases that lead to it.
+func FromMsg(m *dns.Msg, name string) (addrs []Address, target string) {
+	target = dns.CanonicalName(name)
+	chainTTL := ^uint32(0)
+
+	for hops := 0; hops <= maxChain; hops++ {
+		var next string
+		for _, rr := range m.Answer {
+			hdr := rr.Header()
+			owner := dns.CanonicalName(hdr.Name)
+			ttl := hdr.Ttl
+			if chainTTL < ttl {
+				ttl = chainTTL
+			}
+
+			switch v := rr.(type) {
+			case *dns.A:
+				if owner == target {
+					addrs = append(addrs, Address{IP: v.A, TTL: ttl})
+				}
+			case *dns.AAAA:
+				if owner == target {
+					addrs = append(addrs, Address{IP: v.AAAA, TTL: ttl})
+				}
+			case *dns.CNAME:
+				if owner == target && next == "" {
+					next = dns.CanonicalName(v.Target)
+					chainTTL = ttl
+				}
+			case *dns.DNAME:
+				// a DNAME redirects the names below its owner
+				if owner != target && dns.IsSubDomain(owner, target) && next == "" {
+					next = strings.TrimSuffix(target, owner) + dns.CanonicalName(v.Target)
+					chainTTL = ttl
+				}
+			}
+		}
+		if len(addrs) > 0 || next == "" {
+			return addrs, target
+		}
+		target = next
+	}
+	return nil, target
+}
+
+// TTL returns how long a response can be cached in seconds. It's the lowest ttl of the
+// answers, or for a negative response the ttl of the SOA record in the authority section,
+// capped by its minimum field (RFC 2308).
+func TTL(m *dns.Msg) uint32 {
+	if len(m.Answer) == 0 {
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if soa.Minttl < soa.Hdr.Ttl {
+					return soa.Minttl
+				}
+				return soa.Hdr.Ttl
+			}
+		}
+		return defaultNegativeTTL
+	}
+
+	ttl := m.Answer[0].Header().Ttl
+	for _, rr := range m.Answer[1:] {
+		if rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
+	return ttl
+}
@@ -0,0 +1,88 @@
+package resolve
+
+import (
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func msg(t *testing.T, records ...string) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	for _, r := range records {
+		rr, err := dns.NewRR(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.Answer = append(m.Answer, rr)
+	}
+	return m
+}
+
+func TestFromMsg(t *testing.T) {
+	testCases := []struct {
+		name   string
+		msg    []string
+		query  string
+		addrs  []string
+		ttls   []uint32
+		target string
+	}{
+		{
+			name:   "multiple answers",
+			msg:    []string{"example.com. 300 IN A 1.1.1.1", "example.com. 200 IN A 1.0.0.1"},
+			query:  "Example.com",
+			addrs:  []string{"1.1.1.1", "1.0.0.1"},
+			ttls:   []uint32{300, 200},
+			target: "example.com.",
+		},
+		{
+			name: "cname chain",
+			msg: []string{
+				"c.example.com. 300 IN AAAA 2606:4700::1",
+				"www.example.com. 60 IN CNAME b.example.com.",
+				"b.example.com. 600 IN CNAME c.example.com.",
+			},
+			query:  "www.example.com.",
+			addrs:  []string{"2606:4700::1"},
+			ttls:   []uint32{60},
+			target: "c.example.com.",
+		},
+		{
+			name:   "dname",
+			msg:    []string{"example.com. 100 IN DNAME example.net.", "www.example.net. 300 IN A 1.2.3.4"},
+			query:  "www.example.com.",
+			addrs:  []string{"1.2.3.4"},
+			ttls:   []uint32{100},
+			target: "www.example.net.",
+		},
+		{
+			name:   "chain ends outside of the response",
+			msg:    []string{"www.example.com. 60 IN CNAME cdn.example.org."},
+			query:  "www.example.com.",
+			target: "cdn.example.org.",
+		},
+		{
+			name:  "cname loop",
+			msg:   []string{"a.example.com. 60 IN CNAME b.example.com.", "b.example.com. 60 IN CNAME a.example.com."},
+			query: "a.example.com.",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			addrs, target := FromMsg(msg(t, tc.msg...), tc.query)
+			if len(addrs) != len(tc.addrs) {
+				t.Fatalf("Expected %d addresses, got %v", len(tc.addrs), addrs)
+			}
+			for i := range addrs {
+				if addrs[i].String() != tc.addrs[i] || addrs[i].TTL != tc.ttls[i] {
+					t.Errorf("Expected %s with ttl %d, got %s with ttl %d", tc.addrs[i], tc.ttls[i], addrs[i], addrs[i].TTL)
+				}
+			}
+			if tc.target != "" && target != tc.target {
+				t.Errorf("Expected target %s, got %s", tc.target, target)
+			}
+		})
+	}
+}
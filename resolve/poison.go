@@ -0,0 +1,146 @@
+// Package resolve provides DNS resolution and host file management functionality.
+package resolve
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// DefaultPoisonCIDRs are the addresses that DPI boxes are known to inject into DNS answers.
+var DefaultPoisonCIDRs = []string{
+	"10.10.3.0/24",
+	"10.10.30.0/23",
+	"10.10.32.0/21",
+}
+
+// reservedCIDRs are ranges that aren't covered by the net.IP methods but aren't
+// reachable on the internet either.
+var reservedCIDRs = mustParseCIDRs(
+	"100.64.0.0/10", // carrier-grade NAT
+	"240.0.0.0/4",   // reserved, including broadcast
+)
+
+// privateSuffixes are the suffixes of names that may resolve to private addresses.
+var privateSuffixes = []string{
+	"localhost", "local", "lan", "home", "internal", "intranet", "corp", "private", "arpa",
+}
+
+// PoisonDetector detects poisoned DNS answers: known injection addresses and, if enabled,
+// private or reserved addresses returned for public names.
+// A nil PoisonDetector reports nothing as poisoned.
+type PoisonDetector struct {
+	nets         []*net.IPNet
+	checkPrivate bool
+}
+
+// NewPoisonDetector creates a PoisonDetector for the injection addresses in cidrs,
+// DefaultPoisonCIDRs are used if cidrs is empty.
+func NewPoisonDetector(cidrs []string, checkPrivate bool) (*PoisonDetector, error) {
+	if len(cidrs) == 0 {
+		cidrs = DefaultPoisonCIDRs
+	}
+	d := &PoisonDetector{checkPrivate: checkPrivate}
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid poison cidr %q: %w", cidr, err)
+		}
+		d.nets = append(d.nets, n)
+	}
+	return d, nil
+}
+
+// Poisoned returns why ip looks like a poisoned answer for name, or "" if it doesn't.
+func (d *PoisonDetector) Poisoned(name string, ip net.IP) string {
+	if d == nil || ip == nil {
+		return ""
+	}
+	for _, n := range d.nets {
+		if n.Contains(ip) {
+			return fmt.Sprintf("%s is a known injection address", ip)
+		}
+	}
+	if d.checkPrivate && isPublicName(name) && isReserved(ip) {
+		return fmt.Sprintf("%s is a private address for a public name", ip)
+	}
+	return ""
+}
+
+// Check returns why the addresses of name look poisoned, or "" if none of them does.
+func (d *PoisonDetector) Check(name string, addrs []Address) string {
+	for _, addr := range addrs {
+		if reason := d.Poisoned(name, addr.IP); reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// Filter returns the addresses of name that don't look poisoned.
+func (d *PoisonDetector) Filter(name string, addrs []Address) []Address {
+	var clean []Address
+	for _, addr := range addrs {
+		if d.Poisoned(name, addr.IP) == "" {
+			clean = append(clean, addr)
+		}
+	}
+	return clean
+}
+
+// Disagree reports whether two answers for the same name have no address in common.
+// Answers without addresses are never considered to disagree.
+func Disagree(a, b []Address) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+	for _, x := range a {
+		for _, y := range b {
+			if x.IP.Equal(y.IP) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// isPublicName reports whether name can be resolved on the internet,
+// single labels and special use or common private suffixes can't.
+func isPublicName(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if !strings.Contains(name, ".") {
+		return false
+	}
+	for _, suffix := range privateSuffixes {
+		if strings.HasSuffix(name, "."+suffix) {
+			return false
+		}
+	}
+	return true
+}
+
+// isReserved reports whether ip isn't reachable on the internet. The unspecified address isn't
+// included, ad blocking resolvers answer with it on purpose.
+func isReserved(ip net.IP) bool {
+	if ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return true
+	}
+	for _, n := range reservedCIDRs {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets = append(nets, n)
+	}
+	return nets
+}
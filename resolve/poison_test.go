@@ -0,0 +1,72 @@
+package resolve
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPoisonDetector(t *testing.T) {
+	d, err := NewPoisonDetector(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name     string
+		ip       string
+		poisoned bool
+	}{
+		{"example.com", "10.10.34.35", true},
+		{"example.com", "10.10.3.1", true},
+		{"router.lan", "10.10.34.35", true},
+		{"example.com", "93.184.216.34", false},
+		{"example.com", "192.168.1.1", true},
+		{"example.com", "100.64.0.1", true},
+		{"example.com", "fd00::1", true},
+		{"example.com", "0.0.0.0", false},
+		{"router.lan", "192.168.1.1", false},
+		{"printer", "10.0.0.5", false},
+		{"1.168.192.in-addr.arpa", "192.168.1.1", false},
+	}
+	for _, tc := range testCases {
+		if got := d.Poisoned(tc.name, net.ParseIP(tc.ip)) != ""; got != tc.poisoned {
+			t.Errorf("Poisoned(%s, %s) = %v, expected %v", tc.name, tc.ip, got, tc.poisoned)
+		}
+	}
+
+	// private addresses are only checked when enabled
+	d, err = NewPoisonDetector([]string{"203.0.113.0/24"}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Poisoned("example.com", net.ParseIP("192.168.1.1")) != "" {
+		t.Errorf("Expected private addresses to be allowed")
+	}
+	if d.Poisoned("example.com", net.ParseIP("203.0.113.7")) == "" {
+		t.Errorf("Expected the configured range to be detected")
+	}
+
+	if _, err := NewPoisonDetector([]string{"10.10.3"}, false); err == nil {
+		t.Errorf("Expected an error for an invalid cidr")
+	}
+
+	var nilDetector *PoisonDetector
+	if nilDetector.Poisoned("example.com", net.ParseIP("10.10.34.35")) != "" {
+		t.Errorf("Expected a nil detector to report nothing")
+	}
+}
+
+func TestDisagree(t *testing.T) {
+	a := []Address{{IP: net.ParseIP("1.2.3.4")}, {IP: net.ParseIP("1.2.3.5")}}
+	b := []Address{{IP: net.ParseIP("1.2.3.5")}}
+	c := []Address{{IP: net.ParseIP("5.6.7.8")}}
+	if Disagree(a, b) {
+		t.Errorf("Expected answers with a common address to agree")
+	}
+	if !Disagree(a, c) {
+		t.Errorf("Expected answers without a common address to disagree")
+	}
+	if Disagree(a, nil) {
+		t.Errorf("Expected an empty answer not to disagree")
+	}
+}
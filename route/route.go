@@ -0,0 +1,124 @@
+package route
+
+import (
+	"context"
+	"fmt"
+	"github.com/bepass-org/bepass/socks5"
+	"net"
+	"net/url"
+
+	"golang.org/x/net/proxy"
+)
+
+// actions that a rule can take on a connection
+const (
+	ActionDirect   = "direct"
+	ActionFragment = "fragment"
+	ActionWorker   = "worker"
+	ActionReject   = "reject"
+	ActionProxy    = "proxy"
+)
+
+// Metadata holds what is known about a connection when it is routed.
+// Host is the tls sni or http host if it could be extracted, the requested domain otherwise.
+type Metadata struct {
+	Host string
+	IP   net.IP
+	Port int
+}
+
+// Decision is the result of routing a connection.
+type Decision struct {
+	Action string
+	// Proxy is the upstream proxy url of the proxy action
+	Proxy string
+	// Rule describes the matched rule, it's empty if the default action was taken
+	Rule string
+}
+
+type compiledRule struct {
+	rule    Rule
+	matcher matcher
+}
+
+// Router matches connections against the rules in order, the first matching rule wins.
+// Connections that don't match any rule get the default action.
+type Router struct {
+	rules         []compiledRule
+	defaultAction string
+}
+
+// New compiles the rules and creates a Router.
+func New(rules []Rule, defaultAction string) (*Router, error) {
+	if err := checkAction(defaultAction, ""); err != nil {
+		return nil, fmt.Errorf("default route: %w", err)
+	}
+	r := &Router{defaultAction: defaultAction}
+	for i := range rules {
+		rule := rules[i]
+		if err := checkAction(rule.Action, rule.Proxy); err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		m, err := rule.compile()
+		if err != nil {
+			return nil, fmt.Errorf("rule %d: %w", i+1, err)
+		}
+		r.rules = append(r.rules, compiledRule{rule: rule, matcher: m})
+	}
+	return r, nil
+}
+
+func checkAction(action, proxyURL string) error {
+	switch action {
+	case ActionDirect, ActionFragment, ActionWorker, ActionReject:
+		return nil
+	case ActionProxy:
+		u, err := url.Parse(proxyURL)
+		if err != nil {
+			return err
+		}
+		if _, err := proxy.FromURL(u, proxy.Direct); err != nil {
+			return fmt.Errorf("invalid proxy %q: %w", proxyURL, err)
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown action %q", action)
+}
+
+// Match returns the decision for a connection.
+func (r *Router) Match(m Metadata) Decision {
+	m.Host = normalizeHost(m.Host)
+	for i := range r.rules {
+		if r.rules[i].matcher.match(&m) {
+			return Decision{
+				Action: r.rules[i].rule.Action,
+				Proxy:  r.rules[i].rule.Proxy,
+				Rule:   r.rules[i].rule.String(),
+			}
+		}
+	}
+	return Decision{Action: r.defaultAction}
+}
+
+// Allow implements the socks5.RuleSet interface, it rejects requests whose requested
+// address is already routed to the reject action before any data is read.
+func (r *Router) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if req.RawDestAddr == nil {
+		return ctx, true
+	}
+	d := r.Match(Metadata{
+		Host: req.RawDestAddr.FQDN,
+		IP:   req.RawDestAddr.IP,
+		Port: req.RawDestAddr.Port,
+	})
+	return ctx, d.Action != ActionReject
+}
+
+// Dialer returns a dialer that connects through the upstream proxy of the decision.
+func (d Decision) Dialer() (proxy.Dialer, error) {
+	u, err := url.Parse(d.Proxy)
+	if err != nil {
+		return nil, err
+	}
+	return proxy.FromURL(u, proxy.Direct)
+}
@@ -0,0 +1,95 @@
+package route
+
+import (
+	"context"
+	"github.com/bepass-org/bepass/socks5"
+	"github.com/bepass-org/bepass/socks5/statute"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRouterMatch(t *testing.T) {
+	// a GeoIP style list
+	listFile := filepath.Join(t.TempDir(), "ir.txt")
+	if err := os.WriteFile(listFile, []byte("# local networks\n5.160.0.0/16\n\n2.144.0.0/14\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	router, err := New([]Rule{
+		{Type: TypeDomain, Values: []string{"ads.example.com"}, Action: ActionReject},
+		{Type: TypeDomainSuffix, Values: []string{"ir"}, Action: ActionDirect},
+		{Type: TypeDomainKeyword, Values: []string{"google"}, Action: ActionWorker},
+		{Type: TypeDomainRegex, Values: []string{`^cdn\d+\.example\.org$`}, Action: ActionProxy, Proxy: "socks5://127.0.0.1:1080"},
+		{Type: TypeIPCIDR, File: listFile, Action: ActionDirect},
+		{Type: TypePort, Values: []string{"6881-6889"}, Action: ActionReject},
+	}, ActionFragment)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	testCases := []struct {
+		name     string
+		metadata Metadata
+		action   string
+	}{
+		{"exact domain", Metadata{Host: "ADS.example.com.", Port: 443}, ActionReject},
+		{"subdomain of exact domain", Metadata{Host: "x.ads.example.com", Port: 443}, ActionFragment},
+		{"domain suffix", Metadata{Host: "www.digikala.ir", Port: 443}, ActionDirect},
+		{"domain suffix itself", Metadata{Host: "ir", Port: 443}, ActionDirect},
+		{"domain suffix is not a substring match", Metadata{Host: "fair", Port: 443}, ActionFragment},
+		{"keyword", Metadata{Host: "www.google.com", Port: 443}, ActionWorker},
+		{"regex", Metadata{Host: "cdn12.example.org", Port: 443}, ActionProxy},
+		{"cidr from file", Metadata{Host: "example.net", IP: net.ParseIP("2.147.1.1"), Port: 443}, ActionDirect},
+		{"port range", Metadata{IP: net.ParseIP("1.1.1.1"), Port: 6885}, ActionReject},
+		{"default", Metadata{Host: "example.com", IP: net.ParseIP("93.184.216.34"), Port: 443}, ActionFragment},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if d := router.Match(tc.metadata); d.Action != tc.action {
+				t.Errorf("Expected action %s, got %s (rule %s)", tc.action, d.Action, d.Rule)
+			}
+		})
+	}
+}
+
+func TestRouterAllow(t *testing.T) {
+	router, err := New([]Rule{
+		{Type: TypeDomainSuffix, Values: []string{"blocked.com"}, Action: ActionReject},
+	}, ActionFragment)
+	if err != nil {
+		t.Fatalf("New failed: %v", err)
+	}
+
+	req := &socks5.Request{RawDestAddr: &statute.AddrSpec{FQDN: "www.blocked.com", Port: 443}}
+	if _, ok := router.Allow(context.Background(), req); ok {
+		t.Errorf("Expected request to be rejected")
+	}
+	req = &socks5.Request{RawDestAddr: &statute.AddrSpec{FQDN: "example.com", Port: 443}}
+	if _, ok := router.Allow(context.Background(), req); !ok {
+		t.Errorf("Expected request to be allowed")
+	}
+}
+
+func TestRouterInvalidRules(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule Rule
+	}{
+		{"unknown type", Rule{Type: "geosite", Values: []string{"ir"}, Action: ActionDirect}},
+		{"unknown action", Rule{Type: TypeDomain, Values: []string{"a.com"}, Action: "drop"}},
+		{"invalid cidr", Rule{Type: TypeIPCIDR, Values: []string{"10.0.0.0/33"}, Action: ActionDirect}},
+		{"invalid port range", Rule{Type: TypePort, Values: []string{"90-80"}, Action: ActionDirect}},
+		{"invalid proxy", Rule{Type: TypeDomain, Values: []string{"a.com"}, Action: ActionProxy, Proxy: "ftp://a"}},
+		{"missing file", Rule{Type: TypeIPCIDR, File: "does-not-exist.txt", Action: ActionDirect}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, err := New([]Rule{tc.rule}, ActionFragment); err == nil {
+				t.Errorf("Expected an error")
+			}
+		})
+	}
+}
@@ -0,0 +1,226 @@
+// Package route provides a rule engine that decides per connection how bepass
+// forwards the traffic.
+package route
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// rule types
+const (
+	TypeDomain        = "domain"
+	TypeDomainSuffix  = "domain-suffix"
+	TypeDomainKeyword = "domain-keyword"
+	TypeDomainRegex   = "domain-regex"
+	TypeIPCIDR        = "ip-cidr"
+	TypePort          = "port"
+)
+
+// Rule matches connections by one of the rule types and tells which action should handle them.
+// Values are read from the rule itself and from File, which holds one value per line and allows
+// using GeoIP or domain lists. Empty lines and lines starting with # are ignored.
+type Rule struct {
+	Type   string   `mapstructure:"Type"`
+	Values []string `mapstructure:"Values"`
+	File   string   `mapstructure:"File"`
+	Action string   `mapstructure:"Action"`
+	// Proxy is the upstream proxy url used by the proxy action, e.g. socks5://127.0.0.1:1080
+	Proxy string `mapstructure:"Proxy"`
+}
+
+// String returns a short description of the rule for logging.
+func (r *Rule) String() string {
+	if r.File != "" {
+		return fmt.Sprintf("%s(%s)->%s", r.Type, r.File, r.Action)
+	}
+	return fmt.Sprintf("%s(%s)->%s", r.Type, strings.Join(r.Values, ","), r.Action)
+}
+
+// matcher is a compiled rule.
+type matcher interface {
+	match(m *Metadata) bool
+}
+
+type domainMatcher map[string]struct{}
+
+func (d domainMatcher) match(m *Metadata) bool {
+	_, ok := d[m.Host]
+	return ok
+}
+
+type domainSuffixMatcher []string
+
+func (d domainSuffixMatcher) match(m *Metadata) bool {
+	for _, suffix := range d {
+		if m.Host == suffix || strings.HasSuffix(m.Host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+type domainKeywordMatcher []string
+
+func (d domainKeywordMatcher) match(m *Metadata) bool {
+	for _, keyword := range d {
+		if strings.Contains(m.Host, keyword) {
+			return true
+		}
+	}
+	return false
+}
+
+type domainRegexMatcher []*regexp.Regexp
+
+func (d domainRegexMatcher) match(m *Metadata) bool {
+	for _, re := range d {
+		if re.MatchString(m.Host) {
+			return true
+		}
+	}
+	return false
+}
+
+type cidrMatcher []*net.IPNet
+
+func (c cidrMatcher) match(m *Metadata) bool {
+	if m.IP == nil {
+		return false
+	}
+	for _, network := range c {
+		if network.Contains(m.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+type portRange [2]int
+
+type portMatcher []portRange
+
+func (p portMatcher) match(m *Metadata) bool {
+	for _, r := range p {
+		if m.Port >= r[0] && m.Port <= r[1] {
+			return true
+		}
+	}
+	return false
+}
+
+// values returns the values of the rule together with the ones listed in its file.
+func (r *Rule) values() ([]string, error) {
+	values := append([]string{}, r.Values...)
+	if r.File == "" {
+		return values, nil
+	}
+	file, err := os.Open(r.File)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		values = append(values, line)
+	}
+	return values, scanner.Err()
+}
+
+// compile builds the matcher of the rule.
+func (r *Rule) compile() (matcher, error) {
+	values, err := r.values()
+	if err != nil {
+		return nil, err
+	}
+
+	switch r.Type {
+	case TypeDomain:
+		m := domainMatcher{}
+		for _, v := range values {
+			m[normalizeHost(v)] = struct{}{}
+		}
+		return m, nil
+	case TypeDomainSuffix:
+		m := domainSuffixMatcher{}
+		for _, v := range values {
+			m = append(m, strings.TrimPrefix(normalizeHost(v), "."))
+		}
+		return m, nil
+	case TypeDomainKeyword:
+		m := domainKeywordMatcher{}
+		for _, v := range values {
+			m = append(m, strings.ToLower(v))
+		}
+		return m, nil
+	case TypeDomainRegex:
+		m := domainRegexMatcher{}
+		for _, v := range values {
+			re, err := regexp.Compile(v)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, re)
+		}
+		return m, nil
+	case TypeIPCIDR:
+		m := cidrMatcher{}
+		for _, v := range values {
+			if !strings.Contains(v, "/") {
+				if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+					v += "/32"
+				} else {
+					v += "/128"
+				}
+			}
+			_, network, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, network)
+		}
+		return m, nil
+	case TypePort:
+		m := portMatcher{}
+		for _, v := range values {
+			r, err := parsePortRange(v)
+			if err != nil {
+				return nil, err
+			}
+			m = append(m, r)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("unknown rule type %q", r.Type)
+}
+
+// parsePortRange parses a single port like 443 or a range like 8000-9000.
+func parsePortRange(v string) (portRange, error) {
+	from, to, isRange := strings.Cut(v, "-")
+	start, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return portRange{}, fmt.Errorf("invalid port %q", v)
+	}
+	end := start
+	if isRange {
+		end, err = strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || end < start {
+			return portRange{}, fmt.Errorf("invalid port range %q", v)
+		}
+	}
+	return portRange{start, end}, nil
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
@@ -0,0 +1,176 @@
+package server
+
+import (
+	"fmt"
+	"github.com/bepass-org/bepass/logger"
+	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/upstream"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// pinnedTTL is the ttl of answers that come from the hosts overrides or the worker address
+	pinnedTTL = 300
+	// staleTTL is the ttl of stale answers that are served while they are renewed (RFC 8767)
+	staleTTL = 30
+)
+
+// Exchange answers a DNS query of any type, it's used by the local dns server.
+// A and AAAA queries for the hosts overrides, the worker and the DoH server are answered
+// locally, everything else is sent with the configured DNS resolution mechanism and cached.
+func (s *Server) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	if len(req.Question) != 1 {
+		return nil, fmt.Errorf("expected one question, got %d", len(req.Question))
+	}
+	q := req.Question[0]
+
+	if q.Qclass == dns.ClassINET && (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) {
+		if ip := s.pinnedIP(strings.TrimSuffix(strings.ToLower(q.Name), ".")); ip != nil {
+			return pinnedReply(req, ip), nil
+		}
+	}
+
+	key := strings.ToLower(q.Name) + "/" + dns.Class(q.Qclass).String() + "/" + dns.Type(q.Qtype).String()
+	if cachedValue, expiration, stale, found := s.Cache.GetStaleWithExpiration(key); found {
+		resp := cachedValue.(*dns.Msg).Copy()
+		if stale {
+			logger.Infof("using stale cached value for %s", key)
+			query := req.Copy()
+			s.refresh(key, func() {
+				_, _ = s.forward(query, key)
+			})
+			setTTL(resp, staleTTL)
+		} else {
+			logger.Infof("using cached value for %s", key)
+			// the records count down from when they were cached, they may also come from the cache file
+			if !expiration.IsZero() {
+				lowerTTL(resp, uint32(math.Ceil(time.Until(expiration).Seconds())))
+			}
+		}
+		resp.Id = req.Id
+		return resp, nil
+	}
+
+	return s.forward(req, key)
+}
+
+// forward sends req with the configured DNS resolution mechanism and caches the response under key,
+// A and AAAA answers are checked for poisoning before they are cached.
+func (s *Server) forward(req *dns.Msg, key string) (*dns.Msg, error) {
+	resp, err := s.exchange(req.Copy())
+	if err != nil {
+		return nil, err
+	}
+	// answers and negative responses are cached, failures are not
+	if resp.Rcode == dns.RcodeSuccess || resp.Rcode == dns.RcodeNameError {
+		if ttl := s.cacheTTL(resolve.TTL(resp)); ttl > 0 {
+			s.Cache.SetWithTTL(key, resp.Copy(), ttl)
+		}
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// refresh renews the stale cache entry of key with f in the background,
+// only one renewal of a key runs at a time.
+func (s *Server) refresh(key string, f func()) {
+	if _, running := s.refreshing.LoadOrStore(key, struct{}{}); running {
+		return
+	}
+	go func() {
+		defer s.refreshing.Delete(key)
+		f()
+	}()
+}
+
+// setTTL sets the ttl of all records in m.
+func setTTL(m *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
+// lowerTTL lowers the ttl of all records in m to at most ttl.
+func lowerTTL(m *dns.Msg, ttl uint32) {
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if rr.Header().Rrtype != dns.TypeOPT && rr.Header().Ttl > ttl {
+				rr.Header().Ttl = ttl
+			}
+		}
+	}
+}
+
+// cacheTTL clamps the ttl of a record to the configured range of the cache,
+// zero means it must not be cached.
+func (s *Server) cacheTTL(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d < s.CacheMinTTL {
+		d = s.CacheMinTTL
+	}
+	if s.CacheMaxTTL > 0 && d > s.CacheMaxTTL {
+		d = s.CacheMaxTTL
+	}
+	return d
+}
+
+// nxDomainError is returned, and cached, for names that don't exist.
+type nxDomainError struct {
+	name string
+	ttl  uint32
+}
+
+func (e *nxDomainError) Error() string {
+	return fmt.Sprintf("%s: %s", e.name, dns.RcodeToString[dns.RcodeNameError])
+}
+
+// pinnedIP returns the address that host is pinned to, or nil if it must be resolved.
+func (s *Server) pinnedIP(host string) net.IP {
+	if s.WorkerConfig.WorkerEnabled {
+		if u, err := url.Parse(s.WorkerConfig.WorkerAddress); err == nil && u.Hostname() == host {
+			if h, _, err := net.SplitHostPort(s.WorkerConfig.WorkerIPPortAddress); err == nil {
+				return net.ParseIP(h)
+			}
+		}
+	}
+
+	if h := s.LocalResolver.CheckHosts(host); h != "" {
+		return net.ParseIP(h)
+	}
+
+	// the upstreams themselves can't be resolved through the upstreams
+	for _, addr := range upstream.Addresses(s.Upstream) {
+		if u, err := url.Parse(addr); err == nil && u.Hostname() == host {
+			return net.ParseIP(s.LocalResolver.Resolve(host))
+		}
+	}
+	return nil
+}
+
+// pinnedReply answers req with ip, the answer is empty if ip doesn't match the query type.
+func pinnedReply(req *dns.Msg, ip net.IP) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.RecursionAvailable = true
+
+	q := req.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: pinnedTTL}
+	if ip4 := ip.To4(); ip4 != nil {
+		if q.Qtype == dns.TypeA {
+			resp.Answer = append(resp.Answer, &dns.A{Hdr: hdr, A: ip4})
+		}
+	} else if q.Qtype == dns.TypeAAAA {
+		resp.Answer = append(resp.Answer, &dns.AAAA{Hdr: hdr, AAAA: ip})
+	}
+	return resp
+}
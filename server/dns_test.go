@@ -0,0 +1,94 @@
+package server
+
+import (
+	"errors"
+	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/utils"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestExchangeCachedTTL(t *testing.T) {
+	s := &Server{
+		Cache:         utils.NewCache(utils.NoExpiration),
+		Upstream:      staticUpstream("1.2.3.4"),
+		LocalResolver: &resolve.LocalResolver{},
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// an answer that was cached with a ttl of 300 seconds and has 20 seconds left
+	cached := new(dns.Msg)
+	cached.SetReply(req)
+	cached.Answer = append(cached.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+		A:   net.ParseIP("1.2.3.4").To4(),
+	})
+	// the ttl of the OPT record holds its flags
+	cached.SetEdns0(1232, true)
+	s.Cache.SetWithExpiration("example.com./IN/A", cached, time.Now().Add(20*time.Second))
+
+	resp, err := s.Exchange(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl := resp.Answer[0].Header().Ttl; ttl > 20 || ttl < 19 {
+		t.Errorf("Expected the ttl to count down to 20, got %d", ttl)
+	}
+	if opt := resp.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("Expected the flags of the OPT record to be kept")
+	}
+	if ttl := cached.Answer[0].Header().Ttl; ttl != 300 {
+		t.Errorf("Expected the cached answer to be left alone, got ttl %d", ttl)
+	}
+}
+
+func TestExchangePoisoned(t *testing.T) {
+	poison, err := resolve.NewPoisonDetector(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func() *Server {
+		return &Server{
+			Cache:         utils.NewCache(utils.NoExpiration),
+			CacheMaxTTL:   time.Hour,
+			Upstream:      staticUpstream("10.10.34.35"),
+			Poison:        poison,
+			LocalResolver: &resolve.LocalResolver{},
+		}
+	}
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+
+	// without a trusted upstream the poisoned answer is dropped and not cached
+	s := newServer()
+	if _, err := s.Exchange(req); !errors.Is(err, errPoisoned) {
+		t.Errorf("Expected a poisoned answer error, got %v", err)
+	}
+	if n := s.Cache.ItemCount(); n != 0 {
+		t.Errorf("Expected nothing to be cached, got %d entries", n)
+	}
+
+	// the trusted upstream is queried again and its answer is cached
+	s = newServer()
+	s.TrustedUpstream = staticUpstream("93.184.216.34")
+	for i := 0; i < 2; i++ {
+		resp, err := s.Exchange(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a, ok := resp.Answer[0].(*dns.A); !ok || a.A.String() != "93.184.216.34" {
+			t.Errorf("Expected the trusted answer, got %v", resp.Answer)
+		}
+	}
+
+	// other types are passed through
+	s = newServer()
+	req.SetQuestion("example.com.", dns.TypeMX)
+	if _, err := s.Exchange(req); err != nil {
+		t.Errorf("Expected the MX query to be passed through, got %v", err)
+	}
+}
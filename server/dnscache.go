@@ -0,0 +1,116 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/bepass-org/bepass/logger"
+	"github.com/bepass-org/bepass/resolve"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// cacheFileEntry is a DNS cache entry in the cache file, it holds one of the
+// resolved addresses, a non-existent domain or a packed response of the dns server.
+type cacheFileEntry struct {
+	Key        string            `json:"key"`
+	Expiration int64             `json:"expiration"`
+	Addresses  []resolve.Address `json:"addresses,omitempty"`
+	NXDomain   bool              `json:"nxdomain,omitempty"`
+	Msg        []byte            `json:"msg,omitempty"`
+}
+
+// SaveCache writes the DNS cache to path, entries keep their original expiration.
+func (s *Server) SaveCache(path string) error {
+	items := s.Cache.Items()
+	entries := make([]cacheFileEntry, 0, len(items))
+	for k, item := range items {
+		e := cacheFileEntry{Key: k, Expiration: item.Expiration}
+		switch v := item.Object.(type) {
+		case []resolve.Address:
+			e.Addresses = v
+		case *nxDomainError:
+			e.NXDomain = true
+		case *dns.Msg:
+			buf, err := v.Pack()
+			if err != nil {
+				continue
+			}
+			e.Msg = buf
+		default:
+			continue
+		}
+		entries = append(entries, e)
+	}
+
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+	// write to a temporary file first so a crash doesn't leave a truncated cache behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// LoadCache restores the DNS cache from path, a missing file is not an error.
+func (s *Server) LoadCache(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var entries []cacheFileEntry
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		var x interface{}
+		switch {
+		case len(e.Msg) > 0:
+			m := new(dns.Msg)
+			if err := m.Unpack(e.Msg); err != nil {
+				continue
+			}
+			x = m
+		case e.NXDomain:
+			x = &nxDomainError{name: e.Key}
+		case len(e.Addresses) > 0:
+			x = e.Addresses
+		default:
+			continue
+		}
+
+		var t time.Time
+		if e.Expiration > 0 {
+			t = time.Unix(0, e.Expiration)
+		}
+		s.Cache.SetWithExpiration(e.Key, x, t)
+	}
+	// drop what expired beyond the stale window while we weren't running
+	s.Cache.DeleteExpired()
+	logger.Infof("loaded %d dns cache entries from %s", s.Cache.ItemCount(), path)
+	return nil
+}
+
+// saveCacheEvery saves the DNS cache to path at every interval until stop is closed.
+func (s *Server) saveCacheEvery(path string, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SaveCache(path); err != nil {
+				logger.Errorf("failed to save dns cache: %v", err)
+			}
+		case <-stop:
+			return
+		}
+	}
+}
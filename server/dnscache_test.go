@@ -0,0 +1,57 @@
+package server
+
+import (
+	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/utils"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSaveAndLoadCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dns-cache.json")
+	expiration := time.Now().Add(time.Hour)
+
+	s := &Server{Cache: utils.NewCache(utils.NoExpiration)}
+	s.Cache.SetWithExpiration("example.com.", []resolve.Address{{IP: net.ParseIP("1.2.3.4"), TTL: 300}}, expiration)
+	s.Cache.SetWithExpiration("nx.example.com.", &nxDomainError{name: "nx.example.com."}, expiration)
+	s.Cache.SetWithExpiration("old.example.com.", []resolve.Address{{IP: net.ParseIP("1.2.3.5")}}, time.Now().Add(-time.Hour))
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeMX)
+	s.Cache.SetWithExpiration("example.com./IN/MX", m, expiration)
+
+	if err := s.SaveCache(path); err != nil {
+		t.Fatalf("SaveCache failed: %v", err)
+	}
+
+	loaded := &Server{Cache: utils.NewCache(utils.NoExpiration)}
+	if err := loaded.LoadCache(path); err != nil {
+		t.Fatalf("LoadCache failed: %v", err)
+	}
+
+	items := loaded.Cache.Items()
+	if len(items) != 3 {
+		t.Fatalf("Expected 3 entries without the expired one, got %d", len(items))
+	}
+	addrs, ok := items["example.com."].Object.([]resolve.Address)
+	if !ok || len(addrs) != 1 || addrs[0].String() != "1.2.3.4" || addrs[0].TTL != 300 {
+		t.Errorf("Expected the addresses to be restored, got %v", items["example.com."].Object)
+	}
+	if items["example.com."].Expiration != expiration.UnixNano() {
+		t.Errorf("Expected the original expiration to be kept")
+	}
+	if _, ok := items["nx.example.com."].Object.(*nxDomainError); !ok {
+		t.Errorf("Expected the negative entry to be restored")
+	}
+	if msg, ok := items["example.com./IN/MX"].Object.(*dns.Msg); !ok || msg.Question[0].Qtype != dns.TypeMX {
+		t.Errorf("Expected the dns message to be restored")
+	}
+
+	// a missing file is not an error
+	if err := loaded.LoadCache(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("Expected no error for a missing file, got %v", err)
+	}
+}
@@ -3,28 +3,34 @@ package server
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"github.com/bepass-org/bepass/dialer"
-	"github.com/bepass-org/bepass/doh"
 	"github.com/bepass-org/bepass/logger"
 	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/route"
 	"github.com/bepass-org/bepass/sni"
 	"github.com/bepass-org/bepass/socks5"
 	"github.com/bepass-org/bepass/socks5/statute"
 	"github.com/bepass-org/bepass/transport"
+	"github.com/bepass-org/bepass/upstream"
 	"github.com/bepass-org/bepass/utils"
 	"io"
 	"net"
-	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/ameshkov/dnscrypt/v2"
-
 	"github.com/miekg/dns"
 )
 
+// maxLookups limits the queries sent to follow a CNAME chain
+const maxLookups = 8
+
+// errPoisoned is returned when only poisoned answers were received for a name
+var errPoisoned = errors.New("poisoned dns answer")
+
 // FragmentConfig Constants for chunk lengths and delays.
 type FragmentConfig struct {
 	BSL   [2]int
@@ -41,10 +47,13 @@ type WorkerConfig struct {
 }
 
 type Server struct {
-	RemoteDNSAddr         string
 	Cache                 *utils.Cache
-	ResolveSystem         string
-	DoHClient             *doh.Client
+	CacheMinTTL           time.Duration
+	CacheMaxTTL           time.Duration
+	Upstream              upstream.Upstream
+	TrustedUpstream       upstream.Upstream
+	CrossCheck            bool
+	Poison                *resolve.PoisonDetector
 	ChunkConfig           FragmentConfig
 	WorkerConfig          WorkerConfig
 	Dialer                *dialer.Dialer
@@ -52,6 +61,9 @@ type Server struct {
 	EnableLowLevelSockets bool
 	LocalResolver         *resolve.LocalResolver
 	Transport             *transport.Transport
+	Router                *route.Router
+	// refreshing holds the cache keys that are being renewed
+	refreshing sync.Map
 }
 
 // extractHostnameOrChangeHTTPHostHeader This function extracts the tls sni or http
@@ -68,7 +80,10 @@ func (s *Server) extractHostnameOrChangeHTTPHostHeader(data []byte) (
 	return []byte(hello.ServerName), data, false, nil
 }
 
-func (s *Server) processFirstPacket(ctx context.Context, w io.Writer, req *socks5.Request, successReply bool) (
+// processFirstPacket sends the success reply if asked to and reads the first packet of the
+// connection, it returns the tls sni or http host found in it. Nothing is resolved yet, the
+// routes that don't dial the destination themselves must not leak a dns query.
+func (s *Server) processFirstPacket(w io.Writer, req *socks5.Request, successReply bool) (
 	*socks5.Request, string, bool, error,
 ) {
 	if successReply {
@@ -84,52 +99,131 @@ func (s *Server) processFirstPacket(ctx context.Context, w io.Writer, req *socks
 		return nil, "", false, err
 	}
 
-	hostname, firstPacketData, isHTTP, err := s.extractHostnameOrChangeHTTPHostHeader(firstPacket[:read])
-
+	hostname, firstPacketData, isHTTP, _ := s.extractHostnameOrChangeHTTPHostHeader(firstPacket[:read])
 	if hostname != nil {
 		logger.Infof("Hostname %s", string(hostname))
 	}
 
-	dest, err := s.resolveDestination(ctx, req)
-	if err != nil {
-		return nil, "", false, err
+	req.Reader = &utils.BufferedReader{
+		FirstPacketData: firstPacketData,
+		BufReader:       req.Reader,
+		FirstTime:       true,
 	}
+	return req, string(hostname), isHTTP, nil
+}
 
-	IPPort := net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port))
+// resolveFirstPacket resolves the destination of req for dialing it.
+func (s *Server) resolveFirstPacket(ctx context.Context, req *socks5.Request, hostname string) ([]string, error) {
+	IPPorts, err := s.resolveDestination(ctx, req)
 
-	// if user has a faulty dns, and it returns dpi ip,
+	// if user has a faulty dns, and it returns dpi ip, or the destination can't be resolved,
 	// we resolve destination based on extracted tls sni or http hostname
-	if hostname != nil && strings.Contains(IPPort, "10.10.3") {
-		logger.Infof("%s is dpi ip extracting destination host from packets...", IPPort)
-		req.RawDestAddr.FQDN = string(hostname)
-		dest, err = s.resolveDestination(ctx, req)
+	if hostname != "" && hostname != req.RawDestAddr.FQDN {
 		if err != nil {
-			// if destination resolved to dpi and we cant resolve to actual destination
-			// it's pointless to connect to dpi
-			logger.Infof("system was unable to extract destination host from packets!")
-			return nil, "", false, err
+			logger.Infof("unable to resolve %s: %v, extracting destination host from packets...", req.RawDestAddr, err)
+		} else if reason := s.Poison.Poisoned(hostname, req.RawDestAddr.IP); reason != "" {
+			logger.Infof("%s, extracting destination host from packets...", reason)
+			err = errPoisoned
+		}
+		if err != nil {
+			req.RawDestAddr.FQDN = hostname
+			IPPorts, err = s.resolveDestination(ctx, req)
+			if err != nil {
+				// if destination resolved to dpi and we cant resolve to actual destination
+				// it's pointless to connect to dpi
+				logger.Infof("system was unable to extract destination host from packets!")
+			}
 		}
-		IPPort = net.JoinHostPort(dest.IP.String(), strconv.Itoa(dest.Port))
 	}
+	return IPPorts, err
+}
 
-	req.Reader = &utils.BufferedReader{
-		FirstPacketData: firstPacketData,
-		BufReader:       req.Reader,
-		FirstTime:       true,
+// unpoison replaces a requested ip that looks poisoned for hostname by hostname, for the routes
+// that resolve the destination remotely.
+func (s *Server) unpoison(req *socks5.Request, hostname string) {
+	if hostname == "" || req.RawDestAddr.FQDN != "" {
+		return
+	}
+	if reason := s.Poison.Poisoned(hostname, req.RawDestAddr.IP); reason != "" {
+		logger.Infof("%s, connecting to %s instead", reason, hostname)
+		req.RawDestAddr.FQDN = hostname
+		req.RawDestAddr.IP = nil
 	}
+}
 
-	return req, IPPort, isHTTP, nil
+// route decides how a connection is forwarded, without a router every connection
+// is fragmented, or tunneled if the worker is enabled for tcp traffic.
+func (s *Server) route(req *socks5.Request, hostname string) route.Decision {
+	if s.Router == nil {
+		if s.WorkerConfig.WorkerEnabled && !s.WorkerConfig.WorkerDNSOnly {
+			return route.Decision{Action: route.ActionWorker}
+		}
+		return route.Decision{Action: route.ActionFragment}
+	}
+	if hostname == "" {
+		hostname = req.RawDestAddr.FQDN
+	}
+	return s.Router.Match(route.Metadata{
+		Host: hostname,
+		IP:   req.RawDestAddr.IP,
+		Port: req.RawDestAddr.Port,
+	})
 }
 
-func (s *Server) HandleTCPTunnel(ctx context.Context, w io.Writer, req *socks5.Request, successReply bool) error {
-	r, _, _, err := s.processFirstPacket(ctx, w, req, successReply)
+// HandleTCP handles the SOCKS5 request and forwards traffic the way the router decides for it.
+// The requested address is routed before the success reply, so a rejected connection gets a
+// rule failure. Once the first packet is read it's routed again by its sni or http host, which
+// can only close a rejected connection. The destination is resolved for the direct and
+// fragment routes only, ip rules then match the resolved address.
+func (s *Server) HandleTCP(ctx context.Context, w io.Writer, req *socks5.Request, successReply bool) error {
+	if decision := s.route(req, ""); decision.Action == route.ActionReject {
+		if successReply {
+			if err := socks5.SendReply(w, statute.RepRuleFailure, nil); err != nil {
+				return err
+			}
+		}
+		return fmt.Errorf("connection to %s rejected by rule %s", req.RawDestAddr, decision.Rule)
+	}
+
+	r, hostname, isHTTP, err := s.processFirstPacket(w, req, successReply)
 	if err != nil {
 		return err
 	}
-	dest, err := s.resolveDestination(ctx, req)
-	if err == nil {
-		req.RawDestAddr = dest
+
+	decision := s.route(r, hostname)
+	var IPPorts []string
+	if decision.Action == route.ActionDirect || decision.Action == route.ActionFragment {
+		if IPPorts, err = s.resolveFirstPacket(ctx, r, hostname); err != nil {
+			return err
+		}
+		decision = s.route(r, hostname)
+	}
+	if decision.Rule != "" {
+		logger.Infof("routing %s (%s) to %s by rule %s", hostname, r.RawDestAddr, decision.Action, decision.Rule)
+	}
+
+	switch decision.Action {
+	case route.ActionReject:
+		return fmt.Errorf("connection to %s (%s) rejected by rule %s", hostname, r.RawDestAddr, decision.Rule)
+	case route.ActionWorker:
+		s.unpoison(r, hostname)
+		return s.Transport.TunnelTCP(w, r)
+	case route.ActionDirect:
+		return s.direct(w, r, IPPorts)
+	case route.ActionProxy:
+		return s.proxy(w, r, decision, hostname)
+	default:
+		return s.fragment(w, r, IPPorts, isHTTP)
 	}
+}
+
+// HandleTCPTunnel handles the SOCKS5 request and forwards traffic through the worker.
+func (s *Server) HandleTCPTunnel(_ context.Context, w io.Writer, req *socks5.Request, successReply bool) error {
+	r, hostname, _, err := s.processFirstPacket(w, req, successReply)
+	if err != nil {
+		return err
+	}
+	s.unpoison(r, hostname)
 	return s.Transport.TunnelTCP(w, r)
 }
 
@@ -139,24 +233,69 @@ func (s *Server) HandleUDPTunnel(_ context.Context, w io.Writer, req *socks5.Req
 
 // HandleTCPFragment handles the SOCKS5 request and forwards traffic to the destination.
 func (s *Server) HandleTCPFragment(ctx context.Context, w io.Writer, req *socks5.Request, successReply bool) error {
-	r, IPPort, isHTTP, err := s.processFirstPacket(ctx, w, req, successReply)
+	r, hostname, isHTTP, err := s.processFirstPacket(w, req, successReply)
 	if err != nil {
 		return err
 	}
+	IPPorts, err := s.resolveFirstPacket(ctx, r, hostname)
+	if err != nil {
+		return err
+	}
+	return s.fragment(w, r, IPPorts, isHTTP)
+}
 
-	logger.Infof("Dialing %s...", IPPort)
-
-	var conn net.Conn
+// fragment dials the destination with the fragmenting dialer and proxies the traffic.
+func (s *Server) fragment(w io.Writer, r *socks5.Request, IPPorts []string, isHTTP bool) error {
+	logger.Infof("Dialing %s...", IPPorts[0])
 
+	dial := s.Dialer.FragmentDial
 	if isHTTP {
-		conn, err = s.Dialer.HttpDial("tcp", IPPort)
-	} else {
-		conn, err = s.Dialer.FragmentDial("tcp", IPPort)
+		dial = s.Dialer.HttpDial
 	}
 
+	conn, err := dialer.DialAny(dial, "tcp", IPPorts)
 	if err != nil {
 		return err
 	}
+	return s.relay(w, r, conn)
+}
+
+// direct dials the destination without any fragmentation and proxies the traffic.
+func (s *Server) direct(w io.Writer, r *socks5.Request, IPPorts []string) error {
+	logger.Infof("Dialing %s directly...", IPPorts[0])
+
+	conn, err := dialer.DialAny(func(network, addr string) (net.Conn, error) {
+		return s.Dialer.TCPDial(network, addr)
+	}, "tcp", IPPorts)
+	if err != nil {
+		return err
+	}
+	return s.relay(w, r, conn)
+}
+
+// proxy connects to the destination through the upstream proxy of the decision,
+// the hostname is passed to the proxy when it is known so that it resolves it itself.
+func (s *Server) proxy(w io.Writer, r *socks5.Request, decision route.Decision, hostname string) error {
+	d, err := decision.Dialer()
+	if err != nil {
+		return err
+	}
+
+	addr := r.RawDestAddr.String()
+	if hostname != "" {
+		addr = net.JoinHostPort(hostname, strconv.Itoa(r.RawDestAddr.Port))
+	}
+	logger.Infof("Dialing %s through %s...", addr, decision.Proxy)
+
+	conn, err := d.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	return s.relay(w, r, conn)
+}
+
+// relay proxies the traffic between the client and conn until one side is done.
+func (s *Server) relay(w io.Writer, r *socks5.Request, conn net.Conn) error {
 	defer func() {
 		_ = conn.Close()
 	}()
@@ -183,133 +322,277 @@ func (s *Server) Copy(reader io.Reader, writer io.Writer) error {
 	return err
 }
 
-func (s *Server) resolveDestination(_ context.Context, req *socks5.Request) (*statute.AddrSpec, error) {
+// resolveDestination resolves the requested address, it returns the addresses to dial
+// in order of preference and sets the first one as the destination ip.
+func (s *Server) resolveDestination(_ context.Context, req *socks5.Request) ([]string, error) {
 	dest := req.RawDestAddr
+	port := strconv.Itoa(dest.Port)
 
-	if dest.FQDN != "" {
-		ip, err := s.Resolve(dest.FQDN)
-		if err != nil {
-			return nil, err
-		}
-		dest.IP = net.ParseIP(ip)
-		logger.Infof("resolved %s to %s", req.RawDestAddr, dest)
-	} else {
+	if dest.FQDN == "" {
 		logger.Infof("skipping resolution for %s", req.RawDestAddr)
+		return []string{net.JoinHostPort(dest.IP.String(), port)}, nil
+	}
+
+	addrs, err := s.ResolveAll(dest.FQDN)
+	if err != nil {
+		return nil, err
 	}
+	dest.IP = addrs[0].IP
 
-	return dest, nil
+	IPPorts := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		IPPorts = append(IPPorts, net.JoinHostPort(addr.IP.String(), port))
+	}
+	logger.Infof("resolved %s to %v", dest.FQDN, IPPorts)
+	return IPPorts, nil
 }
 
-// Resolve resolves the FQDN to an IP address using the specified resolution mechanism.
+// Resolve resolves the FQDN to its preferred IP address, see ResolveAll.
 func (s *Server) Resolve(fqdn string) (string, error) {
-	if s.WorkerConfig.WorkerEnabled &&
-		strings.Contains(s.WorkerConfig.WorkerAddress, fqdn) {
-		dh, _, err := net.SplitHostPort(s.WorkerConfig.WorkerIPPortAddress)
-		if strings.Contains(dh, ":") {
-			// its ipv6
-			dh = "[" + dh + "]"
+	addrs, err := s.ResolveAll(fqdn)
+	if err != nil {
+		return "", err
+	}
+	return addrs[0].IP.String(), nil
+}
+
+// ResolveAll resolves the FQDN to all of its addresses using the specified resolution mechanism.
+// A and AAAA queries are sent in parallel and IPv4 addresses are listed first.
+func (s *Server) ResolveAll(fqdn string) ([]resolve.Address, error) {
+	fqdn = strings.ToLower(strings.TrimSuffix(fqdn, "."))
+	if ip := s.pinnedIP(fqdn); ip != nil {
+		return []resolve.Address{{IP: ip, TTL: pinnedTTL}}, nil
+	}
+
+	// Ensure fqdn ends with a period
+	fqdn = dns.Fqdn(fqdn)
+
+	// Check the cache for fqdn, a stale value is used while it's renewed in the background
+	if cachedValue, stale, found := s.Cache.GetStale(fqdn); found {
+		if stale {
+			logger.Infof("using stale cached value for %s", fqdn)
+			s.refresh(fqdn, func() {
+				_, _ = s.resolveAll(fqdn)
+			})
+		} else {
+			logger.Infof("using cached value for %s", fqdn)
 		}
-		if err != nil {
-			return "", err
+		switch v := cachedValue.(type) {
+		case []resolve.Address:
+			return v, nil
+		case *nxDomainError:
+			return nil, v
 		}
-		return dh, nil
 	}
 
-	if h := s.LocalResolver.CheckHosts(fqdn); h != "" {
-		return h, nil
-	}
+	return s.resolveAll(fqdn)
+}
 
-	if s.ResolveSystem == "doh" {
-		u, err := url.Parse(s.RemoteDNSAddr)
-		if err == nil {
-			if u.Hostname() == fqdn {
-				return s.LocalResolver.Resolve(u.Hostname()), nil
+// resolveAll queries the addresses of fqdn and caches them.
+func (s *Server) resolveAll(fqdn string) ([]resolve.Address, error) {
+	addrs, err := s.query(fqdn)
+	if err != nil {
+		var nxErr *nxDomainError
+		if errors.As(err, &nxErr) {
+			if ttl := s.cacheTTL(nxErr.ttl); ttl > 0 {
+				s.Cache.SetWithTTL(fqdn, nxErr, ttl)
 			}
 		}
+		return nil, err
 	}
 
-	// Ensure fqdn ends with a period
-	if !strings.HasSuffix(fqdn, ".") {
-		fqdn += "."
+	logger.Infof("resolved %s to %v", fqdn, addrs)
+	ttl := addrs[0].TTL
+	for _, addr := range addrs[1:] {
+		if addr.TTL < ttl {
+			ttl = addr.TTL
+		}
 	}
-
-	// Check the cache for fqdn
-	if cachedValue, _ := s.Cache.Get(fqdn); cachedValue != nil {
-		logger.Infof("using cached value for %s", fqdn)
-		return cachedValue.(string), nil
+	if d := s.cacheTTL(ttl); d > 0 {
+		s.Cache.SetWithTTL(fqdn, addrs, d)
 	}
+	return addrs, nil
+}
 
-	// Build request message
-	req := dns.Msg{}
-	req.Id = dns.Id()
-	req.RecursionDesired = true
-	req.Question = []dns.Question{{
-		Name:   fqdn,
-		Qtype:  dns.TypeA,
-		Qclass: dns.ClassINET,
-	}}
-
-	// Determine which DNS resolution mechanism to use
-	var exchange *dns.Msg
-	var err error
-	switch s.ResolveSystem {
-	case "doh":
-		exchange, err = s.resolveDNSWithDOH(&req)
-	default:
-		exchange, err = s.resolveDNSWithDNSCrypt(&req)
+// query queries the addresses of fqdn. If the answer looks poisoned, or it disagrees with
+// the trusted upstream when cross checking, the answer of the trusted upstream is used instead.
+// Without a trusted upstream the poisoned addresses are dropped.
+func (s *Server) query(fqdn string) ([]resolve.Address, error) {
+	var trusted []resolve.Address
+	var trustedErr error
+	var wg sync.WaitGroup
+	crossCheck := s.CrossCheck && s.TrustedUpstream != nil
+	if crossCheck {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trusted, trustedErr = s.queryAll(s.TrustedUpstream, fqdn)
+		}()
 	}
+	addrs, err := s.queryAll(s.Upstream, fqdn)
+	wg.Wait()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	// Parse answer and store in cache
-	answer := exchange.Answer[0]
-	logger.Infof("resolved %s to %s", fqdn, strings.Replace(answer.String(), "\t", " ", -1))
-	record := strings.Fields(answer.String())
-	if record[3] == "CNAME" {
-		ip, err := s.Resolve(record[4])
-		if err != nil {
-			return "", err
+
+	reason := s.Poison.Check(fqdn, addrs)
+	if reason == "" && crossCheck && trustedErr == nil && resolve.Disagree(addrs, trusted) {
+		reason = fmt.Sprintf("the trusted upstream answered %v", trusted)
+	}
+	if reason == "" {
+		return addrs, nil
+	}
+	logger.Infof("answer %v for %s looks poisoned: %s", addrs, fqdn, reason)
+
+	if s.TrustedUpstream == nil {
+		if addrs = s.Poison.Filter(fqdn, addrs); len(addrs) == 0 {
+			return nil, fmt.Errorf("%s: %w", fqdn, errPoisoned)
 		}
-		s.Cache.Set(fqdn, ip)
-		return ip, nil
+		return addrs, nil
+	}
+	if !crossCheck {
+		trusted, trustedErr = s.queryAll(s.TrustedUpstream, fqdn)
+	}
+	if trustedErr != nil {
+		return nil, trustedErr
 	}
-	ip := record[4]
-	s.Cache.Set(fqdn, ip)
-	return ip, nil
+	if reason := s.Poison.Check(fqdn, trusted); reason != "" {
+		return nil, fmt.Errorf("%s: %w, also through the trusted upstream: %s", fqdn, errPoisoned, reason)
+	}
+	logger.Infof("resolved %s through the trusted upstream %s", fqdn, s.TrustedUpstream.Address())
+	return trusted, nil
 }
 
-// resolveDNSWithDOH resolves DNS using DNS-over-HTTP (DoH) client.
-func (s *Server) resolveDNSWithDOH(req *dns.Msg) (*dns.Msg, error) {
-	dnsAddr := s.RemoteDNSAddr
-	if s.WorkerConfig.WorkerEnabled && s.WorkerConfig.WorkerDNSOnly {
-		dnsAddr = s.WorkerConfig.WorkerAddress
+// queryAll queries the A and AAAA addresses of fqdn from u in parallel, IPv4 addresses are listed first.
+func (s *Server) queryAll(u upstream.Upstream, fqdn string) ([]resolve.Address, error) {
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	results := make([][]resolve.Address, len(qtypes))
+	errs := make([]error, len(qtypes))
+	var wg sync.WaitGroup
+	for i := range qtypes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = s.lookup(u, fqdn, qtypes[i])
+		}(i)
 	}
+	wg.Wait()
 
-	exchange, _, err := s.DoHClient.Exchange(req, dnsAddr)
-	if err != nil {
+	var addrs []resolve.Address
+	var err error
+	for i := range qtypes {
+		if errs[i] != nil {
+			err = errs[i]
+			continue
+		}
+		addrs = append(addrs, results[i]...)
+	}
+	if len(addrs) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no answer for %s", fqdn)
+		}
 		return nil, err
 	}
-	if len(exchange.Answer) == 0 {
-		return nil, fmt.Errorf("no answer")
+	return addrs, nil
+}
+
+// lookup queries the addresses of one record type. The CNAME chain in the response is followed,
+// if it ends at a name whose addresses aren't in the response, that name is queried.
+func (s *Server) lookup(u upstream.Upstream, name string, qtype uint16) ([]resolve.Address, error) {
+	for i := 0; i < maxLookups; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion(name, qtype)
+
+		exchange, err := u.Exchange(req)
+		if err != nil {
+			return nil, err
+		}
+		if exchange.Rcode == dns.RcodeNameError {
+			return nil, &nxDomainError{name: name, ttl: resolve.TTL(exchange)}
+		}
+		if exchange.Rcode != dns.RcodeSuccess {
+			return nil, fmt.Errorf("%s %s: %s", name, dns.TypeToString[qtype], dns.RcodeToString[exchange.Rcode])
+		}
+
+		addrs, target := resolve.FromMsg(exchange, name)
+		if len(addrs) > 0 || target == dns.CanonicalName(name) {
+			return addrs, nil
+		}
+		name = target
 	}
-	return exchange, nil
+	return nil, fmt.Errorf("too many aliases for %s", name)
 }
 
-// resolveDNSWithDNSCrypt resolves DNS using DNSCrypt client.
-func (s *Server) resolveDNSWithDNSCrypt(req *dns.Msg) (*dns.Msg, error) {
-	c := dnscrypt.Client{
-		Net: "tcp", Timeout: 10 * time.Second,
+// exchange sends the query to the upstream. A and AAAA answers are checked like the answers
+// of query, a poisoned answer is replaced by the answer of the trusted upstream, or without a
+// trusted upstream the poisoned records are dropped.
+func (s *Server) exchange(req *dns.Msg) (*dns.Msg, error) {
+	q := req.Question[0]
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		return s.Upstream.Exchange(req)
 	}
-	resolverInfo, err := c.Dial(s.RemoteDNSAddr)
-	if err != nil {
-		return nil, err
+	name := dns.CanonicalName(q.Name)
+
+	var trusted *dns.Msg
+	var trustedErr error
+	var wg sync.WaitGroup
+	crossCheck := s.CrossCheck && s.TrustedUpstream != nil
+	if crossCheck {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trusted, trustedErr = s.TrustedUpstream.Exchange(req.Copy())
+		}()
 	}
-	exchange, err := c.Exchange(req, resolverInfo)
+	resp, err := s.Upstream.Exchange(req)
+	wg.Wait()
 	if err != nil {
 		return nil, err
 	}
-	if len(exchange.Answer) == 0 {
-		return nil, fmt.Errorf("no answer")
+
+	addrs, _ := resolve.FromMsg(resp, name)
+	reason := s.Poison.Check(name, addrs)
+	if reason == "" && crossCheck && trustedErr == nil {
+		if trustedAddrs, _ := resolve.FromMsg(trusted, name); resolve.Disagree(addrs, trustedAddrs) {
+			reason = fmt.Sprintf("the trusted upstream answered %v", trustedAddrs)
+		}
+	}
+	if reason == "" {
+		return resp, nil
+	}
+	logger.Infof("answer %v for %s looks poisoned: %s", addrs, name, reason)
+
+	if s.TrustedUpstream == nil {
+		if len(s.Poison.Filter(name, addrs)) == 0 {
+			return nil, fmt.Errorf("%s: %w", name, errPoisoned)
+		}
+		answer := resp.Answer[:0]
+		for _, rr := range resp.Answer {
+			switch v := rr.(type) {
+			case *dns.A:
+				if s.Poison.Poisoned(name, v.A) != "" {
+					continue
+				}
+			case *dns.AAAA:
+				if s.Poison.Poisoned(name, v.AAAA) != "" {
+					continue
+				}
+			}
+			answer = append(answer, rr)
+		}
+		resp.Answer = answer
+		return resp, nil
+	}
+	if !crossCheck {
+		trusted, trustedErr = s.TrustedUpstream.Exchange(req.Copy())
+	}
+	if trustedErr != nil {
+		return nil, trustedErr
+	}
+	trustedAddrs, _ := resolve.FromMsg(trusted, name)
+	if reason := s.Poison.Check(name, trustedAddrs); reason != "" {
+		return nil, fmt.Errorf("%s: %w, also through the trusted upstream: %s", name, errPoisoned, reason)
 	}
-	return exchange, nil
+	logger.Infof("resolved %s through the trusted upstream %s", name, s.TrustedUpstream.Address())
+	return trusted, nil
 }
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/bepass-org/bepass/dialer"
+	"github.com/bepass-org/bepass/net/adapter/fragment"
+	"github.com/bepass-org/bepass/net/dpitest"
+	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/route"
+	"github.com/bepass-org/bepass/socks5"
+	"github.com/bepass-org/bepass/socks5/statute"
+	"github.com/bepass-org/bepass/utils"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// staticUpstream answers A queries with ip and AAAA queries with no addresses.
+type staticUpstream string
+
+func (u staticUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	if q := req.Question[0]; q.Qtype == dns.TypeA {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+			A:   net.ParseIP(string(u)).To4(),
+		})
+	}
+	return resp, nil
+}
+
+func (u staticUpstream) Address() string {
+	return string(u)
+}
+
+func TestResolvePoisoned(t *testing.T) {
+	poison, err := resolve.NewPoisonDetector(nil, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func() *Server {
+		return &Server{
+			Cache:         utils.NewCache(utils.NoExpiration),
+			CacheMaxTTL:   time.Hour,
+			Upstream:      staticUpstream("10.10.34.35"),
+			Poison:        poison,
+			LocalResolver: &resolve.LocalResolver{},
+		}
+	}
+
+	// without a trusted upstream the poisoned answer is dropped
+	s := newServer()
+	if _, err := s.ResolveAll("example.com"); !errors.Is(err, errPoisoned) {
+		t.Errorf("Expected a poisoned answer error, got %v", err)
+	}
+
+	// the trusted upstream is queried again
+	s = newServer()
+	s.TrustedUpstream = staticUpstream("93.184.216.34")
+	if ip, err := s.Resolve("example.com"); err != nil || ip != "93.184.216.34" {
+		t.Errorf("Expected the trusted answer, got %s, %v", ip, err)
+	}
+
+	// answers that disagree with the trusted upstream are replaced when cross checking
+	s = newServer()
+	s.Upstream = staticUpstream("203.0.113.7")
+	s.TrustedUpstream = staticUpstream("93.184.216.34")
+	if ip, _ := s.Resolve("example.com"); ip != "203.0.113.7" {
+		t.Errorf("Expected the answer to be kept without cross checking, got %s", ip)
+	}
+	s = newServer()
+	s.Upstream = staticUpstream("203.0.113.7")
+	s.TrustedUpstream = staticUpstream("93.184.216.34")
+	s.CrossCheck = true
+	if ip, _ := s.Resolve("example.com"); ip != "93.184.216.34" {
+		t.Errorf("Expected the trusted answer when cross checking, got %s", ip)
+	}
+}
+
+func TestHandleTCPFragment(t *testing.T) {
+	const blocked = "blocked.example"
+	upstream, err := dpitest.NewTLSServer(blocked)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer upstream.Close()
+	m, err := dpitest.New(upstream.Addr(), dpitest.WithBlocked(blocked))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	host, port, _ := net.SplitHostPort(m.Addr())
+	portNum, _ := strconv.Atoi(port)
+
+	handshake := func(c fragment.Config) error {
+		s := &Server{Dialer: &dialer.Dialer{Fragment: c}}
+		client, proxy := net.Pipe()
+		defer client.Close()
+		req := &socks5.Request{
+			Reader:      proxy,
+			RawDestAddr: &statute.AddrSpec{IP: net.ParseIP(host), Port: portNum},
+		}
+		go func() {
+			_ = s.HandleTCPFragment(context.Background(), proxy, req, false)
+			_ = proxy.Close()
+		}()
+
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		conn := tls.Client(client, &tls.Config{ServerName: blocked, InsecureSkipVerify: true})
+		if err := conn.Handshake(); err != nil {
+			return err
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		_, err := conn.Read(make([]byte, 4))
+		return err
+	}
+
+	if err := handshake(fragment.Config{Strategy: fragment.StrategyChunk, ChunkLength: [2]int{5000, 5000}}); err == nil {
+		t.Error("Expected an unfragmented hello to be reset")
+	}
+	whole := [2]int{2000, 2000}
+	if err := handshake(fragment.Config{BSL: whole, SL: [2]int{1, 1}, ASL: whole, Delay: [2]int{5, 5}}); err != nil {
+		t.Errorf("Expected a fragmented hello to get through, got %v", err)
+	}
+	if m.Blocked() != 1 || m.Passed() != 1 {
+		t.Errorf("Expected 1 blocked and 1 passed connection, got %d and %d", m.Blocked(), m.Passed())
+	}
+}
+
+// countingUpstream counts the queries it answers like staticUpstream.
+type countingUpstream struct {
+	staticUpstream
+	queries atomic.Int32
+}
+
+func (u *countingUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	u.queries.Add(1)
+	return u.staticUpstream.Exchange(req)
+}
+
+func TestHandleTCPRoute(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = closed.Close()
+	router, err := route.New([]route.Rule{
+		{Type: "domain", Values: []string{"rejected.example"}, Action: route.ActionReject},
+		{Type: "domain", Values: []string{"proxied.example"}, Action: route.ActionProxy, Proxy: "socks5://" + closed.Addr().String()},
+	}, route.ActionFragment)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := &countingUpstream{staticUpstream: "1.2.3.4"}
+	s := &Server{
+		Cache:         utils.NewCache(utils.NoExpiration),
+		Upstream:      u,
+		LocalResolver: &resolve.LocalResolver{},
+		Router:        router,
+	}
+	handle := func(host string) (*statute.Reply, error) {
+		client, proxy := net.Pipe()
+		defer client.Close()
+		req := &socks5.Request{Reader: proxy, RawDestAddr: &statute.AddrSpec{FQDN: host, Port: 443}}
+		result := make(chan error, 1)
+		go func() {
+			result <- s.HandleTCP(context.Background(), proxy, req, true)
+			_ = proxy.Close()
+		}()
+		_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+		reply, err := statute.ParseReply(client)
+		if err != nil {
+			return nil, err
+		}
+		if reply.Response == statute.RepSuccess {
+			_, _ = client.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		}
+		return &reply, <-result
+	}
+
+	// a rejected destination gets a rule failure instead of a success reply
+	if reply, err := handle("rejected.example"); err == nil || reply == nil || reply.Response != statute.RepRuleFailure {
+		t.Errorf("Expected a rule failure, got %v, %v", reply, err)
+	}
+	// the proxy resolves the destination itself
+	if reply, err := handle("proxied.example"); err == nil || reply == nil || reply.Response != statute.RepSuccess {
+		t.Errorf("Expected the proxy to be unreachable after a success reply, got %v, %v", reply, err)
+	}
+	if n := u.queries.Load(); n != 0 {
+		t.Errorf("Expected no dns query before dialing the proxy, got %d", n)
+	}
+}
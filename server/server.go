@@ -2,142 +2,522 @@ package server
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/bepass-org/bepass/bufferpool"
 	"github.com/bepass-org/bepass/config"
 	"github.com/bepass-org/bepass/dialer"
+	"github.com/bepass-org/bepass/dnsserver"
 	"github.com/bepass-org/bepass/doh"
+	"github.com/bepass-org/bepass/logger"
+	"github.com/bepass-org/bepass/net/adapter/fragment"
 	"github.com/bepass-org/bepass/resolve"
+	"github.com/bepass-org/bepass/route"
 	"github.com/bepass-org/bepass/socks5"
 	"github.com/bepass-org/bepass/transport"
+	"github.com/bepass-org/bepass/upstream"
 	"github.com/bepass-org/bepass/utils"
 	"io"
 	"math/rand"
-	"os"
-	"os/signal"
-	"strings"
-	"syscall"
+	"net"
+	"reflect"
+	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultDNSCacheSize is the number of cached DNS answers if DnsCacheSize isn't set
+	defaultDNSCacheSize = 4096
+	// defaultDNSUpstreamCooldown is how long failing dns upstreams are held back if DNSUpstreamCooldown isn't set
+	defaultDNSUpstreamCooldown = time.Minute
+	// defaultWorkerDoHAddr is the DoH server used while the worker is enabled if WorkerDoHAddr isn't set
+	defaultWorkerDoHAddr = "https://8.8.4.4/dns-query"
+	// defaultDNSCacheSaveInterval is how often the DNS cache file is written if DnsCacheSaveInterval isn't set
+	defaultDNSCacheSaveInterval = 5 * time.Minute
+	// defaultWorkerMuxConnections is the number of multiplexed worker connections if WorkerMuxConnections isn't set
+	defaultWorkerMuxConnections = 2
+	// muxIdleTimeout closes multiplexed worker connections without streams, so reloads don't leave them open
+	muxIdleTimeout = time.Minute
 )
 
-var s5 *socks5.Server
+// restartFields are the settings of the listeners and the dns cache, Reload doesn't change them.
+var restartFields = map[string]bool{
+	"BindAddress":          true,
+	"DNSListenAddress":     true,
+	"DnsCacheSize":         true,
+	"DnsCacheStaleTTL":     true,
+	"DnsCacheFile":         true,
+	"DnsCacheSaveInterval": true,
+}
+
+// Instance is a bepass server built from a config. Instances don't share any state,
+// several of them can run in one process.
+type Instance struct {
+	// cfg is the config of the last reload with its active profile applied, the restartFields
+	// keep the values the instance was started with. It's guarded by mu.
+	cfg         *config.Config
+	userSession string
+	s5          *socks5.Server
+	dnsSrv      *dnsserver.Server
+	// handler serves new connections, connections keep the handler they were started with
+	handler atomic.Pointer[Server]
+
+	// reloadMu serializes reloads, base is the config of the last reload with all its profiles
+	reloadMu sync.Mutex
+	base     *config.Config
+
+	mu             sync.Mutex
+	listener       net.Listener
+	stopCacheSaver chan struct{}
+	stopped        chan struct{}
+}
+
+// New creates an Instance from cfg with its active profile, it's started with Start.
+func New(base *config.Config) (*Instance, error) {
+	cfg, err := base.WithProfile(base.ActiveProfile)
+	if err != nil {
+		return nil, err
+	}
+	i := &Instance{
+		cfg:         cfg,
+		base:        base,
+		userSession: fmt.Sprintf("%08d", rand.Intn(1000)),
+		stopped:     make(chan struct{}),
+	}
+	serverHandler, err := i.newHandler(cfg, nil)
+	if err != nil {
+		return nil, err
+	}
+	i.handler.Store(serverHandler)
+
+	bindHost, _, err := net.SplitHostPort(cfg.BindAddress)
+	if err != nil {
+		return nil, err
+	}
 
-func Run(captureCTRLC bool) error {
-	config.G.UserSession = fmt.Sprintf("%08d", rand.Intn(1000))
-	appCache := utils.NewCache(time.Duration(config.G.DnsCacheTTL) * time.Second)
+	// the handlers are looked up for every connection, so that reloads apply to new connections
+	i.s5 = socks5.NewServer(
+		socks5.WithRule(rules{i}),
+		socks5.WithBindIP(net.ParseIP(bindHost)),
+		socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+			return i.handler.Load().HandleTCP(ctx, w, req, true)
+		}),
+		socks5.WithSocks4ConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+			return i.handler.Load().HandleTCP(ctx, w, req, false)
+		}),
+		socks5.WithAssociateHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
+			h := i.handler.Load()
+			if h.WorkerConfig.WorkerEnabled && !h.WorkerConfig.WorkerDNSOnly {
+				return h.HandleUDPTunnel(ctx, w, req)
+			}
+			return i.s5.HandleAssociate(ctx, w, req)
+		}),
+	)
+	if cfg.DNSListenAddress != "" {
+		i.dnsSrv = dnsserver.New(cfg.DNSListenAddress, i)
+	}
+	return i, nil
+}
 
-	var resolveSystem string
-	var dohClient *doh.Client
+// newHandler creates the handler for cfg, it uses cache if it's not nil.
+func (i *Instance) newHandler(cfg *config.Config, cache *utils.Cache) (*Server, error) {
+	appCache := cache
+	if appCache == nil {
+		cacheSize := cfg.DnsCacheSize
+		if cacheSize == 0 {
+			cacheSize = defaultDNSCacheSize
+		}
+		appCache = utils.NewCache(
+			time.Duration(cfg.DnsCacheTTL)*time.Second,
+			utils.WithMaxItems(cacheSize),
+			utils.WithCleanupInterval(time.Minute),
+			utils.WithStaleWindow(time.Duration(cfg.DnsCacheStaleTTL)*time.Second),
+		)
+	}
 
 	localResolver := &resolve.LocalResolver{
-		Hosts: config.G.Hosts,
+		Hosts: cfg.Hosts,
 	}
 
 	appDialer := &dialer.Dialer{
-		EnableLowLevelSockets: config.G.EnableLowLevelSockets,
-		TLSPaddingEnabled:     config.G.TLSPaddingEnabled,
-		TLSPaddingSize:        config.G.TLSPaddingSize,
-		ProxyAddress:          fmt.Sprintf("socks5://%s", config.G.BindAddress),
+		EnableLowLevelSockets: cfg.EnableLowLevelSockets,
+		TLSPaddingEnabled:     cfg.TLSPaddingEnabled,
+		TLSPaddingSize:        cfg.TLSPaddingSize,
+		ProxyAddress:          fmt.Sprintf("socks5://%s", cfg.BindAddress),
+		Fragment: fragment.Config{
+			Strategy:     cfg.FragmentStrategy,
+			BSL:          cfg.ChunksLengthBeforeSni,
+			SL:           cfg.SniChunksLength,
+			ASL:          cfg.ChunksLengthAfterSni,
+			ChunkLength:  cfg.FragmentChunksLength,
+			Offset:       cfg.FragmentOffset,
+			Delay:        cfg.DelayBetweenChunks,
+			RecordSplit:  cfg.TLSRecordFragmentation,
+			HeaderLength: cfg.TLSHeaderLength,
+		},
 	}
 
 	wsTunnel := &transport.WSTunnel{
-		BindAddress:        config.G.BindAddress,
-		Dialer:             appDialer,
-		ReadTimeout:        config.G.UDPReadTimeout,
-		WriteTimeout:       config.G.UDPWriteTimeout,
-		LinkIdleTimeout:    config.G.UDPLinkIdleTimeout,
-		EstablishedTunnels: make(map[string]*transport.EstablishedTunnel),
-		ShortClientID:      utils.ShortID(6),
+		BindAddress:         cfg.BindAddress,
+		WorkerIPPortAddress: cfg.WorkerIPPortAddress,
+		Dialer:              appDialer,
+		ReadTimeout:         cfg.UDPReadTimeout,
+		WriteTimeout:        cfg.UDPWriteTimeout,
+		LinkIdleTimeout:     cfg.UDPLinkIdleTimeout,
+		ShortClientID:       utils.ShortID(6),
 	}
 
+	// a self-hosted relay only serves the clients that send its token as their session
+	session := i.userSession
+	if cfg.WorkerToken != "" {
+		session = cfg.WorkerToken
+	}
 	tunnelTransport := &transport.Transport{
-		WorkerAddress: config.G.WorkerAddress,
-		BindAddress:   config.G.BindAddress,
+		WorkerAddress: cfg.WorkerAddress,
+		UserSession:   session,
+		BindAddress:   cfg.BindAddress,
 		Dialer:        appDialer,
 		BufferPool:    bufferpool.NewPool(32 * 1024),
-		UDPBind:       config.G.UDPBindAddress,
+		UDPBind:       cfg.UDPBindAddress,
 		Tunnel:        wsTunnel,
+		UDPDatagrams:  cfg.WorkerUDPDatagrams,
+	}
+	if cfg.WorkerMux {
+		endpoint, err := utils.MuxEndpointHelper(cfg.WorkerAddress, session)
+		if err != nil {
+			return nil, err
+		}
+		size := cfg.WorkerMuxConnections
+		if size == 0 {
+			size = defaultWorkerMuxConnections
+		}
+		tunnelTransport.Mux = &transport.MuxPool{
+			Tunnel:      wsTunnel,
+			Endpoint:    endpoint,
+			Size:        size,
+			IdleTimeout: muxIdleTimeout,
+		}
 	}
 
-	if strings.HasPrefix(config.G.RemoteDNSAddr, "https://") {
-		resolveSystem = "doh"
-		dohClient = doh.NewClient(
-			doh.WithDNSFragmentation((config.G.WorkerEnabled && config.G.WorkerDNSOnly) || config.G.EnableDNSFragmentation),
-			doh.WithDialer(appDialer),
-			doh.WithLocalResolver(localResolver),
+	dnsFragmentation := (cfg.WorkerEnabled && cfg.WorkerDNSOnly) || cfg.EnableDNSFragmentation
+	dnsAddrs := cfg.DNSUpstreams
+	if len(dnsAddrs) == 0 {
+		switch {
+		case cfg.WorkerEnabled && cfg.WorkerDNSOnly:
+			dnsAddrs = []config.DNSUpstream{{Address: config.UpstreamWorker}}
+		case cfg.WorkerEnabled:
+			workerDoHAddr := cfg.WorkerDoHAddr
+			if workerDoHAddr == "" {
+				workerDoHAddr = defaultWorkerDoHAddr
+			}
+			dnsAddrs = []config.DNSUpstream{{Address: workerDoHAddr}}
+		default:
+			dnsAddrs = []config.DNSUpstream{{Address: cfg.RemoteDNSAddr}}
+		}
+	}
+	// DoH requests go through the local proxy while the worker is enabled
+	dohClient, err := doh.NewClient(
+		doh.WithDNSFragmentation(dnsFragmentation),
+		doh.WithDialer(appDialer),
+		doh.WithLocalResolver(localResolver),
+		doh.WithProxy(cfg.WorkerEnabled),
+	)
+	if err != nil {
+		return nil, err
+	}
+	newUpstream := func(u config.DNSUpstream) (upstream.Upstream, error) {
+		addr := u.Address
+		if addr == config.UpstreamWorker {
+			addr = cfg.WorkerAddress
+			if cfg.WorkerToken != "" {
+				var err error
+				if addr, err = utils.DoHEndpointHelper(addr, cfg.WorkerToken); err != nil {
+					return nil, err
+				}
+			}
+		}
+		queryOptions, err := dohQueryOptions(u)
+		if err != nil {
+			return nil, err
+		}
+		return upstream.New(addr,
+			upstream.WithDialer(appDialer),
+			upstream.WithDoHClient(dohClient),
+			upstream.WithQueryOptions(queryOptions...),
+			upstream.WithLocalResolver(localResolver),
+			upstream.WithFragmentation(dnsFragmentation),
+			upstream.WithTimeout(time.Duration(cfg.DnsRequestTimeout)*time.Second),
 		)
-	} else {
-		resolveSystem = "DNSCrypt"
+	}
+	dnsUpstreams := make([]upstream.Upstream, 0, len(dnsAddrs))
+	for _, addr := range dnsAddrs {
+		u, err := newUpstream(addr)
+		if err != nil {
+			return nil, err
+		}
+		dnsUpstreams = append(dnsUpstreams, u)
+	}
+	cooldown := time.Duration(cfg.DNSUpstreamCooldown) * time.Second
+	if cooldown == 0 {
+		cooldown = defaultDNSUpstreamCooldown
+	}
+	dnsUpstream, err := upstream.NewGroup(dnsUpstreams, cfg.DNSUpstreamStrategy, cooldown)
+	if err != nil {
+		return nil, err
+	}
+	var trustedUpstream upstream.Upstream
+	if cfg.TrustedDNSAddr != "" {
+		if trustedUpstream, err = newUpstream(config.DNSUpstream{Address: cfg.TrustedDNSAddr}); err != nil {
+			return nil, err
+		}
+	}
+	poisonDetector, err := resolve.NewPoisonDetector(cfg.PoisonCIDRs, cfg.PoisonCheckPrivate)
+	if err != nil {
+		return nil, err
 	}
 
 	chunkConfig := FragmentConfig{
-		BSL:   config.G.SniChunksLength,
-		ASL:   config.G.ChunksLengthAfterSni,
-		Delay: config.G.DelayBetweenChunks,
+		BSL:   cfg.SniChunksLength,
+		ASL:   cfg.ChunksLengthAfterSni,
+		Delay: cfg.DelayBetweenChunks,
 	}
 
 	workerConfig := WorkerConfig{
-		WorkerAddress:       config.G.WorkerAddress,
-		WorkerIPPortAddress: config.G.WorkerIPPortAddress,
-		WorkerEnabled:       config.G.WorkerEnabled,
-		WorkerDNSOnly:       config.G.WorkerDNSOnly,
+		WorkerAddress:       cfg.WorkerAddress,
+		WorkerIPPortAddress: cfg.WorkerIPPortAddress,
+		WorkerEnabled:       cfg.WorkerEnabled,
+		WorkerDNSOnly:       cfg.WorkerDNSOnly,
 	}
 
 	serverHandler := &Server{
-		RemoteDNSAddr:         config.G.RemoteDNSAddr,
 		Cache:                 appCache,
-		ResolveSystem:         resolveSystem,
-		DoHClient:             dohClient,
+		CacheMinTTL:           time.Duration(cfg.DnsCacheMinTTL) * time.Second,
+		CacheMaxTTL:           time.Duration(cfg.DnsCacheTTL) * time.Second,
+		Upstream:              dnsUpstream,
+		TrustedUpstream:       trustedUpstream,
+		CrossCheck:            cfg.DNSCrossCheck,
+		Poison:                poisonDetector,
 		ChunkConfig:           chunkConfig,
 		WorkerConfig:          workerConfig,
-		BindAddress:           config.G.BindAddress,
-		EnableLowLevelSockets: config.G.EnableLowLevelSockets,
+		BindAddress:           cfg.BindAddress,
+		EnableLowLevelSockets: cfg.EnableLowLevelSockets,
 		Dialer:                appDialer,
 		LocalResolver:         localResolver,
 		Transport:             tunnelTransport,
 	}
 
-	if captureCTRLC {
-		c := make(chan os.Signal)
-		signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-		go func() {
-			<-c
-			_ = ShutDown()
-			os.Exit(0)
-		}()
+	defaultRoute := cfg.DefaultRoute
+	if defaultRoute == "" {
+		defaultRoute = route.ActionFragment
+		if workerConfig.WorkerEnabled && !workerConfig.WorkerDNSOnly {
+			defaultRoute = route.ActionWorker
+		}
+	}
+	router, err := route.New(cfg.Rules, defaultRoute)
+	if err != nil {
+		return nil, err
 	}
+	serverHandler.Router = router
+	return serverHandler, nil
+}
 
-	if workerConfig.WorkerEnabled && !workerConfig.WorkerDNSOnly {
-		s5 = socks5.NewServer(
-			socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.HandleTCPTunnel(ctx, w, req, true)
-			}),
-			socks5.WithSocks4ConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.HandleTCPTunnel(ctx, w, req, false)
-			}),
-			socks5.WithAssociateHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.HandleUDPTunnel(ctx, w, req)
-			}),
-		)
-	} else {
-		s5 = socks5.NewServer(
-			socks5.WithConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.HandleTCPFragment(ctx, w, req, true)
-			}),
-			socks5.WithSocks4ConnectHandle(func(ctx context.Context, w io.Writer, req *socks5.Request) error {
-				return serverHandler.HandleTCPFragment(ctx, w, req, false)
-			}),
-		)
+// Reload applies base with its active profile to new connections, connections that are being
+// served keep the settings they were started with. The listeners and the dns cache keep their
+// settings until a restart.
+func (i *Instance) Reload(base *config.Config) error {
+	i.reloadMu.Lock()
+	defer i.reloadMu.Unlock()
+	return i.reload(base)
+}
+
+func (i *Instance) reload(base *config.Config) error {
+	cfg, err := base.WithProfile(base.ActiveProfile)
+	if err != nil {
+		return err
+	}
+	i.mu.Lock()
+	running := i.cfg
+	i.mu.Unlock()
+	for _, c := range config.Diff(running, cfg) {
+		if restartFields[c.Field] {
+			logger.Infof("%s changed, it takes effect after a restart", c.Field)
+		}
 	}
+	// the handler has to use the addresses that are listened on, not the changed ones
+	keepRestartFields(cfg, running)
 
-	fmt.Println("Starting socks, http server:", config.G.BindAddress)
-	if err := s5.ListenAndServe("tcp", config.G.BindAddress); err != nil {
+	old := i.handler.Load()
+	h, err := i.newHandler(cfg, old.Cache)
+	if err != nil {
 		return err
 	}
+	i.handler.Store(h)
+	// the streams of the old handler are served to the end, its connections aren't reused
+	if pool := old.Transport.Mux; pool != nil {
+		pool.Retire()
+	}
+	i.mu.Lock()
+	i.cfg = cfg
+	i.mu.Unlock()
+	i.base = base
+	return nil
+}
 
+// keepRestartFields copies the restartFields of running to cfg.
+func keepRestartFields(cfg, running *config.Config) {
+	dst, src := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(running).Elem()
+	for field := range restartFields {
+		dst.FieldByName(field).Set(src.FieldByName(field))
+	}
+}
+
+// SetProfile switches to the named profile of the current config, "" switches to the config
+// without a profile. Like Reload, it applies to new connections.
+func (i *Instance) SetProfile(name string) error {
+	i.reloadMu.Lock()
+	defer i.reloadMu.Unlock()
+	base := *i.base
+	base.ActiveProfile = name
+	if err := i.reload(&base); err != nil {
+		return err
+	}
+	logger.Infof("switched to profile %q", name)
 	return nil
 }
 
-func ShutDown() error {
-	return s5.Shutdown()
+// Profile returns the name of the active profile.
+func (i *Instance) Profile() string {
+	i.reloadMu.Lock()
+	defer i.reloadMu.Unlock()
+	return i.base.ActiveProfile
+}
+
+// Exchange answers a DNS query with the current handler, see Server.Exchange.
+func (i *Instance) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	return i.handler.Load().Exchange(req)
+}
+
+// rules checks requests with the router of the current handler.
+type rules struct {
+	i *Instance
+}
+
+func (r rules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	return r.i.handler.Load().Router.Allow(ctx, req)
+}
+
+// Start listens on the bind address and serves in the background until Stop is called
+// or ctx is done. Listening errors are returned.
+func (i *Instance) Start(ctx context.Context) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.listener != nil {
+		return errors.New("server already started")
+	}
+	select {
+	case <-i.stopped:
+		return errors.New("server stopped")
+	default:
+	}
+
+	l, err := net.Listen("tcp", i.cfg.BindAddress)
+	if err != nil {
+		return err
+	}
+	i.listener = l
+
+	if i.cfg.DnsCacheFile != "" {
+		if err := i.handler.Load().LoadCache(i.cfg.DnsCacheFile); err != nil {
+			logger.Errorf("failed to load dns cache: %v", err)
+		}
+		saveInterval := time.Duration(i.cfg.DnsCacheSaveInterval) * time.Second
+		if saveInterval <= 0 {
+			saveInterval = defaultDNSCacheSaveInterval
+		}
+		i.stopCacheSaver = make(chan struct{})
+		go i.handler.Load().saveCacheEvery(i.cfg.DnsCacheFile, saveInterval, i.stopCacheSaver)
+	}
+
+	if i.dnsSrv != nil {
+		fmt.Println("Starting dns server:", i.cfg.DNSListenAddress)
+		go func() {
+			if err := i.dnsSrv.ListenAndServe(); err != nil {
+				logger.Errorf("dns server failed: %v", err)
+			}
+		}()
+	}
+
+	fmt.Println("Starting socks, http server:", l.Addr())
+	go func() {
+		if err := i.s5.Serve(l); err != nil {
+			logger.Errorf("socks server failed: %v", err)
+		}
+	}()
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = i.Stop()
+		case <-i.stopped:
+		}
+	}()
+	return nil
+}
+
+// Addr returns the address the instance listens on, it's nil before Start.
+func (i *Instance) Addr() net.Addr {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.listener == nil {
+		return nil
+	}
+	return i.listener.Addr()
+}
+
+// Stop stops the servers of the instance and saves the DNS cache, it's safe to call more than once.
+func (i *Instance) Stop() error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	select {
+	case <-i.stopped:
+		return nil
+	default:
+	}
+	close(i.stopped)
+
+	if i.stopCacheSaver != nil {
+		close(i.stopCacheSaver)
+		i.stopCacheSaver = nil
+		if err := i.handler.Load().SaveCache(i.cfg.DnsCacheFile); err != nil {
+			logger.Errorf("failed to save dns cache: %v", err)
+		}
+	}
+	if i.dnsSrv != nil {
+		if err := i.dnsSrv.Shutdown(); err != nil {
+			logger.Errorf("failed to shut down dns server: %v", err)
+		}
+	}
+	if pool := i.handler.Load().Transport.Mux; pool != nil {
+		_ = pool.Close()
+	}
+	return i.s5.Shutdown()
+}
+
+// dohQueryOptions returns the options of DoH queries to u.
+func dohQueryOptions(u config.DNSUpstream) ([]doh.QueryOption, error) {
+	opts := []doh.QueryOption{doh.WithMethod(u.Method), doh.WithPadding(u.Padding)}
+	switch u.ClientSubnet {
+	case "":
+	case config.ClientSubnetNone:
+		opts = append(opts, doh.WithoutClientSubnet())
+	default:
+		_, subnet, err := net.ParseCIDR(u.ClientSubnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client subnet of dns upstream %s: %w", u.Address, err)
+		}
+		opts = append(opts, doh.WithClientSubnet(subnet))
+	}
+	return opts, nil
 }
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/bepass-org/bepass/config"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInstances(t *testing.T) {
+	newConfig := func(strategy string) *config.Config {
+		return &config.Config{
+			BindAddress:         "127.0.0.1:0",
+			RemoteDNSAddr:       "https://127.0.0.1/dns-query",
+			DNSUpstreamStrategy: strategy,
+			FragmentStrategy:    "chunk",
+		}
+	}
+
+	// two instances with different configs run side by side
+	ctx, cancel := context.WithCancel(context.Background())
+	a, err := New(newConfig("fallback"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := New(newConfig("race"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Start(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Start(context.Background()); err == nil {
+		t.Errorf("Expected an error when starting twice")
+	}
+	if a.Addr().String() == b.Addr().String() {
+		t.Fatalf("Expected the instances to listen on different addresses")
+	}
+	for _, i := range []*Instance{a, b} {
+		conn, err := net.Dial("tcp", i.Addr().String())
+		if err != nil {
+			t.Fatalf("Expected %s to accept connections: %v", i.Addr(), err)
+		}
+		_ = conn.Close()
+	}
+
+	// canceling the context stops a, b keeps running
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", a.Addr().String())
+		if err != nil {
+			break
+		}
+		_ = conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatalf("Expected %s to be stopped", a.Addr())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	conn, err := net.Dial("tcp", b.Addr().String())
+	if err != nil {
+		t.Fatalf("Expected %s to keep running: %v", b.Addr(), err)
+	}
+	_ = conn.Close()
+
+	if err := b.Stop(); err != nil {
+		t.Errorf("Stop failed: %v", err)
+	}
+	if err := b.Stop(); err != nil {
+		t.Errorf("Expected a second Stop to succeed, got %v", err)
+	}
+	if err := a.Start(context.Background()); err == nil {
+		t.Errorf("Expected an error when starting a stopped instance")
+	}
+
+	if _, err := New(&config.Config{BindAddress: "127.0.0.1:0", DNSUpstreamStrategy: "random"}); err == nil {
+		t.Errorf("Expected an error for an invalid config")
+	}
+}
+
+func TestReload(t *testing.T) {
+	cfg := &config.Config{
+		BindAddress:   "127.0.0.1:0",
+		RemoteDNSAddr: "https://127.0.0.1/dns-query",
+	}
+	i, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := i.handler.Load()
+
+	invalid := *cfg
+	invalid.PoisonCIDRs = []string{"10.10.3"}
+	if err := i.Reload(&invalid); err == nil {
+		t.Errorf("Expected an error for an invalid config")
+	}
+	if i.handler.Load() != old {
+		t.Errorf("Expected the handler to be kept after a failed reload")
+	}
+
+	changed := *cfg
+	changed.SniChunksLength = [2]int{1, 2}
+	changed.DefaultRoute = "direct"
+	if err := i.Reload(&changed); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	h := i.handler.Load()
+	if h == old || h.ChunkConfig.BSL != [2]int{1, 2} {
+		t.Errorf("Expected the new settings to be used for new connections")
+	}
+	if h.Cache != old.Cache {
+		t.Errorf("Expected the dns cache to be kept")
+	}
+	// the old handler is left as it is for the connections it serves
+	if old.ChunkConfig.BSL != ([2]int{}) {
+		t.Errorf("Expected the old handler to keep its settings")
+	}
+
+	// the listener isn't moved, so the handler keeps using the address it listens on
+	moved := changed
+	moved.BindAddress = "127.0.0.1:1"
+	if err := i.Reload(&moved); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	h = i.handler.Load()
+	for _, addr := range []string{h.BindAddress, h.Transport.BindAddress, h.Transport.Tunnel.BindAddress, h.Dialer.ProxyAddress} {
+		if addr != cfg.BindAddress && addr != "socks5://"+cfg.BindAddress {
+			t.Errorf("Expected the handler to use %s, got %s", cfg.BindAddress, addr)
+		}
+	}
+	// the changes of a reload are the base of the next one
+	if i.cfg.DefaultRoute != "direct" || i.cfg.BindAddress != cfg.BindAddress {
+		t.Errorf("Expected the config of the last reload with the address it listens on, got %+v", i.cfg)
+	}
+}
+
+func TestSetProfile(t *testing.T) {
+	cfg := &config.Config{
+		BindAddress:     "127.0.0.1:0",
+		RemoteDNSAddr:   "https://127.0.0.1/dns-query",
+		SniChunksLength: [2]int{1, 2},
+		Profiles: map[string]json.RawMessage{
+			"mobile": json.RawMessage(`{"SniChunksLength": [5, 10], "WorkerEnabled": true}`),
+		},
+		ActiveProfile: "mobile",
+	}
+	i, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h := i.handler.Load(); h.ChunkConfig.BSL != [2]int{5, 10} || !h.WorkerConfig.WorkerEnabled {
+		t.Errorf("Expected the settings of the active profile")
+	}
+
+	if err := i.SetProfile("office"); err == nil {
+		t.Errorf("Expected an error for an unknown profile")
+	}
+	if err := i.SetProfile(""); err != nil {
+		t.Fatalf("SetProfile failed: %v", err)
+	}
+	if h := i.handler.Load(); h.ChunkConfig.BSL != [2]int{1, 2} || h.WorkerConfig.WorkerEnabled {
+		t.Errorf("Expected the settings without a profile")
+	}
+	if i.Profile() != "" || cfg.ActiveProfile != "mobile" {
+		t.Errorf("Expected the profile to be switched without changing the config")
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"net"
 	"strings"
 	"sync"
+	"time"
 )
 
 // AddressRewriter is used to rewrite a destination transparently
@@ -55,7 +56,6 @@ func (sf *Server) handleRequest(write io.Writer, req *Request) error {
 	// I disabled this part because client shouldn't resolve destination
 	/*var err error
 
-	ctx := context.Background()
 	// Resolve the address if we have a FQDN
 	dest := req.RawDestAddr
 	if dest.FQDN != "" {
@@ -66,7 +66,9 @@ func (sf *Server) handleRequest(write io.Writer, req *Request) error {
 			}
 			return fmt.Errorf("failed to resolve destination[%v], %v", dest.FQDN, err)
 		}
-	}
+	}*/
+
+	ctx := context.Background()
 
 	// Apply any address rewrites
 	req.DestAddr = req.RawDestAddr
@@ -81,10 +83,8 @@ func (sf *Server) handleRequest(write io.Writer, req *Request) error {
 		if err := SendReply(write, statute.RepRuleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply, %v", err)
 		}
-		return fmt.Errorf("bind to %v blocked by rules", req.RawDestAddr)
-	}*/
-
-	ctx := context.Background()
+		return fmt.Errorf("request to %v blocked by rules", req.RawDestAddr)
+	}
 
 	// Switch on the command
 	switch req.Command {
@@ -156,15 +156,89 @@ func (sf *Server) handleConnect(ctx context.Context, writer io.Writer, request *
 	return nil
 }
 
-// handleBind is used to handle a connect command
-func (sf *Server) handleBind(_ context.Context, writer io.Writer, _ *Request) error {
-	// TODO: Support bind
-	if err := SendReply(writer, statute.RepCommandNotSupported, nil); err != nil {
-		return fmt.Errorf("failed to send reply: %v", err)
+// handleBind is used to handle a bind command
+func (sf *Server) handleBind(_ context.Context, writer io.Writer, request *Request) error {
+	ln, err := net.ListenTCP("tcp", &net.TCPAddr{IP: sf.bindIP})
+	if err != nil {
+		if err := SendReply(writer, statute.RepServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("listen tcp failed, %v", err)
+	}
+	defer ln.Close()
+
+	// if we listen on all interfaces, advertise the address the client reached us on
+	bndAddr := ln.Addr().(*net.TCPAddr)
+	if bndAddr.IP.IsUnspecified() {
+		if localAddr, ok := request.LocalAddr.(*net.TCPAddr); ok {
+			bndAddr = &net.TCPAddr{IP: localAddr.IP, Port: bndAddr.Port}
+		}
+	}
+
+	// first reply, BND.ADDR and BND.PORT of the listener the peer should connect to
+	if err := SendReply(writer, statute.RepSuccess, bndAddr); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	if sf.bindAcceptTimeout > 0 {
+		_ = ln.SetDeadline(time.Now().Add(sf.bindAcceptTimeout))
+	}
+	target, err := sf.acceptBindPeer(ln, request)
+	if err != nil {
+		if err := SendReply(writer, statute.RepTTLExpired, nil); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+		return fmt.Errorf("bind accept failed, %v", err)
+	}
+	_ = ln.Close()
+	defer target.Close()
+
+	// second reply, the address of the connected peer
+	if err := SendReply(writer, statute.RepSuccess, target.RemoteAddr()); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+
+	// Start proxying
+	errCh := make(chan error, 2)
+	sf.goFunc(func() { errCh <- sf.Proxy(target, request.Reader) })
+	sf.goFunc(func() { errCh <- sf.Proxy(writer, target) })
+	// Wait
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if e != nil {
+			// return from this function closes target (and conn).
+			return e
+		}
 	}
 	return nil
 }
 
+// acceptBindPeer accepts exactly one inbound connection for a bind request. If the request
+// names a specific ip in DST.ADDR, connections from other hosts are dropped.
+func (sf *Server) acceptBindPeer(ln *net.TCPListener, request *Request) (*net.TCPConn, error) {
+	var expected net.IP
+	if request.DestAddr != nil && len(request.DestAddr.IP) != 0 && !request.DestAddr.IP.IsUnspecified() {
+		expected = request.DestAddr.IP
+	}
+	for {
+		conn, err := ln.AcceptTCP()
+		if err != nil {
+			return nil, err
+		}
+		if expected == nil || conn.RemoteAddr().(*net.TCPAddr).IP.Equal(expected) {
+			return conn, nil
+		}
+		logger.Errorf("bind rejected connection from %s, expected %s", conn.RemoteAddr(), expected)
+		_ = conn.Close()
+	}
+}
+
+// HandleAssociate serves an associate request with the built-in udp relay,
+// associate handles set with WithAssociateHandle can fall back to it.
+func (sf *Server) HandleAssociate(ctx context.Context, writer io.Writer, request *Request) error {
+	return sf.handleAssociate(ctx, writer, request)
+}
+
 // handleAssociate is used to handle a connect command
 func (sf *Server) handleAssociate(ctx context.Context, writer io.Writer, request *Request) error {
 	var err error
@@ -0,0 +1,125 @@
+package socks5
+
+import (
+	"bytes"
+	"github.com/bepass-org/bepass/socks5/statute"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// serve accepts connections on a local listener and serves them with srv.
+func serve(t *testing.T, srv *Server) net.Addr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() { _ = srv.ServeConn(conn) }()
+		}
+	}()
+	return ln.Addr()
+}
+
+// request negotiates no-auth and sends a request for command and dest.
+func request(t *testing.T, proxyAddr net.Addr, command byte, dest string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", proxyAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, []byte{statute.MethodNoAuth}).Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := statute.ParseMethodReply(conn); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := statute.ParseAddrSpec(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := statute.Request{Version: statute.VersionSocks5, Command: command, DstAddr: addr}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func TestBind(t *testing.T) {
+	proxyAddr := serve(t, NewServer(WithBindIP(net.ParseIP("127.0.0.1"))))
+
+	client := request(t, proxyAddr, statute.CommandBind, "127.0.0.1:0")
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	first, err := statute.ParseReply(client)
+	if err != nil {
+		t.Fatalf("reading first reply failed: %v", err)
+	}
+	if first.Response != statute.RepSuccess {
+		t.Fatalf("Expected first reply to succeed, got %d", first.Response)
+	}
+
+	peer, err := net.Dial("tcp", first.BndAddr.String())
+	if err != nil {
+		t.Fatalf("connecting to the bound address failed: %v", err)
+	}
+	defer peer.Close()
+
+	second, err := statute.ParseReply(client)
+	if err != nil {
+		t.Fatalf("reading second reply failed: %v", err)
+	}
+	if second.Response != statute.RepSuccess {
+		t.Fatalf("Expected second reply to succeed, got %d", second.Response)
+	}
+	if second.BndAddr.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Errorf("Expected second reply to hold the peer address %s, got %s", peer.LocalAddr(), second.BndAddr.String())
+	}
+
+	// relay in both directions
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || !bytes.Equal(buf, []byte("ping")) {
+		t.Fatalf("Expected ping from peer, got %q, %v", buf, err)
+	}
+	if _, err := client.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	_ = peer.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(peer, buf); err != nil || !bytes.Equal(buf, []byte("pong")) {
+		t.Fatalf("Expected pong from client, got %q, %v", buf, err)
+	}
+}
+
+func TestBindAcceptTimeout(t *testing.T) {
+	proxyAddr := serve(t, NewServer(
+		WithBindIP(net.ParseIP("127.0.0.1")),
+		WithBindAcceptTimeout(50*time.Millisecond),
+	))
+
+	client := request(t, proxyAddr, statute.CommandBind, "127.0.0.1:0")
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := statute.ParseReply(client); err != nil {
+		t.Fatalf("reading first reply failed: %v", err)
+	}
+	second, err := statute.ParseReply(client)
+	if err != nil {
+		t.Fatalf("reading second reply failed: %v", err)
+	}
+	if second.Response != statute.RepTTLExpired {
+		t.Errorf("Expected the bind to expire, got %d", second.Response)
+	}
+}
@@ -0,0 +1,135 @@
+// Package socks5 provides an HTTP/1.1 proxy frontend that turns CONNECT and
+// absolute-URI requests into SOCKS5 connect requests, so plain HTTP proxy clients
+// are served by the same connect handlers as SOCKS clients.
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"github.com/bepass-org/bepass/socks5/statute"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+// hop-by-hop headers that are meant for the proxy and must not be forwarded
+var proxyHeaders = []string{
+	"Proxy-Connection",
+	"Proxy-Authorization",
+	"Proxy-Authenticate",
+	"Keep-Alive",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// handleHTTPRequest serves a connection of an http proxy client.
+func (sf *Server) handleHTTPRequest(conn net.Conn, bufConn *bufio.Reader) error {
+	req, err := http.ReadRequest(bufConn)
+	if err != nil {
+		return err
+	}
+
+	connect := req.Method == http.MethodConnect
+	if !connect && req.URL.Scheme != "http" {
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return fmt.Errorf("unsupported http proxy request %s %s", req.Method, req.RequestURI)
+	}
+
+	host := req.URL.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if connect {
+			writeHTTPStatus(conn, http.StatusBadRequest)
+			return fmt.Errorf("invalid connect address %s, %v", host, err)
+		}
+		host = net.JoinHostPort(req.URL.Hostname(), "80")
+	}
+	dest, err := statute.ParseAddrSpec(host)
+	if err != nil {
+		writeHTTPStatus(conn, http.StatusBadRequest)
+		return fmt.Errorf("invalid destination address %s, %v", host, err)
+	}
+
+	request := &Request{
+		Request: statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: dest,
+		},
+		LocalAddr:   conn.LocalAddr(),
+		RemoteAddr:  conn.RemoteAddr(),
+		RawDestAddr: &dest,
+		Reader:      bufConn,
+	}
+
+	if !connect {
+		// the body, if any, is still unread in bufConn and follows the rewritten head
+		request.Reader = io.MultiReader(bytes.NewReader(originFormHead(req)), bufConn)
+	}
+
+	return sf.handleRequest(&httpReplyWriter{conn: conn, connect: connect}, request)
+}
+
+// originFormHead rewrites the head of an absolute-URI proxy request into the origin-form
+// request that is sent to the destination. The connection is closed after the response
+// since the next request of the client may be for another host.
+func originFormHead(req *http.Request) []byte {
+	for _, h := range proxyHeaders {
+		req.Header.Del(h)
+	}
+	req.Header.Set("Connection", "close")
+	if len(req.TransferEncoding) > 0 {
+		req.Header.Set("Transfer-Encoding", "chunked")
+		req.Header.Del("Content-Length")
+	} else if req.ContentLength > 0 {
+		req.Header.Set("Content-Length", strconv.FormatInt(req.ContentLength, 10))
+	}
+
+	var head bytes.Buffer
+	fmt.Fprintf(&head, "%s %s HTTP/1.1\r\nHost: %s\r\n", req.Method, req.URL.RequestURI(), req.Host)
+	_ = req.Header.Write(&head)
+	head.WriteString("\r\n")
+	return head.Bytes()
+}
+
+// httpReplyWriter translates the socks5 reply that connect handlers send into the matching
+// http response, everything written after the reply is passed through.
+type httpReplyWriter struct {
+	conn    net.Conn
+	connect bool
+	replied bool
+}
+
+func (w *httpReplyWriter) Write(b []byte) (int, error) {
+	if w.replied {
+		return w.conn.Write(b)
+	}
+	w.replied = true
+	if len(b) < 2 || b[0] != statute.VersionSocks5 {
+		return w.conn.Write(b)
+	}
+
+	switch b[1] {
+	case statute.RepSuccess:
+		// a forwarded request gets its response from the destination
+		if w.connect {
+			if _, err := io.WriteString(w.conn, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+				return 0, err
+			}
+		}
+	case statute.RepRuleFailure:
+		writeHTTPStatus(w.conn, http.StatusForbidden)
+	case statute.RepTTLExpired:
+		writeHTTPStatus(w.conn, http.StatusGatewayTimeout)
+	default:
+		writeHTTPStatus(w.conn, http.StatusBadGateway)
+	}
+	return len(b), nil
+}
+
+// writeHTTPStatus sends an empty http response with the given status code.
+func writeHTTPStatus(w io.Writer, code int) {
+	_, _ = fmt.Fprintf(w, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", code, http.StatusText(code))
+}
@@ -0,0 +1,111 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHTTPConnect(t *testing.T) {
+	// echo server
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}()
+
+	proxyAddr := serve(t, NewServer())
+	client, err := net.Dial("tcp", proxyAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(client, "CONNECT "+ln.Addr().String()+" HTTP/1.1\r\nHost: "+ln.Addr().String()+"\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(client)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatalf("reading connect response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", resp.StatusCode)
+	}
+
+	if _, err := io.WriteString(client, "hello"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(br, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("Expected echoed hello, got %q, %v", buf, err)
+	}
+}
+
+func TestHTTPForward(t *testing.T) {
+	var gotURI, gotProxyHeader string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotURI = r.RequestURI
+		gotProxyHeader = r.Header.Get("Proxy-Connection")
+		_, _ = io.WriteString(w, "ok")
+	}))
+	defer testServer.Close()
+
+	proxyURL, _ := url.Parse("http://" + serve(t, NewServer()).String())
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)},
+		Timeout:   5 * time.Second,
+	}
+
+	resp, err := client.Get(testServer.URL + "/path?q=1")
+	if err != nil {
+		t.Fatalf("HTTP request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("Expected 200 ok, got %d %q", resp.StatusCode, body)
+	}
+	if gotURI != "/path?q=1" {
+		t.Errorf("Expected origin-form request uri, got %q", gotURI)
+	}
+	if gotProxyHeader != "" {
+		t.Errorf("Expected proxy headers to be removed")
+	}
+}
+
+func TestHTTPConnectRejected(t *testing.T) {
+	proxyAddr := serve(t, NewServer(WithRule(NewPermitNone())))
+	client, err := net.Dial("tcp", proxyAddr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := io.WriteString(client, "CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(client), nil)
+	if err != nil {
+		t.Fatalf("reading connect response failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", resp.StatusCode)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"github.com/bepass-org/bepass/bufferpool"
 	"io"
 	"net"
+	"time"
 )
 
 // Option represents user-configurable options for the SOCKS5 server.
@@ -73,6 +74,14 @@ func WithBindIP(ip net.IP) Option {
 	}
 }
 
+// WithBindAcceptTimeout limits how long a bind request waits for the inbound connection.
+// By default, it waits for 2 minutes, a zero value waits forever.
+func WithBindAcceptTimeout(timeout time.Duration) Option {
+	return func(s *Server) {
+		s.bindAcceptTimeout = timeout
+	}
+}
+
 // WithDial allows users to provide a custom dial function for outgoing connections.
 func WithDial(dial func(ctx context.Context, network, addr string) (net.Conn, error)) Option {
 	return func(s *Server) {
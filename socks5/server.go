@@ -13,11 +13,10 @@ import (
 	"github.com/bepass-org/bepass/bufferpool"
 	"github.com/bepass-org/bepass/logger"
 	"github.com/bepass-org/bepass/socks5/statute"
-	"github.com/elazarl/goproxy"
-	"golang.org/x/net/proxy"
 	"io"
 	"net"
-	"net/http"
+	"sync"
+	"time"
 )
 
 // GPool is used to implement custom goroutine pool default use goroutine
@@ -48,6 +47,8 @@ type Server struct {
 	rewriter AddressRewriter
 	// bindIP is used for bind or udp associate
 	bindIP net.IP
+	// bindAcceptTimeout limits how long a bind request waits for the peer to connect
+	bindAcceptTimeout time.Duration
 	// Optional function for dialing out
 	dial func(ctx context.Context, network, addr string) (net.Conn, error)
 	// buffer pool
@@ -59,19 +60,21 @@ type Server struct {
 	userConnectHandle       func(ctx context.Context, writer io.Writer, request *Request) error
 	userBindHandle          func(ctx context.Context, writer io.Writer, request *Request) error
 	userAssociateHandle     func(ctx context.Context, writer io.Writer, request *Request) error
-	done                    chan bool
+	done                    chan struct{}
+	shutdown                sync.Once
+	mu                      sync.Mutex
 	listen                  net.Listener
-	httpProxyBindAddr       string
-	bindAddress             string
 }
 
 // NewServer creates a new Server
 func NewServer(opts ...Option) *Server {
 	srv := &Server{
-		authMethods: []Authenticator{},
-		bufferPool:  bufferpool.NewPool(32 * 1024),
-		resolver:    DNSResolver{},
-		rules:       NewPermitAll(),
+		authMethods:       []Authenticator{},
+		bufferPool:        bufferpool.NewPool(32 * 1024),
+		resolver:          DNSResolver{},
+		rules:             NewPermitAll(),
+		bindAcceptTimeout: 2 * time.Minute,
+		done:              make(chan struct{}),
 		dial: func(ctx context.Context, net_, addr string) (net.Conn, error) {
 			return net.Dial(net_, addr)
 		},
@@ -94,56 +97,28 @@ func NewServer(opts ...Option) *Server {
 
 // ListenAndServe is used to create a listener and serve on it
 func (sf *Server) ListenAndServe(network, addr string) error {
-	prx := goproxy.NewProxyHttpServer()
-	prx.Verbose = true
-
-	sf.bindAddress = addr
-
-	// Create a custom dialer with DialContext
-	dialer, err := proxy.SOCKS5(network, sf.bindAddress, nil, nil)
-
+	l, err := net.Listen(network, addr)
 	if err != nil {
 		return err
 	}
+	return sf.Serve(l)
+}
 
-	// Don't change this line i know this is deprecated but dialContext doesn't work
-	prx.Tr.Dial = dialer.Dial
-
-	// Find a random port and listen to it
-	listener, err := net.Listen("tcp", ":0")
-	if err != nil {
-		return err
+// Serve is used to serve internet from a listener until the server is shut down
+func (sf *Server) Serve(l net.Listener) error {
+	sf.mu.Lock()
+	select {
+	case <-sf.done:
+		sf.mu.Unlock()
+		_ = l.Close()
+		return nil
+	default:
 	}
+	sf.listen = l
+	sf.mu.Unlock()
 
-	sf.httpProxyBindAddr = listener.Addr().String()
-
-	errorChan := make(chan error)
-
-	go func() {
-		err := http.Serve(listener, prx)
-		if err != nil {
-			errorChan <- err
-			return
-		}
-	}()
-
-	go func() {
-		l, err := net.Listen(network, addr)
-		sf.listen = l
-		if err != nil {
-			errorChan <- err
-			return
-		}
-		errorChan <- sf.Serve()
-	}()
-
-	return <-errorChan
-}
-
-// Serve is used to serve internet from a listener
-func (sf *Server) Serve() error {
 	for {
-		conn, err := sf.listen.Accept()
+		conn, err := l.Accept()
 		if err != nil {
 			select {
 			case <-sf.done:
@@ -162,16 +137,19 @@ func (sf *Server) Serve() error {
 	}
 }
 
-// Shutdown gracefully stops the SOCKS5 server. It closes the listener and waits
-// for all active connections to complete. This function blocks until the server
-// is completely shut down.
+// Shutdown stops the SOCKS5 server by closing its listener, connections that are being
+// served are not interrupted. It's safe to call more than once.
 func (sf *Server) Shutdown() error {
-	go func() { sf.done <- true }() // Shutting down the socks5 proxy
-	err := sf.listen.Close()
-	if err != nil {
-		return err
-	}
-	return nil
+	var err error
+	sf.shutdown.Do(func() {
+		sf.mu.Lock()
+		defer sf.mu.Unlock()
+		close(sf.done) // Shutting down the socks5 proxy
+		if sf.listen != nil {
+			err = sf.listen.Close()
+		}
+	})
+	return err
 }
 
 // ServeConn is used to serve a single connection.
@@ -195,33 +173,6 @@ func (sf *Server) ServeConn(conn net.Conn) error {
 	}
 }
 
-func (sf *Server) handleHTTPRequest(conn net.Conn, bufConn *bufio.Reader) error {
-	// redirect http to socks5
-	dstConn, err := net.Dial(sf.listen.Addr().Network(), sf.httpProxyBindAddr)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		_ = dstConn.Close() // No need to handle the error if there's no specific action to take.
-	}()
-
-	errChan := make(chan error)
-	go func() {
-		_, err := io.Copy(dstConn, bufConn)
-		if err != nil {
-			errChan <- err
-		}
-	}()
-	go func() {
-		_, err := io.Copy(conn, dstConn)
-		if err != nil {
-			errChan <- err
-		}
-	}()
-
-	return <-errChan
-}
-
 func (sf *Server) handleSocksRequest(conn net.Conn, bufConn *bufio.Reader) error {
 	var authContext *AuthContext
 
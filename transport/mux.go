@@ -0,0 +1,151 @@
+package transport
+
+import (
+	"github.com/bepass-org/bepass/logger"
+	"github.com/bepass-org/bepass/mux"
+	"github.com/bepass-org/bepass/net/adapter/ws"
+	"net"
+	"sync"
+	"time"
+)
+
+// drainInterval is how often a retired connection is checked for streams.
+const drainInterval = time.Second
+
+// MuxPool carries tcp streams over a few persistent WebSocket connections to the worker,
+// instead of opening a WebSocket connection for every stream.
+type MuxPool struct {
+	Tunnel      *WSTunnel
+	Endpoint    string        // WebSocket endpoint of the multiplexed connections
+	Size        int           // Connections that are opened at most
+	IdleTimeout time.Duration // Connections without streams are closed after this long
+
+	mu       sync.Mutex
+	sessions []*mux.Session
+	dialing  int           // connections that are being opened, they count towards Size
+	dialed   chan struct{} // closed when one of them is opened or failed
+	closed   bool
+}
+
+// Open opens a stream to addr on the least busy connection. A new connection is opened while
+// there are less than Size and all of them carry streams, the pool isn't locked while dialing.
+func (p *MuxPool) Open(addr string) (net.Conn, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		live := p.sessions[:0]
+		for _, s := range p.sessions {
+			if !s.IsClosed() {
+				live = append(live, s)
+			}
+		}
+		p.sessions = live
+		// without a connection, wait for the ones being opened instead of opening more than Size
+		if len(p.sessions) > 0 || p.dialing < max(p.Size, 1) {
+			break
+		}
+		if p.dialed == nil {
+			p.dialed = make(chan struct{})
+		}
+		dialed := p.dialed
+		p.mu.Unlock()
+		<-dialed
+		p.mu.Lock()
+	}
+	var best *mux.Session
+	for _, s := range p.sessions {
+		if best == nil || s.NumStreams() < best.NumStreams() {
+			best = s
+		}
+	}
+	grow := best == nil || (best.NumStreams() > 0 && len(p.sessions)+p.dialing < p.Size)
+	if grow {
+		p.dialing++
+	}
+	p.mu.Unlock()
+
+	if grow {
+		s, err := p.add()
+		switch {
+		case err == nil:
+			best = s
+		case best == nil:
+			return nil, err
+		default:
+			logger.Errorf("unable to open another mux connection: %v", err)
+		}
+	}
+	return best.Open(addr)
+}
+
+// add dials a connection and adds it to the pool, p.dialing has been counted up for it.
+func (p *MuxPool) add() (*mux.Session, error) {
+	s, err := p.dial()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dialing--
+	if p.dialed != nil {
+		close(p.dialed)
+		p.dialed = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p.closed {
+		_ = s.Close()
+		return nil, net.ErrClosed
+	}
+	p.sessions = append(p.sessions, s)
+	return s, nil
+}
+
+// Close closes the connections and the streams they carry, the pool can't be used afterwards.
+func (p *MuxPool) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, s := range p.sessions {
+		_ = s.Close()
+	}
+	p.sessions = nil
+	return nil
+}
+
+// Retire closes the pool to new streams like Close, but leaves the streams that are being
+// carried alone, each connection is closed once its streams ended.
+func (p *MuxPool) Retire() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, s := range p.sessions {
+		go closeWhenDrained(s)
+	}
+	p.sessions = nil
+}
+
+// closeWhenDrained closes s once it doesn't carry streams anymore.
+func closeWhenDrained(s *mux.Session) {
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for s.NumStreams() > 0 {
+		select {
+		case <-s.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+	_ = s.Close()
+}
+
+func (p *MuxPool) dial() (*mux.Session, error) {
+	logger.Infof("opening mux connection to %s", p.Endpoint)
+	conn, err := p.Tunnel.Dial(p.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	return mux.Client(ws.New(conn), mux.WithIdleTimeout(p.IdleTimeout)), nil
+}
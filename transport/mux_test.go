@@ -0,0 +1,155 @@
+package transport
+
+import (
+	"errors"
+	"github.com/bepass-org/bepass/dialer"
+	"github.com/bepass-org/bepass/mux"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newMuxPool returns a pool of size connections to a mux worker and the address of an echo server.
+func newMuxPool(t *testing.T, size int) (*MuxPool, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	worker := httptest.NewServer(&mux.Handler{})
+	t.Cleanup(worker.Close)
+
+	pool := &MuxPool{
+		Tunnel: &WSTunnel{
+			Dialer:              &dialer.Dialer{},
+			WorkerIPPortAddress: worker.Listener.Addr().String(),
+		},
+		Endpoint:    "ws://worker.example/mux?session=test",
+		Size:        size,
+		IdleTimeout: time.Minute,
+	}
+	t.Cleanup(func() { _ = pool.Close() })
+	return pool, ln.Addr().String()
+}
+
+func TestMuxPool(t *testing.T) {
+	pool, addr := newMuxPool(t, 2)
+
+	var streams []net.Conn
+	for i := 0; i < 4; i++ {
+		stream, err := pool.Open(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer stream.Close()
+		streams = append(streams, stream)
+	}
+	for _, stream := range streams {
+		_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+		if _, err := stream.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+			t.Errorf("Expected the echo of the destination, got %q, %v", buf, err)
+		}
+	}
+
+	pool.mu.Lock()
+	sessions := len(pool.sessions)
+	pool.mu.Unlock()
+	if sessions != 2 {
+		t.Errorf("Expected the streams to share 2 connections, got %d", sessions)
+	}
+}
+
+func TestMuxPoolConcurrent(t *testing.T) {
+	pool, addr := newMuxPool(t, 2)
+
+	// the first streams wait for the connections being opened instead of opening more
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			stream, err := pool.Open(addr)
+			if err != nil {
+				errs <- err
+				return
+			}
+			_ = stream.Close()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Errorf("Open failed: %v", err)
+	}
+
+	pool.mu.Lock()
+	sessions := len(pool.sessions)
+	pool.mu.Unlock()
+	if sessions < 1 || sessions > 2 {
+		t.Errorf("Expected 1 or 2 connections, got %d", sessions)
+	}
+
+	_ = pool.Close()
+	if _, err := pool.Open(addr); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected a closed pool to fail, got %v", err)
+	}
+}
+
+func TestMuxPoolRetire(t *testing.T) {
+	pool, addr := newMuxPool(t, 1)
+
+	stream, err := pool.Open(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	pool.mu.Lock()
+	session := pool.sessions[0]
+	pool.mu.Unlock()
+
+	pool.Retire()
+	if _, err := pool.Open(addr); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("Expected a retired pool to fail, got %v", err)
+	}
+
+	// the stream that is being carried keeps working
+	_ = stream.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := stream.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(stream, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the echo of the destination, got %q, %v", buf, err)
+	}
+	if session.IsClosed() {
+		t.Fatal("Expected the connection to stay open while it carries a stream")
+	}
+
+	_ = stream.Close()
+	select {
+	case <-session.Done():
+	case <-time.After(5 * time.Second):
+		t.Error("Expected the connection to be closed after its stream ended")
+	}
+}
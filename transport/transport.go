@@ -2,6 +2,7 @@
 package transport
 
 import (
+	"errors"
 	"fmt"
 	"github.com/bepass-org/bepass/bufferpool"
 	"github.com/bepass-org/bepass/dialer"
@@ -12,21 +13,10 @@ import (
 	"github.com/bepass-org/bepass/utils"
 	"io"
 	"net"
-	"strings"
+	"sync"
+	"sync/atomic"
 )
 
-// UDPBind represents a UDP binding configuration.
-type UDPBind struct {
-	Source        *net.UDPAddr
-	Destination   string
-	TCPTunnel     *ws.Adapter
-	TunnelStatus  bool
-	SocksWriter   io.Writer
-	SocksReq      *socks5.Request
-	AssociateBind *net.UDPConn
-	RecvChan      chan UDPPacket
-}
-
 // UDPConf represents UDP configuration.
 type UDPConf struct {
 	ReadTimeout     int
@@ -37,22 +27,25 @@ type UDPConf struct {
 // Transport represents the transport layer.
 type Transport struct {
 	WorkerAddress string
+	UserSession   string
 	BindAddress   string
 	Dialer        *dialer.Dialer
 	BufferPool    bufferpool.BufPool
 	UDPBind       string
 	Tunnel        *WSTunnel
-}
-
-// UDPPacket represents a UDP packet.
-type UDPPacket struct {
-	Channel uint16
-	Data    []byte
+	// Mux carries the tcp connections over multiplexed WebSocket connections if it's not nil
+	Mux *MuxPool
+	// UDPDatagrams sends the udp packets with their destination over one tunnel, instead of
+	// opening a tunnel for every destination
+	UDPDatagrams bool
 }
 
 // TunnelTCP handles tcp network traffic.
 func (t *Transport) TunnelTCP(w io.Writer, req *socks5.Request) error {
-	tunnelEndpoint, err := utils.WSEndpointHelper(t.WorkerAddress, req.RawDestAddr.String(), "tcp")
+	if t.Mux != nil {
+		return t.tunnelMux(w, req)
+	}
+	tunnelEndpoint, err := utils.WSEndpointHelper(t.WorkerAddress, req.RawDestAddr.String(), "tcp", t.UserSession)
 	if err != nil {
 		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
 			return err
@@ -75,23 +68,36 @@ func (t *Transport) TunnelTCP(w io.Writer, req *socks5.Request) error {
 		_ = conn.Close()
 	}()
 
-	if err != nil {
+	// flush ws stream to write
+	if _, err := conn.Write([]byte{}); err != nil {
 		return err
 	}
 
-	// flush ws stream to write
-	conn.Write([]byte{})
-
-	errCh := make(chan error)
+	errCh := make(chan error, 2)
 	go func() { errCh <- t.Copy(req.Reader, conn) }()
 	go func() { errCh <- t.Copy(conn, w) }()
-	// Wait
-	e := <-errCh
-	if e != nil {
-		// return from this function closes target (and conn).
-		return e
+	// returning closes conn, which ends the other copy
+	return <-errCh
+}
+
+// tunnelMux carries the connection as a stream of the multiplexed connections to the worker.
+func (t *Transport) tunnelMux(w io.Writer, req *socks5.Request) error {
+	stream, err := t.Mux.Open(req.RawDestAddr.String())
+	if err != nil {
+		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
+			return err
+		}
+		logger.Infof("Can not connect: %v\n", err)
+		return err
 	}
-	return nil
+	defer func() {
+		_ = stream.Close()
+	}()
+
+	errCh := make(chan error, 2)
+	go func() { errCh <- t.Copy(req.Reader, stream) }()
+	go func() { errCh <- t.Copy(stream, w) }()
+	return <-errCh
 }
 
 // Copy copies data from reader to writer.
@@ -102,10 +108,12 @@ func (t *Transport) Copy(reader io.Reader, writer io.Writer) error {
 	return err
 }
 
-// TunnelUDP tunnels UDP packets over WebSocket.
+// TunnelUDP tunnels UDP packets over WebSocket. Every destination of the associate gets its own
+// channel, or with UDPDatagrams one channel carries the packets of all destinations. Channels
+// that are idle are closed and opened again by the next packet. The associate lasts until the
+// client closes its tcp connection or a tunnel is lost.
 func (t *Transport) TunnelUDP(w io.Writer, req *socks5.Request) error {
 	udpAddr, _ := net.ResolveUDPAddr("udp", t.UDPBind+":0") // Use _ to indicate the error is intentionally ignored
-	// connect to remote server via ws
 	bindLn, err := net.ListenUDP("udp", udpAddr)
 	if err != nil {
 		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
@@ -113,70 +121,191 @@ func (t *Transport) TunnelUDP(w io.Writer, req *socks5.Request) error {
 		}
 		return fmt.Errorf("listen udp failed, %v", err)
 	}
+	defer bindLn.Close()
+
+	a := &udpAssociate{
+		transport: t,
+		channels:  make(map[string]*UDPChannel),
+		replies:   make(chan udpReply),
+		failed:    make(chan error, 1),
+		done:      make(chan struct{}),
+	}
+	defer a.close()
+	// the destination of the request is opened right away if the client gave one
+	if t.UDPDatagrams || req.RawDestAddr.Port != 0 {
+		if _, err := a.channel(req.RawDestAddr.String()); err != nil {
+			if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
+				return fmt.Errorf("failed to send reply, %v", err)
+			}
+			return fmt.Errorf("unable to open udp channel, %v", err)
+		}
+	}
+
 	logger.Infof("listening on %s udp for associate", bindLn.LocalAddr())
 	if err := socks5.SendReply(w, statute.RepSuccess, bindLn.LocalAddr()); err != nil {
 		logger.Errorf("failed to send reply: %v", err)
 		return err
 	}
 
-	tunnelEndpoint, err := utils.WSEndpointHelper(t.WorkerAddress, req.RawDestAddr.String(), "udp")
-	if err != nil {
-		if err := socks5.SendReply(w, statute.RepServerFailure, nil); err != nil {
-			return err
-		}
-		logger.Infof("Could not split host and port: %v\n", err)
-		return err
-	}
+	// the associate ends when the client closes its tcp connection
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		_, _ = io.Copy(io.Discard, req.Reader)
+	}()
 
-	bindWriteChannel := make(chan UDPPacket)
-	tunnelWriteChannel, channelIndex, err := t.Tunnel.PersistentDial(tunnelEndpoint, bindWriteChannel)
-	if err != nil {
-		logger.Errorf("Unable to get or create tunnel for udpBindWriteChannel %v\r\n", err)
-		return err
-	}
-	// make new Bind
-	udpBind := &UDPBind{
-		SocksWriter:   w,
-		SocksReq:      req,
-		AssociateBind: bindLn,
-		Destination:   req.RawDestAddr.String(),
-		RecvChan:      bindWriteChannel,
-	}
-	bufPool := t.BufferPool.Get()
-	defer t.BufferPool.Put(bufPool)
+	// the replies go to the address the client last sent from
+	var source atomic.Pointer[net.UDPAddr]
 	go func() {
+		bufPool := t.BufferPool.Get()
+		defer t.BufferPool.Put(bufPool)
 		for {
-			n, addr, err := udpBind.AssociateBind.ReadFromUDP(bufPool[:cap(bufPool)])
-			udpBind.Source = addr
+			n, addr, err := bindLn.ReadFromUDP(bufPool[:cap(bufPool)])
 			if err != nil {
-				if err == io.EOF {
-					break
-				}
-				if strings.Contains(err.Error(), "use of closed network connection") {
-					logger.Errorf("read data from bind listen address %s failed, %v", udpBind.AssociateBind.LocalAddr(), err)
-				}
-				break
+				return
 			}
 			pk, err := statute.ParseDatagram(bufPool[:n])
+			if err != nil || pk.Frag != 0 {
+				continue
+			}
+			source.Store(addr)
+			channel, err := a.channel(pk.DstAddr.String())
 			if err != nil {
+				logger.Errorf("unable to open udp channel to %s: %v", pk.DstAddr.String(), err)
 				continue
 			}
-			tunnelWriteChannel <- UDPPacket{
-				Channel: channelIndex,
-				Data:    pk.Data,
+			// datagrams are sent as they are, so the worker gets the destination of every packet
+			payload := pk.Data
+			if t.UDPDatagrams {
+				payload = bufPool[:n]
 			}
+			// a channel that was closed for being idle just now drops the packet
+			_ = channel.Write(payload)
 		}
 	}()
+
 	for {
-		datagram := <-udpBind.RecvChan
-		pkb, err := statute.NewDatagram(req.RawDestAddr.String(), datagram.Data)
-		if err != nil {
-			continue
-		}
-		proBuf := append(pkb.Header(), pkb.Data...)
-		_, err = udpBind.AssociateBind.WriteTo(proBuf, udpBind.Source)
-		if err != nil {
+		select {
+		case <-ended:
+			return nil
+		case err := <-a.failed:
 			return err
+		case reply := <-a.replies:
+			addr := source.Load()
+			if addr == nil {
+				continue
+			}
+			// the worker wraps the replies of datagrams with their source, others come from
+			// the destination of their channel
+			data := reply.data
+			if t.UDPDatagrams {
+				if _, err := statute.ParseDatagram(data); err != nil {
+					continue
+				}
+			} else {
+				pkb, err := statute.NewDatagram(reply.dest, data)
+				if err != nil {
+					continue
+				}
+				data = append(pkb.Header(), pkb.Data...)
+			}
+			if _, err := bindLn.WriteTo(data, addr); err != nil {
+				return err
+			}
 		}
 	}
 }
+
+// udpAssociate holds the udp channels of an associate, keyed by their destination. With
+// UDPDatagrams all destinations share one channel, which is kept under the key "".
+type udpAssociate struct {
+	transport *Transport
+	replies   chan udpReply
+	failed    chan error
+	done      chan struct{}
+
+	mu       sync.Mutex
+	channels map[string]*UDPChannel
+	closed   bool
+}
+
+// udpReply is a packet received from dest.
+type udpReply struct {
+	dest string
+	data []byte
+}
+
+// channel returns the channel of dest, it's opened if there isn't one.
+func (a *udpAssociate) channel(dest string) (*UDPChannel, error) {
+	t := a.transport
+	if t.UDPDatagrams {
+		dest = ""
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.closed {
+		return nil, ErrUDPChannelClosed
+	}
+	if c, ok := a.channels[dest]; ok {
+		return c, nil
+	}
+
+	var endpoint string
+	var err error
+	if t.UDPDatagrams {
+		endpoint, err = utils.UDPEndpointHelper(t.WorkerAddress, t.UserSession)
+	} else {
+		endpoint, err = utils.WSEndpointHelper(t.WorkerAddress, dest, "udp", t.UserSession)
+	}
+	if err != nil {
+		return nil, err
+	}
+	c, err := t.Tunnel.OpenUDP(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	a.channels[dest] = c
+	go a.relay(dest, c)
+	return c, nil
+}
+
+// relay passes the packets received on c to the associate until c is closed. An idle channel
+// is forgotten, any other failure ends the associate.
+func (a *udpAssociate) relay(dest string, c *UDPChannel) {
+	for {
+		select {
+		case data := <-c.Recv():
+			select {
+			case a.replies <- udpReply{dest: dest, data: data}:
+			case <-a.done:
+				return
+			}
+		case <-c.Done():
+			a.mu.Lock()
+			if a.channels[dest] == c {
+				delete(a.channels, dest)
+			}
+			a.mu.Unlock()
+			if err := c.Err(); !errors.Is(err, ErrUDPChannelIdle) && !errors.Is(err, ErrUDPChannelClosed) {
+				select {
+				case a.failed <- err:
+				default:
+				}
+			}
+			return
+		}
+	}
+}
+
+// close closes the channels of the associate.
+func (a *udpAssociate) close() {
+	a.mu.Lock()
+	a.closed = true
+	channels := a.channels
+	a.channels = nil
+	a.mu.Unlock()
+	close(a.done)
+	for _, c := range channels {
+		_ = c.Close()
+	}
+}
@@ -0,0 +1,258 @@
+package transport
+
+import (
+	"bytes"
+	"github.com/bepass-org/bepass/bufferpool"
+	"github.com/bepass-org/bepass/dialer"
+	"github.com/bepass-org/bepass/relay"
+	"github.com/bepass-org/bepass/socks5"
+	"github.com/bepass-org/bepass/socks5/statute"
+	"github.com/bepass-org/bepass/utils"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// relayWorker is a relay served over tls, it keeps the WebSocket connections so they can be dropped.
+type relayWorker struct {
+	*httptest.Server
+	conns sync.Map
+}
+
+// Kill stops the relay and drops its WebSocket connections, which httptest doesn't close.
+func (w *relayWorker) Kill() {
+	w.Close()
+	w.conns.Range(func(c, _ any) bool {
+		_ = c.(net.Conn).Close()
+		return true
+	})
+}
+
+// newRelayTransport returns a transport whose worker is a relay.
+func newRelayTransport(t *testing.T) (*Transport, *relayWorker) {
+	t.Helper()
+	worker := &relayWorker{Server: httptest.NewUnstartedServer(&relay.Server{Token: "test", AllowPrivate: true})}
+	worker.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateHijacked {
+			worker.conns.Store(c, nil)
+		}
+	}
+	worker.StartTLS()
+	t.Cleanup(worker.Kill)
+	return &Transport{
+		WorkerAddress: "https://relay.example/dns-query",
+		UserSession:   "test",
+		BufferPool:    bufferpool.NewPool(32 * 1024),
+		UDPBind:       "127.0.0.1",
+		Tunnel: &WSTunnel{
+			Dialer:              &dialer.Dialer{},
+			WorkerIPPortAddress: worker.Listener.Addr().String(),
+			ReadTimeout:         120,
+			WriteTimeout:        120,
+			LinkIdleTimeout:     120,
+			ShortClientID:       utils.ShortID(6),
+		},
+	}, worker
+}
+
+// echoUDP starts a udp server that echoes the packets it receives.
+func echoUDP(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteTo(buf[:n], addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func TestTunnelTCPThroughRelay(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	dest, err := statute.ParseAddrSpec(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, _ := newRelayTransport(t)
+
+	client, local := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer local.Close()
+		_ = tr.TunnelTCP(local, &socks5.Request{Reader: local, RawDestAddr: &dest})
+	}()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(client, buf); err != nil || string(buf) != "ping" {
+		t.Errorf("Expected the echo of the destination, got %q, %v", buf, err)
+	}
+}
+
+// associate starts an associate of tr to dest, it returns the tcp connection of the associate,
+// a udp socket connected to its bind address and the result of TunnelUDP.
+func associate(t *testing.T, tr *Transport, dest statute.AddrSpec) (net.Conn, *net.UDPConn, <-chan error) {
+	t.Helper()
+	client, local := net.Pipe()
+	t.Cleanup(func() { _ = client.Close() })
+	result := make(chan error, 1)
+	go func() {
+		defer local.Close()
+		result <- tr.TunnelUDP(local, &socks5.Request{Reader: local, RawDestAddr: &dest})
+	}()
+
+	// the associate reply tells where the datagrams are sent to
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := statute.ParseReply(client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.Response != statute.RepSuccess {
+		t.Fatalf("Expected a successful associate, got %d", reply.Response)
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: reply.BndAddr.IP, Port: reply.BndAddr.Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return client, conn, result
+}
+
+// roundTrip sends data to dest through the associate of conn and returns the reply.
+func roundTrip(t *testing.T, conn *net.UDPConn, dest string, data string) statute.Datagram {
+	t.Helper()
+	datagram, err := statute.NewDatagram(dest, []byte(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(datagram.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2048)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reply, err := statute.ParseDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return reply
+}
+
+func TestTunnelUDPThroughRelay(t *testing.T) {
+	dest, err := statute.ParseAddrSpec(echoUDP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, _ := newRelayTransport(t)
+
+	client, conn, result := associate(t, tr, dest)
+	if got := roundTrip(t, conn, dest.String(), "ping"); !bytes.Equal(got.Data, []byte("ping")) {
+		t.Errorf("Expected the echo of the destination, got %q", got.Data)
+	}
+
+	// closing the tcp connection ends the associate and frees its channel
+	_ = client.Close()
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Errorf("Expected the associate to end without an error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the associate to end with its tcp connection")
+	}
+	if n := numUDPTunnels(tr.Tunnel); n != 0 {
+		t.Errorf("Expected the tunnel to be closed with its last channel, got %d tunnels", n)
+	}
+}
+
+func TestTunnelUDPDestinationsThroughRelay(t *testing.T) {
+	// clients usually don't know the destinations when they associate
+	unspecified, err := statute.ParseAddrSpec("0.0.0.0:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, datagrams := range []bool{false, true} {
+		tr, _ := newRelayTransport(t)
+		tr.UDPDatagrams = datagrams
+
+		_, conn, _ := associate(t, tr, unspecified)
+		dests := []string{echoUDP(t), echoUDP(t), echoUDP(t)}
+		for _, dest := range dests {
+			got := roundTrip(t, conn, dest, "ping")
+			if !bytes.Equal(got.Data, []byte("ping")) {
+				t.Errorf("Expected the echo of %s, got %q", dest, got.Data)
+			}
+			if got.DstAddr.String() != dest {
+				t.Errorf("Expected the reply to come from %s, got %s", dest, got.DstAddr.String())
+			}
+		}
+		// without datagrams every destination has its own tunnel
+		want := len(dests)
+		if datagrams {
+			want = 1
+		}
+		if n := numUDPTunnels(tr.Tunnel); n != want {
+			t.Errorf("Expected %d tunnels with datagrams %v, got %d", want, datagrams, n)
+		}
+	}
+}
+
+func TestTunnelUDPIdleThroughRelay(t *testing.T) {
+	dest, err := statute.ParseAddrSpec(echoUDP(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr, _ := newRelayTransport(t)
+	tr.Tunnel.LinkIdleTimeout = 1
+
+	_, conn, result := associate(t, tr, dest)
+	roundTrip(t, conn, dest.String(), "ping")
+
+	// the idle channel is closed, the next packet opens it again
+	time.Sleep(1600 * time.Millisecond)
+	if n := numUDPTunnels(tr.Tunnel); n != 0 {
+		t.Errorf("Expected the idle tunnel to be closed, got %d tunnels", n)
+	}
+	if got := roundTrip(t, conn, dest.String(), "pong"); !bytes.Equal(got.Data, []byte("pong")) {
+		t.Errorf("Expected the echo of the destination, got %q", got.Data)
+	}
+	select {
+	case err := <-result:
+		t.Errorf("Expected the associate to outlive its idle channel, it ended with %v", err)
+	default:
+	}
+}
@@ -0,0 +1,358 @@
+package transport
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/bepass/logger"
+	"math"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// udpRecvBuffer is the number of received packets a channel holds, more are dropped
+	udpRecvBuffer = 64
+	// udpSendBuffer is the number of packets a tunnel holds while it's reconnecting
+	udpSendBuffer = 64
+	// udpDialAttempts is how often a lost tunnel is dialed again before its channels are closed
+	udpDialAttempts = 3
+	// udpRedialDelay is the pause between the dial attempts of a tunnel
+	udpRedialDelay = 200 * time.Millisecond
+)
+
+var (
+	// ErrUDPChannelClosed is the error of a channel that was closed by its associate
+	ErrUDPChannelClosed = errors.New("udp channel closed")
+	// ErrUDPChannelIdle is the error of a channel that was closed for being idle
+	ErrUDPChannelIdle = errors.New("udp channel idle")
+	// errNoFreeChannel is returned when all channel ids of a tunnel are in use
+	errNoFreeChannel = errors.New("no free udp channel")
+)
+
+// udpTunnel carries the udp packets of its channels to one destination over a WebSocket
+// connection to the worker. Each packet is prefixed with the client id and the channel id,
+// the replies come back prefixed with the channel id alone.
+type udpTunnel struct {
+	ws       *WSTunnel
+	endpoint string
+	send     chan []byte
+
+	mu       sync.Mutex
+	channels map[uint16]*UDPChannel
+	next     uint16 // the id that's tried first for the next channel
+
+	die chan struct{}
+}
+
+// UDPChannel is the binding of an associate to a udp tunnel.
+type UDPChannel struct {
+	id     uint16
+	tunnel *udpTunnel
+	recv   chan []byte
+
+	lastActivity atomic.Int64
+	done         chan struct{}
+	once         sync.Once
+	err          error
+}
+
+// OpenUDP opens a channel on the udp tunnel of endpoint, the tunnel is dialed if it isn't
+// open yet. Tunnels are closed when their last channel is closed.
+func (w *WSTunnel) OpenUDP(endpoint string) (*UDPChannel, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.udpTunnels == nil {
+		w.udpTunnels = make(map[string]*udpTunnel)
+	}
+	t, ok := w.udpTunnels[endpoint]
+	if !ok {
+		t = newUDPTunnel(w, endpoint)
+		w.udpTunnels[endpoint] = t
+		go t.run()
+		if idle := w.linkIdleTimeout(); idle > 0 {
+			go t.expire(idle)
+		}
+	}
+	return t.add()
+}
+
+func (w *WSTunnel) linkIdleTimeout() time.Duration {
+	return time.Duration(w.LinkIdleTimeout) * time.Second
+}
+
+func newUDPTunnel(w *WSTunnel, endpoint string) *udpTunnel {
+	return &udpTunnel{
+		ws:       w,
+		endpoint: endpoint,
+		send:     make(chan []byte, udpSendBuffer),
+		channels: make(map[uint16]*UDPChannel),
+		next:     1,
+		die:      make(chan struct{}),
+	}
+}
+
+// add allocates the first free channel id from t.next on, 0 isn't used.
+func (t *udpTunnel) add() (*UDPChannel, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.isClosed() {
+		return nil, fmt.Errorf("udp tunnel to %s is closed", t.endpoint)
+	}
+	if len(t.channels) == math.MaxUint16 {
+		return nil, errNoFreeChannel
+	}
+	id := t.next
+	for id == 0 || t.channels[id] != nil {
+		id++
+	}
+	t.next = id + 1
+	c := &UDPChannel{
+		id:     id,
+		tunnel: t,
+		recv:   make(chan []byte, udpRecvBuffer),
+		done:   make(chan struct{}),
+	}
+	c.touch()
+	t.channels[id] = c
+	return c, nil
+}
+
+// remove frees the id of c, the tunnel is closed with its last channel.
+func (t *udpTunnel) remove(c *UDPChannel) {
+	t.mu.Lock()
+	if t.channels[c.id] == c {
+		delete(t.channels, c.id)
+	}
+	empty := len(t.channels) == 0
+	t.mu.Unlock()
+	if empty {
+		t.shutdown(nil, true)
+	}
+}
+
+func (t *udpTunnel) channel(id uint16) *UDPChannel {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.channels[id]
+}
+
+func (t *udpTunnel) isClosed() bool {
+	select {
+	case <-t.die:
+		return true
+	default:
+		return false
+	}
+}
+
+// close closes the tunnel, its channels are closed with err.
+func (t *udpTunnel) close(err error) {
+	t.shutdown(err, false)
+}
+
+// shutdown closes the tunnel and forgets it, so the next channel to its endpoint dials a new
+// one. With onlyEmpty it's kept if OpenUDP added a channel after the last one was removed.
+func (t *udpTunnel) shutdown(err error, onlyEmpty bool) {
+	t.ws.mu.Lock()
+	t.mu.Lock()
+	if t.isClosed() || (onlyEmpty && len(t.channels) > 0) {
+		t.mu.Unlock()
+		t.ws.mu.Unlock()
+		return
+	}
+	if t.ws.udpTunnels[t.endpoint] == t {
+		delete(t.ws.udpTunnels, t.endpoint)
+	}
+	close(t.die)
+	channels := t.channels
+	t.channels = make(map[uint16]*UDPChannel)
+	t.mu.Unlock()
+	t.ws.mu.Unlock()
+
+	for _, c := range channels {
+		c.closeWith(err)
+	}
+}
+
+// run keeps the tunnel connected until it's closed, it gives up when the worker can't
+// be reached udpDialAttempts times in a row.
+func (t *udpTunnel) run() {
+	for {
+		var conn *websocket.Conn
+		var err error
+		for attempt := 0; attempt < udpDialAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-t.die:
+					return
+				case <-time.After(udpRedialDelay):
+				}
+			}
+			logger.Infof("connecting to %s", t.endpoint)
+			if conn, err = t.ws.Dial(t.endpoint); err == nil {
+				break
+			}
+			logger.Errorf("error dialing udp over tcp tunnel: %v", err)
+		}
+		if err != nil {
+			t.close(fmt.Errorf("udp tunnel to %s lost: %w", t.endpoint, err))
+			return
+		}
+		t.serve(conn)
+		if t.isClosed() {
+			return
+		}
+	}
+}
+
+// serve relays the packets of the channels over conn until it fails or the tunnel is closed.
+func (t *udpTunnel) serve(conn *websocket.Conn) {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer conn.Close()
+		for {
+			select {
+			case <-done:
+				return
+			case <-t.die:
+				return
+			case frame := <-t.send:
+				if err := conn.SetWriteDeadline(timeoutDeadline(t.ws.WriteTimeout)); err != nil {
+					return
+				}
+				if err := conn.WriteMessage(websocket.BinaryMessage, frame); err != nil {
+					logger.Errorf("writing to udp over tcp tunnel: %v", err)
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		if err := conn.SetReadDeadline(timeoutDeadline(t.ws.ReadTimeout)); err != nil {
+			return
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			if !t.isClosed() {
+				logger.Errorf("reading from udp over tcp tunnel: %v", err)
+			}
+			_ = conn.Close()
+			return
+		}
+		// the first 2 bytes of a reply are the channel id
+		if len(msg) < 2 {
+			continue
+		}
+		if c := t.channel(binary.BigEndian.Uint16(msg[:2])); c != nil {
+			c.deliver(msg[2:])
+		}
+	}
+}
+
+// timeoutDeadline returns the deadline of a timeout in seconds, 0 means no deadline.
+func timeoutDeadline(seconds int) time.Time {
+	if seconds <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(time.Duration(seconds) * time.Second)
+}
+
+// expire closes the channels that had no packets for idle.
+func (t *udpTunnel) expire(idle time.Duration) {
+	ticker := time.NewTicker(idle / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.die:
+			return
+		case <-ticker.C:
+			var expired []*UDPChannel
+			t.mu.Lock()
+			for _, c := range t.channels {
+				if time.Since(time.Unix(0, c.lastActivity.Load())) >= idle {
+					expired = append(expired, c)
+				}
+			}
+			t.mu.Unlock()
+			for _, c := range expired {
+				c.closeWith(ErrUDPChannelIdle)
+			}
+		}
+	}
+}
+
+// ID returns the id of the channel in its tunnel.
+func (c *UDPChannel) ID() uint16 {
+	return c.id
+}
+
+// Write queues a packet for the destination of the tunnel, it waits while the queue is full.
+func (c *UDPChannel) Write(data []byte) error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+	}
+	clientID := c.tunnel.ws.ShortClientID
+	frame := make([]byte, len(clientID)+2+len(data))
+	n := copy(frame, clientID)
+	binary.BigEndian.PutUint16(frame[n:], c.id)
+	copy(frame[n+2:], data)
+
+	select {
+	case <-c.done:
+		return c.err
+	case c.tunnel.send <- frame:
+		c.touch()
+		return nil
+	}
+}
+
+// Recv returns the packets received from the destination.
+func (c *UDPChannel) Recv() <-chan []byte {
+	return c.recv
+}
+
+// Done returns a channel that's closed when the channel is closed.
+func (c *UDPChannel) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns why the channel was closed, after Done is closed.
+func (c *UDPChannel) Err() error {
+	return c.err
+}
+
+// Close closes the channel and frees its id.
+func (c *UDPChannel) Close() error {
+	c.closeWith(ErrUDPChannelClosed)
+	return nil
+}
+
+// closeWith closes the channel with err and frees its id.
+func (c *UDPChannel) closeWith(err error) {
+	c.once.Do(func() {
+		c.err = err
+		close(c.done)
+		c.tunnel.remove(c)
+	})
+}
+
+// deliver queues a received packet, it's dropped if the associate doesn't keep up.
+func (c *UDPChannel) deliver(data []byte) {
+	c.touch()
+	select {
+	case c.recv <- data:
+	default:
+	}
+}
+
+func (c *UDPChannel) touch() {
+	c.lastActivity.Store(time.Now().UnixNano())
+}
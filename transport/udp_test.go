@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bepass-org/bepass/utils"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// numUDPTunnels returns the number of open udp tunnels of w.
+func numUDPTunnels(w *WSTunnel) int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.udpTunnels)
+}
+
+// exchange sends data on c and waits for its echo.
+func exchange(c *UDPChannel, data string) error {
+	if err := c.Write([]byte(data)); err != nil {
+		return err
+	}
+	select {
+	case got := <-c.Recv():
+		if string(got) != data {
+			return fmt.Errorf("Expected %q, got %q", data, got)
+		}
+		return nil
+	case <-c.Done():
+		return c.Err()
+	case <-time.After(5 * time.Second):
+		return errors.New("Expected an echo, got nothing")
+	}
+}
+
+func TestUDPChannelIDs(t *testing.T) {
+	tunnel := newUDPTunnel(&WSTunnel{}, "wss://worker.example/connect")
+	var channels []*UDPChannel
+	for i := 0; i < 3; i++ {
+		c, err := tunnel.add()
+		if err != nil {
+			t.Fatal(err)
+		}
+		channels = append(channels, c)
+	}
+	for i, c := range channels {
+		if c.ID() != uint16(i+1) {
+			t.Errorf("Expected channel %d, got %d", i+1, c.ID())
+		}
+	}
+
+	// freed ids are used again after the ids wrap around, 0 and the ids in use are skipped
+	_ = channels[0].Close()
+	tunnel.mu.Lock()
+	tunnel.next = math.MaxUint16
+	tunnel.mu.Unlock()
+	for _, want := range []uint16{math.MaxUint16, 1, 4} {
+		c, err := tunnel.add()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.ID() != want {
+			t.Errorf("Expected channel %d, got %d", want, c.ID())
+		}
+	}
+	if tunnel.isClosed() {
+		t.Error("Expected a tunnel with channels to stay open")
+	}
+}
+
+func TestUDPChannelsConcurrent(t *testing.T) {
+	tr, _ := newRelayTransport(t)
+	endpoint, err := utils.WSEndpointHelper(tr.WorkerAddress, echoUDP(t), "udp", tr.UserSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the associates share the tunnel and only get the replies of their own channel
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c, err := tr.Tunnel.OpenUDP(endpoint)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer c.Close()
+			for j := 0; j < 10; j++ {
+				if err := exchange(c, fmt.Sprintf("packet %d of %d", j, i)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if n := numUDPTunnels(tr.Tunnel); n != 0 {
+		t.Errorf("Expected the tunnel to be closed with its last channel, got %d tunnels", n)
+	}
+}
+
+func TestUDPChannelIdle(t *testing.T) {
+	tr, _ := newRelayTransport(t)
+	tr.Tunnel.LinkIdleTimeout = 1
+	endpoint, err := utils.WSEndpointHelper(tr.WorkerAddress, echoUDP(t), "udp", tr.UserSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tr.Tunnel.OpenUDP(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exchange(c, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-c.Done():
+		if !errors.Is(c.Err(), ErrUDPChannelIdle) {
+			t.Errorf("Expected an idle channel error, got %v", c.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the idle channel to be closed")
+	}
+	if n := numUDPTunnels(tr.Tunnel); n != 0 {
+		t.Errorf("Expected the tunnel to be closed with its last channel, got %d tunnels", n)
+	}
+}
+
+func TestUDPTunnelLost(t *testing.T) {
+	tr, worker := newRelayTransport(t)
+	endpoint, err := utils.WSEndpointHelper(tr.WorkerAddress, echoUDP(t), "udp", tr.UserSession)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := tr.Tunnel.OpenUDP(endpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := exchange(c, "ping"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the channels learn that the worker is gone once it can't be dialed again
+	worker.Kill()
+	select {
+	case <-c.Done():
+		if err := c.Err(); err == nil || !strings.Contains(err.Error(), "lost") {
+			t.Errorf("Expected a lost tunnel error, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the channel to be closed with its tunnel")
+	}
+	if err := c.Write([]byte("ping")); err == nil {
+		t.Error("Expected writing to a closed channel to fail")
+	}
+}
@@ -0,0 +1,112 @@
+package tune
+
+import (
+	"fmt"
+	"github.com/bepass-org/bepass/net/adapter/fragment"
+	"strings"
+)
+
+// wholeRange is a fragment size range that sends a part of the client hello in one fragment
+var wholeRange = [2]int{2000, 2000}
+
+// delays are the ranges of milliseconds between fragments that are tried
+var delays = [][2]int{{0, 0}, {5, 10}, {10, 20}, {50, 100}}
+
+// DefaultCandidates returns the fragmentation settings that are tried by default: the sni
+// strategy with several sni fragment sizes, fixed chunks, splits at an offset and inside
+// the record header, and the disorder strategy, each of them with several delays.
+func DefaultCandidates() []fragment.Config {
+	var candidates []fragment.Config
+	for _, delay := range delays {
+		for _, sl := range [][2]int{{1, 1}, {1, 3}, {2, 5}, {5, 10}} {
+			candidates = append(candidates, fragment.Config{
+				Strategy: fragment.StrategySNI,
+				BSL:      wholeRange,
+				SL:       sl,
+				ASL:      wholeRange,
+				Delay:    delay,
+			})
+		}
+		for _, length := range [][2]int{{1, 5}, {5, 20}, {20, 50}} {
+			candidates = append(candidates, fragment.Config{
+				Strategy:    fragment.StrategyChunk,
+				ChunkLength: length,
+				Delay:       delay,
+			})
+		}
+		candidates = append(candidates,
+			fragment.Config{Strategy: fragment.StrategyOffset, Offset: 50, Delay: delay},
+			fragment.Config{Strategy: fragment.StrategyHeader, Offset: 1, Delay: delay},
+			fragment.Config{Strategy: fragment.StrategyDisorder, BSL: wholeRange, SL: [2]int{1, 3}, ASL: wholeRange, Delay: delay},
+		)
+	}
+	return candidates
+}
+
+// FilterStrategies returns the candidates that use one of the strategies.
+func FilterStrategies(candidates []fragment.Config, strategies []string) []fragment.Config {
+	var filtered []fragment.Config
+	for _, c := range candidates {
+		for _, s := range strategies {
+			if strategyOf(c) == s {
+				filtered = append(filtered, c)
+				break
+			}
+		}
+	}
+	return filtered
+}
+
+// Settings returns the config fields that make the server fragment like c,
+// as they're written to a profile.
+func Settings(c fragment.Config) map[string]interface{} {
+	settings := map[string]interface{}{
+		"FragmentStrategy":       strategyOf(c),
+		"DelayBetweenChunks":     c.Delay,
+		"TLSRecordFragmentation": c.RecordSplit,
+	}
+	switch strategyOf(c) {
+	case fragment.StrategySNI, fragment.StrategyDisorder:
+		settings["ChunksLengthBeforeSni"] = c.BSL
+		settings["SniChunksLength"] = c.SL
+		settings["ChunksLengthAfterSni"] = c.ASL
+	case fragment.StrategyChunk:
+		settings["FragmentChunksLength"] = c.ChunkLength
+	case fragment.StrategyOffset, fragment.StrategyHeader:
+		settings["FragmentOffset"] = c.Offset
+	}
+	if c.RecordSplit {
+		settings["TLSHeaderLength"] = c.HeaderLength
+	}
+	return settings
+}
+
+// Describe returns a short description of c for the output of the tuner.
+func Describe(c fragment.Config) string {
+	var b strings.Builder
+	b.WriteString(strategyOf(c))
+	switch strategyOf(c) {
+	case fragment.StrategySNI, fragment.StrategyDisorder:
+		fmt.Fprintf(&b, " before=%s sni=%s after=%s", formatRange(c.BSL), formatRange(c.SL), formatRange(c.ASL))
+	case fragment.StrategyChunk:
+		fmt.Fprintf(&b, " length=%s", formatRange(c.ChunkLength))
+	case fragment.StrategyOffset, fragment.StrategyHeader:
+		fmt.Fprintf(&b, " offset=%d", c.Offset)
+	}
+	if c.RecordSplit {
+		b.WriteString(" records")
+	}
+	fmt.Fprintf(&b, " delay=%sms", formatRange(c.Delay))
+	return b.String()
+}
+
+func strategyOf(c fragment.Config) string {
+	if c.Strategy == "" {
+		return fragment.StrategySNI
+	}
+	return c.Strategy
+}
+
+func formatRange(r [2]int) string {
+	return fmt.Sprintf("%d-%d", r[0], r[1])
+}
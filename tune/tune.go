@@ -0,0 +1,226 @@
+// Package tune searches for fragmentation settings that get tls handshakes through a DPI
+// middlebox. Every candidate setting is tried with handshakes to a list of test domains, the
+// candidates are ranked by how many handshakes completed and how fast they were.
+package tune
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/bepass-org/bepass/dialer"
+	"github.com/bepass-org/bepass/net/adapter/fragment"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultPort is the port of the test domains that have no address
+const defaultPort = "443"
+
+// Target is a domain that handshakes are tried with.
+type Target struct {
+	Domain  string // Server name of the handshakes
+	Address string // ip:port to connect to, the domain on port 443 if it's empty
+}
+
+// ParseTarget parses a target written as domain or domain=ip:port.
+func ParseTarget(s string) (Target, error) {
+	domain, address, _ := strings.Cut(s, "=")
+	if domain == "" {
+		return Target{}, fmt.Errorf("invalid target %q: missing domain", s)
+	}
+	if address != "" {
+		if _, _, err := net.SplitHostPort(address); err != nil {
+			return Target{}, fmt.Errorf("invalid target %q: %w", s, err)
+		}
+	}
+	return Target{Domain: domain, Address: address}, nil
+}
+
+func (t Target) address() string {
+	if t.Address != "" {
+		return t.Address
+	}
+	return net.JoinHostPort(t.Domain, defaultPort)
+}
+
+// Result is how a candidate did.
+type Result struct {
+	Fragment  fragment.Config
+	Succeeded int
+	Failed    int
+	Latency   time.Duration // Mean duration of the completed handshakes
+	Err       error         // Last error of the failed handshakes
+}
+
+// Options represents options for the tuner.
+type Options struct {
+	Candidates  []fragment.Config // Fragmentation settings that are tried
+	Dialer      dialer.Dialer     // Dials the connections, its Fragment is set to each candidate
+	Timeout     time.Duration     // Timeout of a handshake
+	Attempts    int               // Handshakes per candidate and target
+	Concurrency int               // Candidates that are tried at the same time
+	Progress    func(Result)      // Called with the result of each candidate
+}
+
+// Option is a function type used for setting tuner options.
+type Option func(*Options)
+
+// WithCandidates sets the fragmentation settings that are tried, see DefaultCandidates.
+func WithCandidates(candidates []fragment.Config) Option {
+	return func(o *Options) {
+		o.Candidates = candidates
+	}
+}
+
+// WithDialer sets the dialer whose settings, like low level sockets or tls padding, are used.
+func WithDialer(d dialer.Dialer) Option {
+	return func(o *Options) {
+		o.Dialer = d
+	}
+}
+
+// WithTimeout sets the timeout of a handshake, it's 5 seconds by default.
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		if d > 0 {
+			o.Timeout = d
+		}
+	}
+}
+
+// WithAttempts sets the number of handshakes per candidate and target, it's 1 by default.
+func WithAttempts(n int) Option {
+	return func(o *Options) {
+		if n > 0 {
+			o.Attempts = n
+		}
+	}
+}
+
+// WithConcurrency sets the number of candidates that are tried at the same time, it's 4 by default.
+func WithConcurrency(n int) Option {
+	return func(o *Options) {
+		if n > 0 {
+			o.Concurrency = n
+		}
+	}
+}
+
+// WithProgress sets a function that's called with the result of each candidate when it's done.
+func WithProgress(f func(Result)) Option {
+	return func(o *Options) {
+		o.Progress = f
+	}
+}
+
+// Run tries the candidates with the targets and returns their results, the best first.
+// If ctx is done, the results of the candidates that were tried so far are returned with its error.
+func Run(ctx context.Context, targets []Target, opts ...Option) ([]Result, error) {
+	o := &Options{Timeout: 5 * time.Second, Attempts: 1, Concurrency: 4}
+	for _, f := range opts {
+		f(o)
+	}
+	if len(targets) == 0 {
+		return nil, errors.New("no target to tune with")
+	}
+	candidates := o.Candidates
+	if candidates == nil {
+		candidates = DefaultCandidates()
+	}
+
+	results := make([]Result, len(candidates))
+	done := make([]bool, len(candidates))
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, o.Concurrency)
+loop:
+	for i := range candidates {
+		select {
+		case <-ctx.Done():
+			break loop
+		case sem <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			r := o.try(ctx, candidates[i], targets)
+			mu.Lock()
+			results[i], done[i] = r, true
+			if o.Progress != nil {
+				o.Progress(r)
+			}
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	var tried []Result
+	for i, r := range results {
+		if done[i] {
+			tried = append(tried, r)
+		}
+	}
+	// the most handshakes first, then the fastest, candidates are kept in order otherwise
+	sort.SliceStable(tried, func(i, j int) bool {
+		if tried[i].Succeeded != tried[j].Succeeded {
+			return tried[i].Succeeded > tried[j].Succeeded
+		}
+		return tried[i].Succeeded > 0 && tried[i].Latency < tried[j].Latency
+	})
+	return tried, ctx.Err()
+}
+
+// try does the handshakes of a candidate with all targets.
+func (o *Options) try(ctx context.Context, c fragment.Config, targets []Target) Result {
+	r := Result{Fragment: c}
+	var total time.Duration
+	for _, t := range targets {
+		for n := 0; n < o.Attempts && ctx.Err() == nil; n++ {
+			d, err := o.handshake(c, t)
+			if err != nil {
+				r.Failed++
+				r.Err = fmt.Errorf("%s: %w", t.Domain, err)
+				continue
+			}
+			r.Succeeded++
+			total += d
+		}
+	}
+	if r.Succeeded > 0 {
+		r.Latency = total / time.Duration(r.Succeeded)
+	}
+	return r
+}
+
+// handshake does a tls handshake with the target through a connection fragmented like c
+// and returns how long it took.
+func (o *Options) handshake(c fragment.Config, t Target) (time.Duration, error) {
+	d := o.Dialer
+	d.Fragment = c
+	deadline := time.Now().Add(o.Timeout)
+	// the server name is the domain, the connection goes to the address of the target
+	plainDial := func(network, _ string) (net.Conn, error) {
+		conn, err := d.FragmentDial(network, t.address())
+		if err != nil {
+			return nil, err
+		}
+		if err := conn.SetDeadline(deadline); err != nil {
+			_ = conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+
+	begin := time.Now()
+	conn, err := d.TLSDial(plainDial, "tcp", net.JoinHostPort(t.Domain, defaultPort))
+	if err != nil {
+		return 0, err
+	}
+	elapsed := time.Since(begin)
+	_ = conn.Close()
+	return elapsed, nil
+}
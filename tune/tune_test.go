@@ -0,0 +1,78 @@
+package tune
+
+import (
+	"context"
+	"github.com/bepass-org/bepass/net/adapter/fragment"
+	"github.com/bepass-org/bepass/net/dpitest"
+	"testing"
+	"time"
+)
+
+const blockedDomain = "blocked.example"
+
+func TestRun(t *testing.T) {
+	server, err := dpitest.NewTLSServer(blockedDomain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	m, err := dpitest.New(server.Addr(), dpitest.WithBlocked(blockedDomain))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	target := Target{Domain: blockedDomain, Address: m.Addr()}
+	whole := fragment.Config{Strategy: fragment.StrategyChunk, ChunkLength: [2]int{5000, 5000}}
+	slow := fragment.Config{Strategy: fragment.StrategySNI, BSL: wholeRange, SL: [2]int{1, 1}, ASL: wholeRange, Delay: [2]int{50, 50}}
+	fast := slow
+	fast.Delay = [2]int{5, 5}
+
+	var progress int
+	results, err := Run(context.Background(), []Target{target},
+		WithCandidates([]fragment.Config{whole, slow, fast}),
+		WithAttempts(2),
+		WithTimeout(5*time.Second),
+		WithProgress(func(Result) { progress++ }),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 3 || progress != 3 {
+		t.Fatalf("Expected 3 results and progress reports, got %d and %d", len(results), progress)
+	}
+	if results[0].Fragment != fast || results[0].Succeeded != 2 {
+		t.Errorf("Expected %s to be the best with 2 handshakes, got %s with %d: %v",
+			Describe(fast), Describe(results[0].Fragment), results[0].Succeeded, results[0].Err)
+	}
+	if results[1].Fragment != slow || results[1].Succeeded != 2 || results[1].Latency <= results[0].Latency {
+		t.Errorf("Expected %s to be second and slower, got %+v", Describe(slow), results[1])
+	}
+	if results[2].Fragment != whole || results[2].Succeeded != 0 || results[2].Failed != 2 || results[2].Err == nil {
+		t.Errorf("Expected the unfragmented hello to be blocked, got %+v", results[2])
+	}
+}
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Target
+		address string
+		wantErr bool
+	}{
+		{in: "example.com", want: Target{Domain: "example.com"}, address: "example.com:443"},
+		{in: "example.com=1.2.3.4:8443", want: Target{Domain: "example.com", Address: "1.2.3.4:8443"}, address: "1.2.3.4:8443"},
+		{in: "example.com=1.2.3.4", wantErr: true},
+		{in: "=1.2.3.4:443", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseTarget(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseTarget(%q) error = %v, wantErr %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (got != tt.want || got.address() != tt.address) {
+			t.Errorf("ParseTarget(%q) = %+v, want %+v dialing %s", tt.in, got, tt.want, tt.address)
+		}
+	}
+}
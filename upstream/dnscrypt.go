@@ -0,0 +1,49 @@
+package upstream
+
+import (
+	"sync"
+
+	"github.com/ameshkov/dnscrypt/v2"
+	"github.com/miekg/dns"
+)
+
+// dnscryptUpstream sends queries with DNSCrypt, the address is a DNS stamp.
+type dnscryptUpstream struct {
+	address string
+	opt     *Options
+
+	mu           sync.Mutex
+	resolverInfo *dnscrypt.ResolverInfo
+}
+
+func (u *dnscryptUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	c := &dnscrypt.Client{
+		Net: "tcp", Timeout: u.opt.Timeout,
+	}
+
+	u.mu.Lock()
+	resolverInfo := u.resolverInfo
+	u.mu.Unlock()
+	if resolverInfo == nil {
+		var err error
+		resolverInfo, err = c.Dial(u.address)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := c.Exchange(req, resolverInfo)
+	u.mu.Lock()
+	if err != nil {
+		// the certificate may have been rotated, fetch it again on the next query
+		u.resolverInfo = nil
+	} else {
+		u.resolverInfo = resolverInfo
+	}
+	u.mu.Unlock()
+	return resp, err
+}
+
+func (u *dnscryptUpstream) Address() string {
+	return u.address
+}
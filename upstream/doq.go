@@ -0,0 +1,130 @@
+package upstream
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// doqALPN is the application protocol of DNS-over-QUIC
+const doqALPN = "doq"
+
+// doqUpstream sends queries over QUIC (RFC 9250), every query is sent on a new stream
+// of a shared connection. QUIC runs over udp, so the tcp fragmentation and uTLS fingerprints
+// of the dialer don't apply, the handshake is done by quic-go.
+type doqUpstream struct {
+	address string
+	host    string
+	port    string
+	opt     *Options
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func (u *doqUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, err := u.connection()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.exchange(conn, req)
+	if err != nil {
+		// the connection may be broken or closed by the server, the next query makes a new one
+		u.mu.Lock()
+		if u.conn == conn {
+			u.conn = nil
+		}
+		u.mu.Unlock()
+		_ = conn.CloseWithError(0, "")
+		return nil, err
+	}
+	return resp, nil
+}
+
+func (u *doqUpstream) exchange(conn quic.Connection, req *dns.Msg) (*dns.Msg, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), u.opt.Timeout)
+	defer cancel()
+
+	// the message id must be zero on DoQ
+	q := req.Copy()
+	q.Id = 0
+	buf, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = stream.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2+len(buf))
+	binary.BigEndian.PutUint16(msg, uint16(len(buf)))
+	copy(msg[2:], buf)
+	if _, err := stream.Write(msg); err != nil {
+		stream.CancelRead(0)
+		return nil, err
+	}
+	// the client closes its side of the stream after the query
+	_ = stream.Close()
+
+	var length uint16
+	if err := binary.Read(stream, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	respBuf := make([]byte, length)
+	if _, err := io.ReadFull(stream, respBuf); err != nil {
+		return nil, err
+	}
+
+	resp := new(dns.Msg)
+	if err := resp.Unpack(respBuf); err != nil {
+		return nil, err
+	}
+	resp.Id = req.Id
+	return resp, nil
+}
+
+// connection returns the shared connection, it's made if there is none.
+func (u *doqUpstream) connection() (quic.Connection, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.conn != nil {
+		select {
+		case <-u.conn.Context().Done():
+		default:
+			return u.conn, nil
+		}
+	}
+
+	addr, err := u.opt.bootstrap(u.host, u.port)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), u.opt.Timeout)
+	defer cancel()
+	conn, err := quic.DialAddr(ctx, addr, &tls.Config{
+		ServerName: u.host,
+		NextProtos: []string{doqALPN},
+		// certificates aren't verified, like on the DoH and DoT connections of the dialer
+		InsecureSkipVerify: true,
+	}, nil)
+	if err != nil {
+		return nil, fmt.Errorf("doq dial %s: %w", addr, err)
+	}
+	u.conn = conn
+	return conn, nil
+}
+
+func (u *doqUpstream) Address() string {
+	return u.address
+}
@@ -0,0 +1,104 @@
+package upstream
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// dotUpstream sends queries over TLS (RFC 7858). Connections are made with the uTLS dialer
+// of bepass, optionally with a fragmented client hello, and an idle one is reused.
+type dotUpstream struct {
+	address string
+	host    string
+	port    string
+	opt     *Options
+
+	mu   sync.Mutex
+	idle *dns.Conn
+}
+
+func (u *dotUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	conn, reused, err := u.conn()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := u.exchange(conn, req)
+	if err != nil && reused {
+		// the server may have closed the idle connection, try once more on a new one
+		if conn, err = u.dial(); err != nil {
+			return nil, err
+		}
+		resp, err = u.exchange(conn, req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.release(conn)
+	return resp, nil
+}
+
+func (u *dotUpstream) exchange(conn *dns.Conn, req *dns.Msg) (*dns.Msg, error) {
+	_ = conn.SetDeadline(time.Now().Add(u.opt.Timeout))
+	if err := conn.WriteMsg(req); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	resp, err := conn.ReadMsg()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// conn returns the idle connection, or a new one.
+func (u *dotUpstream) conn() (*dns.Conn, bool, error) {
+	u.mu.Lock()
+	conn := u.idle
+	u.idle = nil
+	u.mu.Unlock()
+	if conn != nil {
+		return conn, true, nil
+	}
+	conn, err := u.dial()
+	return conn, false, err
+}
+
+// release keeps conn for the next query, unless there is an idle connection already.
+func (u *dotUpstream) release(conn *dns.Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.idle != nil {
+		_ = conn.Close()
+		return
+	}
+	u.idle = conn
+}
+
+func (u *dotUpstream) dial() (*dns.Conn, error) {
+	addr, err := u.opt.bootstrap(u.host, u.port)
+	if err != nil {
+		return nil, err
+	}
+
+	d := u.opt.Dialer
+	plainDial := func(network, _ string) (net.Conn, error) {
+		if u.opt.Fragment {
+			return d.FragmentDial(network, addr)
+		}
+		return d.TCPDial(network, addr)
+	}
+	// the host name is dialed so that it's sent as the sni
+	conn, err := d.TLSDial(plainDial, "tcp", net.JoinHostPort(u.host, u.port))
+	if err != nil {
+		return nil, err
+	}
+	return &dns.Conn{Conn: conn}, nil
+}
+
+func (u *dotUpstream) Address() string {
+	return u.address
+}
@@ -0,0 +1,254 @@
+package upstream
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bepass-org/bepass/logger"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// strategies of a Group
+const (
+	// StrategyFallback sends the query to the upstreams in order until one answers.
+	StrategyFallback = "fallback"
+	// StrategyRace sends the query to all upstreams at once, the first valid answer wins.
+	StrategyRace = "race"
+	// StrategyWeighted is like fallback, but the upstreams are ordered randomly, weighted
+	// by their measured latency and failure rate, so faster and more reliable ones are used more.
+	StrategyWeighted = "weighted"
+)
+
+const (
+	// failureThreshold is the number of consecutive failures after which an upstream is held back
+	failureThreshold = 3
+	// defaultLatency is assumed for upstreams that didn't answer yet
+	defaultLatency = 100 * time.Millisecond
+	// ewmaWeight is the weight of a new sample in the moving averages of latency and failure rate
+	ewmaWeight = 0.2
+)
+
+// Group is an Upstream that sends queries to several upstreams with a strategy.
+// Upstreams that fail several times in a row are held back for a cooldown period,
+// unless all of them are held back.
+type Group struct {
+	members  []*member
+	strategy string
+	cooldown time.Duration
+}
+
+// member is an upstream of a group with its health.
+type member struct {
+	Upstream
+
+	mu                  sync.Mutex
+	latency             time.Duration // moving average
+	failureRate         float64       // moving average
+	consecutiveFailures int
+	cooldownUntil       time.Time
+}
+
+// NewGroup creates a Group of upstreams, the strategy defaults to fallback.
+func NewGroup(upstreams []Upstream, strategy string, cooldown time.Duration) (*Group, error) {
+	if len(upstreams) == 0 {
+		return nil, errors.New("no dns upstream")
+	}
+	switch strategy {
+	case "":
+		strategy = StrategyFallback
+	case StrategyFallback, StrategyRace, StrategyWeighted:
+	default:
+		return nil, fmt.Errorf("unknown dns upstream strategy %q", strategy)
+	}
+
+	g := &Group{strategy: strategy, cooldown: cooldown}
+	for _, u := range upstreams {
+		g.members = append(g.members, &member{Upstream: u})
+	}
+	return g, nil
+}
+
+// Exchange sends the query with the strategy of the group.
+func (g *Group) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	switch g.strategy {
+	case StrategyRace:
+		return g.race(req)
+	case StrategyWeighted:
+		return g.fallback(req, g.weighted(g.available()))
+	default:
+		return g.fallback(req, g.available())
+	}
+}
+
+// Address returns the addresses of the upstreams in the group.
+func (g *Group) Address() string {
+	return strings.Join(g.Addresses(), ",")
+}
+
+// Addresses returns the addresses of the upstreams in the group.
+func (g *Group) Addresses() []string {
+	addrs := make([]string, 0, len(g.members))
+	for _, m := range g.members {
+		addrs = append(addrs, m.Address())
+	}
+	return addrs
+}
+
+// Addresses returns the addresses of u, or of its upstreams if it's a Group.
+func Addresses(u Upstream) []string {
+	if g, ok := u.(*Group); ok {
+		return g.Addresses()
+	}
+	return []string{u.Address()}
+}
+
+// fallback tries the members in order until one of them answers.
+func (g *Group) fallback(req *dns.Msg, members []*member) (*dns.Msg, error) {
+	var err error
+	for _, m := range members {
+		var resp *dns.Msg
+		resp, err = g.exchange(m, req)
+		if err == nil {
+			return resp, nil
+		}
+	}
+	return nil, err
+}
+
+// race sends the query to all members at once and returns the first valid answer.
+func (g *Group) race(req *dns.Msg) (*dns.Msg, error) {
+	members := g.available()
+	type result struct {
+		resp *dns.Msg
+		err  error
+	}
+	results := make(chan result, len(members))
+	for _, m := range members {
+		go func(m *member) {
+			// every member gets its own copy, the query is modified by some of them
+			resp, err := g.exchange(m, req.Copy())
+			results <- result{resp, err}
+		}(m)
+	}
+
+	var err error
+	for range members {
+		r := <-results
+		if r.err == nil {
+			return r.resp, nil
+		}
+		err = r.err
+	}
+	return nil, err
+}
+
+// exchange sends the query to m and records its health.
+func (g *Group) exchange(m *member, req *dns.Msg) (*dns.Msg, error) {
+	begin := time.Now()
+	resp, err := m.Exchange(req)
+	if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		err = fmt.Errorf("%s", dns.RcodeToString[resp.Rcode])
+	}
+	rtt := time.Since(begin)
+
+	name := ""
+	if len(req.Question) > 0 {
+		name = req.Question[0].Name
+	}
+	if err != nil {
+		logger.Errorf("dns upstream %s failed for %s: %v", m.Address(), name, err)
+		if m.failed(g.cooldown) {
+			logger.Errorf("dns upstream %s failed %d times in a row, holding it back for %v", m.Address(), failureThreshold, g.cooldown)
+		}
+		return nil, fmt.Errorf("%s: %w", m.Address(), err)
+	}
+	logger.Infof("dns query for %s answered by %s in %v", name, m.Address(), rtt)
+	m.succeeded(rtt)
+	return resp, nil
+}
+
+// available returns the members that aren't held back, or all of them if they all are.
+func (g *Group) available() []*member {
+	now := time.Now()
+	members := make([]*member, 0, len(g.members))
+	for _, m := range g.members {
+		m.mu.Lock()
+		cooling := now.Before(m.cooldownUntil)
+		m.mu.Unlock()
+		if !cooling {
+			members = append(members, m)
+		}
+	}
+	if len(members) == 0 {
+		return g.members
+	}
+	return members
+}
+
+// weighted orders the members randomly, the weight of a member is the inverse of its
+// latency, penalized by its failure rate.
+func (g *Group) weighted(members []*member) []*member {
+	weights := make([]float64, len(members))
+	for i, m := range members {
+		weights[i] = m.weight()
+	}
+
+	ordered := make([]*member, 0, len(members))
+	for len(members) > 0 {
+		var total float64
+		for _, w := range weights {
+			total += w
+		}
+		i := 0
+		for r := rand.Float64() * total; i < len(weights)-1; i++ {
+			r -= weights[i]
+			if r < 0 {
+				break
+			}
+		}
+		ordered = append(ordered, members[i])
+		members = append(members[:i:i], members[i+1:]...)
+		weights = append(weights[:i:i], weights[i+1:]...)
+	}
+	return ordered
+}
+
+func (m *member) weight() float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	latency := m.latency
+	if latency == 0 {
+		latency = defaultLatency
+	}
+	return 1 / (latency.Seconds() * (1 + 10*m.failureRate))
+}
+
+func (m *member) succeeded(rtt time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.latency == 0 {
+		m.latency = rtt
+	} else {
+		m.latency = time.Duration((1-ewmaWeight)*float64(m.latency) + ewmaWeight*float64(rtt))
+	}
+	m.failureRate = (1 - ewmaWeight) * m.failureRate
+	m.consecutiveFailures = 0
+}
+
+// failed records a failure, it reports whether the member is held back now.
+func (m *member) failed(cooldown time.Duration) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failureRate = (1-ewmaWeight)*m.failureRate + ewmaWeight
+	m.consecutiveFailures++
+	if cooldown > 0 && m.consecutiveFailures >= failureThreshold {
+		m.consecutiveFailures = 0
+		m.cooldownUntil = time.Now().Add(cooldown)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,129 @@
+package upstream
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// fakeUpstream answers after delay, or fails if fail is set.
+type fakeUpstream struct {
+	address string
+	delay   time.Duration
+	fail    bool
+	queries atomic.Int32
+}
+
+func (u *fakeUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	u.queries.Add(1)
+	time.Sleep(u.delay)
+	if u.fail {
+		return nil, errors.New("blocked")
+	}
+	return answer(req), nil
+}
+
+func (u *fakeUpstream) Address() string {
+	return u.address
+}
+
+func exchange(t *testing.T, g *Group) (*dns.Msg, error) {
+	t.Helper()
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	return g.Exchange(req)
+}
+
+func TestGroupFallback(t *testing.T) {
+	blocked := &fakeUpstream{address: "blocked", fail: true}
+	working := &fakeUpstream{address: "working"}
+	g, err := NewGroup([]Upstream{blocked, working}, StrategyFallback, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < failureThreshold+2; i++ {
+		if _, err := exchange(t, g); err != nil {
+			t.Fatalf("Exchange failed: %v", err)
+		}
+	}
+	// the blocked upstream is held back after failing in a row
+	if n := blocked.queries.Load(); n != failureThreshold {
+		t.Errorf("Expected %d queries to the blocked upstream, got %d", failureThreshold, n)
+	}
+	if n := working.queries.Load(); n != failureThreshold+2 {
+		t.Errorf("Expected %d queries to the working upstream, got %d", failureThreshold+2, n)
+	}
+}
+
+func TestGroupAllFailing(t *testing.T) {
+	g, err := NewGroup([]Upstream{
+		&fakeUpstream{address: "a", fail: true},
+		&fakeUpstream{address: "b", fail: true},
+	}, StrategyFallback, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// upstreams are still tried when all of them are held back
+	for i := 0; i < failureThreshold+1; i++ {
+		if _, err := exchange(t, g); err == nil {
+			t.Fatalf("Expected an error")
+		}
+	}
+	for _, m := range g.members {
+		if n := m.Upstream.(*fakeUpstream).queries.Load(); n != failureThreshold+1 {
+			t.Errorf("Expected %d queries to %s, got %d", failureThreshold+1, m.Address(), n)
+		}
+	}
+}
+
+func TestGroupRace(t *testing.T) {
+	slow := &fakeUpstream{address: "slow", delay: time.Second}
+	fast := &fakeUpstream{address: "fast"}
+	blocked := &fakeUpstream{address: "blocked", fail: true}
+	g, err := NewGroup([]Upstream{slow, blocked, fast}, StrategyRace, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	begin := time.Now()
+	if _, err := exchange(t, g); err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if d := time.Since(begin); d > 500*time.Millisecond {
+		t.Errorf("Expected the fast answer to win, took %v", d)
+	}
+}
+
+func TestGroupWeighted(t *testing.T) {
+	g, err := NewGroup([]Upstream{
+		&fakeUpstream{address: "slow"},
+		&fakeUpstream{address: "fast"},
+	}, StrategyWeighted, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g.members[0].succeeded(time.Second)
+	g.members[1].succeeded(10 * time.Millisecond)
+
+	first := 0
+	for i := 0; i < 1000; i++ {
+		if g.weighted(g.available())[0].Address() == "fast" {
+			first++
+		}
+	}
+	// the fast upstream has 100 times the weight of the slow one
+	if first < 950 {
+		t.Errorf("Expected the fast upstream to be ordered first most of the time, got %d/1000", first)
+	}
+
+	if _, err := NewGroup(nil, StrategyRace, 0); err == nil {
+		t.Errorf("Expected an error for an empty group")
+	}
+	if _, err := NewGroup([]Upstream{g.members[0].Upstream}, "random", 0); err == nil {
+		t.Errorf("Expected an error for an unknown strategy")
+	}
+}
@@ -0,0 +1,177 @@
+// Package upstream provides the DNS servers that queries are sent to. The kind of upstream is
+// chosen by the scheme of its address: https:// is DNS-over-HTTPS, tls:// is DNS-over-TLS,
+// quic:// is DNS-over-QUIC and anything else, like an sdns:// stamp, is DNSCrypt.
+package upstream
+
+import (
+	"fmt"
+	"github.com/bepass-org/bepass/dialer"
+	"github.com/bepass-org/bepass/doh"
+	"github.com/bepass-org/bepass/resolve"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// schemes of upstream addresses
+const (
+	SchemeDoH = "https"
+	SchemeDoT = "tls"
+	SchemeDoQ = "quic"
+)
+
+// defaultPort is the port of DNS-over-TLS and DNS-over-QUIC (RFC 7858, RFC 9250)
+const defaultPort = "853"
+
+// Upstream is a DNS server that queries are sent to.
+type Upstream interface {
+	// Exchange sends the query and returns the response.
+	Exchange(req *dns.Msg) (*dns.Msg, error)
+	// Address returns the address the upstream was created with.
+	Address() string
+}
+
+// Options represents options for configuring upstreams.
+type Options struct {
+	Dialer        *dialer.Dialer         // Dialer for DoT connections
+	DoHClient     *doh.Client            // Client for DoH queries
+	QueryOptions  []doh.QueryOption      // Options of DoH queries
+	LocalResolver *resolve.LocalResolver // Resolves the host names of upstreams
+	Fragment      bool                   // Fragment the client hello of DoT connections
+	Timeout       time.Duration          // Timeout of a query
+}
+
+// Option is a function type used for setting upstream options.
+type Option func(*Options)
+
+// WithDialer sets the dialer that DoT connections are made with.
+func WithDialer(d *dialer.Dialer) Option {
+	return func(o *Options) {
+		o.Dialer = d
+	}
+}
+
+// WithDoHClient sets the client that DoH queries are sent with.
+func WithDoHClient(c *doh.Client) Option {
+	return func(o *Options) {
+		o.DoHClient = c
+	}
+}
+
+// WithQueryOptions sets the options of DoH queries, like the request method, padding or client subnet.
+func WithQueryOptions(opts ...doh.QueryOption) Option {
+	return func(o *Options) {
+		o.QueryOptions = opts
+	}
+}
+
+// WithLocalResolver sets the resolver for the host names of DoT and DoQ upstreams,
+// they can't be resolved through the upstream itself.
+func WithLocalResolver(r *resolve.LocalResolver) Option {
+	return func(o *Options) {
+		o.LocalResolver = r
+	}
+}
+
+// WithFragmentation enables or disables fragmentation of the client hello of DoT connections.
+func WithFragmentation(f bool) Option {
+	return func(o *Options) {
+		o.Fragment = f
+	}
+}
+
+// WithTimeout sets the timeout of a query, it's 10 seconds by default.
+func WithTimeout(d time.Duration) Option {
+	return func(o *Options) {
+		if d > 0 {
+			o.Timeout = d
+		}
+	}
+}
+
+// New creates the upstream for address, its kind is chosen by the scheme of the address.
+func New(address string, opts ...Option) (Upstream, error) {
+	o := &Options{Timeout: 10 * time.Second}
+	for _, f := range opts {
+		f(o)
+	}
+
+	scheme, _, _ := strings.Cut(address, "://")
+	switch scheme {
+	case SchemeDoH:
+		if o.DoHClient == nil {
+			return nil, fmt.Errorf("%s: no DoH client", address)
+		}
+		return &dohUpstream{address: address, client: o.DoHClient, opts: o.QueryOptions}, nil
+	case SchemeDoT:
+		if o.Dialer == nil {
+			return nil, fmt.Errorf("%s: no dialer", address)
+		}
+		host, port, err := hostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return &dotUpstream{address: address, host: host, port: port, opt: o}, nil
+	case SchemeDoQ:
+		host, port, err := hostPort(address)
+		if err != nil {
+			return nil, err
+		}
+		return &doqUpstream{address: address, host: host, port: port, opt: o}, nil
+	default:
+		return &dnscryptUpstream{address: address, opt: o}, nil
+	}
+}
+
+// hostPort returns the host and port of a DoT or DoQ address.
+func hostPort(address string) (string, string, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Hostname() == "" {
+		return "", "", fmt.Errorf("%s: missing host", address)
+	}
+	port := u.Port()
+	if port == "" {
+		port = defaultPort
+	}
+	return u.Hostname(), port, nil
+}
+
+// bootstrap returns the ip:port address to connect to for host, the host name is
+// resolved with the local resolver.
+func (o *Options) bootstrap(host, port string) (string, error) {
+	if net.ParseIP(host) != nil {
+		return net.JoinHostPort(host, port), nil
+	}
+	var ip string
+	if o.LocalResolver != nil {
+		ip = o.LocalResolver.Resolve(host)
+	} else if ips, err := net.LookupIP(host); err == nil && len(ips) > 0 {
+		ip = ips[0].String()
+	}
+	if ip == "" {
+		return "", fmt.Errorf("unable to resolve upstream %s", host)
+	}
+	return net.JoinHostPort(ip, port), nil
+}
+
+// dohUpstream sends queries with the DoH client.
+type dohUpstream struct {
+	address string
+	client  *doh.Client
+	opts    []doh.QueryOption
+}
+
+func (u *dohUpstream) Exchange(req *dns.Msg) (*dns.Msg, error) {
+	resp, _, err := u.client.Exchange(req, u.address, u.opts...)
+	return resp, err
+}
+
+func (u *dohUpstream) Address() string {
+	return u.address
+}
@@ -0,0 +1,166 @@
+package upstream
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"fmt"
+	"github.com/bepass-org/bepass/dialer"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/quic-go/quic-go"
+)
+
+// testCertificate returns a self-signed certificate for dns.example.
+func testCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"dns.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// answer answers A queries with 1.2.3.4.
+func answer(req *dns.Msg) *dns.Msg {
+	resp := new(dns.Msg)
+	resp.SetReply(req)
+	resp.Answer = append(resp.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: req.Question[0].Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
+		A:   net.ParseIP("1.2.3.4").To4(),
+	})
+	return resp
+}
+
+func query(t *testing.T, u Upstream) {
+	t.Helper()
+	for i := 0; i < 2; i++ {
+		req := new(dns.Msg)
+		req.SetQuestion("example.com.", dns.TypeA)
+		resp, err := u.Exchange(req)
+		if err != nil {
+			t.Fatalf("Exchange failed: %v", err)
+		}
+		if resp.Id != req.Id {
+			t.Errorf("Expected id %d, got %d", req.Id, resp.Id)
+		}
+		if len(resp.Answer) != 1 || resp.Answer[0].(*dns.A).A.String() != "1.2.3.4" {
+			t.Errorf("Expected 1.2.3.4, got %v", resp.Answer)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	testCases := []struct {
+		address string
+		want    interface{}
+	}{
+		{"tls://1.1.1.1", &dotUpstream{}},
+		{"quic://dns.adguard-dns.com:784", &doqUpstream{}},
+		{"sdns://AQcAAAAAAAAAFDE3Ni4xMDMuMTMwLjEzMDo1NDQz", &dnscryptUpstream{}},
+	}
+	for _, tc := range testCases {
+		u, err := New(tc.address, WithDialer(&dialer.Dialer{}))
+		if err != nil {
+			t.Fatalf("New(%s) failed: %v", tc.address, err)
+		}
+		if got, want := fmt.Sprintf("%T", u), fmt.Sprintf("%T", tc.want); got != want {
+			t.Errorf("Expected %s for %s, got %s", want, tc.address, got)
+		}
+	}
+
+	if _, err := New("https://1.1.1.1/dns-query"); err == nil {
+		t.Errorf("Expected an error for DoH without a client")
+	}
+	if _, err := New("tls://:853", WithDialer(&dialer.Dialer{})); err == nil {
+		t.Errorf("Expected an error for a missing host")
+	}
+
+	if u, _ := New("quic://dns.example"); u.(*doqUpstream).port != defaultPort {
+		t.Errorf("Expected the default port")
+	}
+}
+
+func TestDoT(t *testing.T) {
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{Listener: ln, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		_ = w.WriteMsg(answer(req))
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	u, err := New("tls://"+ln.Addr().String(), WithDialer(&dialer.Dialer{}), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query(t, u)
+}
+
+func TestDoQ(t *testing.T) {
+	ln, err := quic.ListenAddr("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{testCertificate(t)},
+		NextProtos:   []string{doqALPN},
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept(context.Background())
+			if err != nil {
+				return
+			}
+			go func() {
+				for {
+					stream, err := conn.AcceptStream(context.Background())
+					if err != nil {
+						return
+					}
+					buf, err := io.ReadAll(stream)
+					if err != nil || len(buf) < 2 {
+						return
+					}
+					req := new(dns.Msg)
+					if err := req.Unpack(buf[2:]); err != nil || req.Id != 0 {
+						stream.CancelWrite(1)
+						continue
+					}
+					out, _ := answer(req).Pack()
+					_ = binary.Write(stream, binary.BigEndian, uint16(len(out)))
+					_, _ = stream.Write(out)
+					_ = stream.Close()
+				}
+			}()
+		}
+	}()
+
+	u, err := New("quic://"+ln.Addr().String(), WithTimeout(5*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	query(t, u)
+}
@@ -2,12 +2,20 @@
 package utils
 
 import (
+	"container/list"
 	"fmt"
 	"runtime"
 	"sync"
 	"time"
 )
 
+const (
+	// NoExpiration is passed to SetWithTTL for an item that never expires.
+	NoExpiration time.Duration = -1
+	// DefaultExpiration is passed to SetWithTTL for an item with the default expiration of the cache.
+	DefaultExpiration time.Duration = 0
+)
+
 // Item represents an item in the cache.
 type Item struct {
 	Object     interface{}
@@ -24,15 +32,20 @@ func (item Item) Expired() bool {
 
 // Cache is a thread-safe in-memory cache implementation with expiration support.
 // It allows you to store key-value pairs with optional expiration times.
+// Expired items are never returned and are removed by a janitor, and the cache can
+// be bounded to a number of items, in which case the least recently used one is evicted.
 //
 // Usage:
 //
 //	// Create a new cache with a 10-minute default expiration time.
 //	myCache := NewCache(10 * time.Minute)
 //
-//	// Store a value with a key and an optional expiration duration.
+//	// Store a value with a key and the default expiration duration.
 //	myCache.Set("myKey", myValue)
 //
+//	// Store a value that expires after a minute.
+//	myCache.SetWithTTL("otherKey", otherValue, time.Minute)
+//
 //	// Retrieve a value from the cache. Returns the value and true if found, or nil and false if not found.
 //	value, found := myCache.Get("myKey")
 //
@@ -49,33 +62,99 @@ type Cache struct {
 }
 
 type cache struct {
-	expiration time.Duration
-	items      map[string]Item
-	mu         sync.RWMutex
-	onExpired  func()
-	janitor    *janitor
+	expiration      time.Duration
+	cleanupInterval time.Duration
+	staleWindow     time.Duration
+	maxItems        int
+	items           map[string]*list.Element
+	// lru holds the entries, most recently used first
+	lru       *list.List
+	mu        sync.Mutex
+	onExpired func()
+	janitor   *janitor
+}
+
+type entry struct {
+	key  string
+	item Item
+}
+
+// CacheOption configures a Cache.
+type CacheOption func(*cache)
+
+// WithMaxItems bounds the cache to n items, the least recently used item is evicted
+// when another one is added. Zero means unbounded.
+func WithMaxItems(n int) CacheOption {
+	return func(c *cache) {
+		c.maxItems = n
+	}
+}
+
+// WithCleanupInterval sets how often expired items are removed, it defaults to the
+// expiration duration of the cache.
+func WithCleanupInterval(d time.Duration) CacheOption {
+	return func(c *cache) {
+		c.cleanupInterval = d
+	}
+}
+
+// WithStaleWindow keeps expired items for d before the janitor removes them,
+// so they can still be served with GetStale while they are renewed.
+func WithStaleWindow(d time.Duration) CacheOption {
+	return func(c *cache) {
+		c.staleWindow = d
+	}
 }
 
-// Set add an item to the cache, replacing any existing item.
+// Set add an item to the cache with the default expiration, replacing any existing item.
 func (c *cache) Set(k string, x interface{}) {
-	// "Inlining" of set
-	var e = time.Now().Add(c.expiration).UnixNano()
+	c.SetWithTTL(k, x, DefaultExpiration)
+}
 
+// SetWithTTL add an item to the cache that expires after d, replacing any existing item.
+// If d is DefaultExpiration the default expiration of the cache is used,
+// if it's NoExpiration the item never expires.
+func (c *cache) SetWithTTL(k string, x interface{}, d time.Duration) {
 	c.mu.Lock()
-	c.items[k] = Item{
-		Object:     x,
-		Expiration: e,
+	c.set(k, x, d)
+	c.mu.Unlock()
+}
+
+// SetWithExpiration add an item to the cache that expires at t, replacing any existing item.
+// It's used to restore items with their original expiration, a zero t means it never expires.
+func (c *cache) SetWithExpiration(k string, x interface{}, t time.Time) {
+	var e int64
+	if !t.IsZero() {
+		e = t.UnixNano()
 	}
-	// TODO: Calls to mu.Unlock are currently not deferred because defer
-	// adds ~200 ns (as of go1.)
+	c.mu.Lock()
+	c.setItem(k, Item{Object: x, Expiration: e})
 	c.mu.Unlock()
 }
 
-func (c *cache) set(k string, x interface{}) {
-	var e = time.Now().Add(c.expiration).UnixNano()
-	c.items[k] = Item{
+func (c *cache) set(k string, x interface{}, d time.Duration) {
+	if d == DefaultExpiration {
+		d = c.expiration
+	}
+	var e int64
+	if d > 0 {
+		e = time.Now().Add(d).UnixNano()
+	}
+	c.setItem(k, Item{
 		Object:     x,
 		Expiration: e,
+	})
+}
+
+func (c *cache) setItem(k string, item Item) {
+	if el, found := c.items[k]; found {
+		el.Value.(*entry).item = item
+		c.lru.MoveToFront(el)
+		return
+	}
+	c.items[k] = c.lru.PushFront(&entry{key: k, item: item})
+	if c.maxItems > 0 && c.lru.Len() > c.maxItems {
+		c.removeElement(c.lru.Back())
 	}
 }
 
@@ -87,42 +166,85 @@ func (c *cache) Replace(k string, x interface{}) error {
 		c.mu.Unlock()
 		return fmt.Errorf("item %s doesn't exist", k)
 	}
-	c.set(k, x)
+	c.set(k, x, DefaultExpiration)
 	c.mu.Unlock()
 	return nil
 }
 
 // Get an item from the cache. Returns the item or nil, and a bool indicating
-// whether the key was found.
+// whether the key was found. Expired items are not returned.
 func (c *cache) Get(k string) (interface{}, bool) {
-	c.mu.RLock()
-	item, found := c.items[k]
+	c.mu.Lock()
+	x, found := c.get(k)
+	c.mu.Unlock()
+	return x, found
+}
+
+func (c *cache) get(k string) (interface{}, bool) {
+	el, found := c.items[k]
 	if !found {
-		c.mu.RUnlock()
 		return nil, false
 	}
-	c.mu.RUnlock()
-	return item.Object, true
+	e := el.Value.(*entry)
+	if e.item.Expired() {
+		return nil, false
+	}
+	c.lru.MoveToFront(el)
+	return e.item.Object, true
 }
 
-func (c *cache) get(k string) (interface{}, bool) {
-	item, found := c.items[k]
+// GetStale is like Get, but it also returns items that expired less than the stale window ago,
+// stale reports whether the item is expired.
+func (c *cache) GetStale(k string) (x interface{}, stale bool, found bool) {
+	x, _, stale, found = c.GetStaleWithExpiration(k)
+	return x, stale, found
+}
+
+// GetStaleWithExpiration is like GetStale, it also returns when the item expires,
+// or the zero time if it never does.
+func (c *cache) GetStaleWithExpiration(k string) (x interface{}, expiration time.Time, stale bool, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, found := c.items[k]
 	if !found {
-		return nil, false
+		return nil, time.Time{}, false, false
+	}
+	e := el.Value.(*entry)
+	if e.item.Expiration > 0 && time.Now().UnixNano() > e.item.Expiration+int64(c.staleWindow) {
+		return nil, time.Time{}, false, false
+	}
+	c.lru.MoveToFront(el)
+	if e.item.Expiration > 0 {
+		expiration = time.Unix(0, e.item.Expiration)
+	}
+	return e.item.Object, expiration, e.item.Expired(), true
+}
+
+// Items returns a snapshot of all items in the cache with their expiration,
+// including expired items that the janitor didn't remove yet.
+func (c *cache) Items() map[string]Item {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	items := make(map[string]Item, len(c.items))
+	for k, el := range c.items {
+		items[k] = el.Value.(*entry).item
 	}
-	return item.Object, true
+	return items
 }
 
-// GetAll returns all keys in the cache or empty map.
+// GetAll returns all unexpired items in the cache or empty map.
 func (c *cache) GetAll() map[string]interface{} {
-	c.mu.RLock()
-	defer c.mu.RUnlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	var items map[string]interface{}
 
-	if c.ItemCount() > 0 {
+	if len(c.items) > 0 {
 		items = make(map[string]interface{}, len(c.items))
-		for k, v := range c.items {
-			items[k] = v.Object
+		for k, el := range c.items {
+			e := el.Value.(*entry)
+			if !e.item.Expired() {
+				items[k] = e.item.Object
+			}
 		}
 	}
 
@@ -132,44 +254,51 @@ func (c *cache) GetAll() map[string]interface{} {
 // Delete an item from the cache. Does nothing if the key is not in the cache.
 func (c *cache) Delete(k string) {
 	c.mu.Lock()
-	delete(c.items, k)
+	if el, found := c.items[k]; found {
+		c.removeElement(el)
+	}
 	c.mu.Unlock()
 }
 
-// DeleteExpired Delete all expired items from the cache.
+func (c *cache) removeElement(el *list.Element) {
+	c.lru.Remove(el)
+	delete(c.items, el.Value.(*entry).key)
+}
+
+// DeleteExpired Delete all items from the cache that expired longer than the stale window ago.
 func (c *cache) DeleteExpired() {
 	now := time.Now().UnixNano()
 	c.mu.Lock()
-	for k, v := range c.items {
-		if v.Expiration > 0 && now > v.Expiration {
-			delete(c.items, k)
+	for _, el := range c.items {
+		e := el.Value.(*entry)
+		if e.item.Expiration > 0 && now > e.item.Expiration+int64(c.staleWindow) {
+			c.removeElement(el)
 		}
 	}
 	c.mu.Unlock()
 }
 
-type keyAndValue struct {
-	key   string
-	value interface{}
-}
-
-// OnExpired sets an (optional) function that is called when the cache expires
+// OnExpired sets an (optional) function that is called after the janitor removed the expired items
 func (c *cache) OnExpired(f func()) {
+	c.mu.Lock()
 	c.onExpired = f
+	c.mu.Unlock()
 }
 
-// ItemCount Returns the number of items in the cache, including expired items.
+// ItemCount Returns the number of items in the cache, including expired items
+// that the janitor didn't remove yet.
 func (c *cache) ItemCount() int {
-	c.mu.RLock()
+	c.mu.Lock()
 	n := len(c.items)
-	c.mu.RUnlock()
+	c.mu.Unlock()
 	return n
 }
 
 // Flush Delete all items from the cache.
 func (c *cache) Flush() {
 	c.mu.Lock()
-	c.items = map[string]Item{}
+	c.items = map[string]*list.Element{}
+	c.lru.Init()
 	c.mu.Unlock()
 }
 
@@ -178,10 +307,14 @@ type janitor struct {
 	stop     chan bool
 }
 
-// handleExpired is fired by the ticker and executes the onExpired function.
+// handleExpired is fired by the ticker, it removes the expired items and executes the onExpired function.
 func (c *cache) handleExpired() {
-	if c.onExpired != nil {
-		c.onExpired()
+	c.DeleteExpired()
+	c.mu.Lock()
+	onExpired := c.onExpired
+	c.mu.Unlock()
+	if onExpired != nil {
+		onExpired()
 	}
 }
 
@@ -202,36 +335,43 @@ func stopJanitor(c *Cache) {
 	c.janitor.stop <- true
 }
 
-func runJanitor(c *cache, ex time.Duration) {
+func runJanitor(c *cache, ci time.Duration) {
 	j := &janitor{
-		Interval: ex,
+		Interval: ci,
 		stop:     make(chan bool, 1),
 	}
 	c.janitor = j
 	go j.Run(c)
 }
 
-func newCache(ex time.Duration, m map[string]Item) *cache {
+func newCache(ex time.Duration, opts ...CacheOption) *cache {
 	if ex <= 0 {
-		ex = -1
+		ex = NoExpiration
 	}
 	c := &cache{
 		expiration: ex,
-		items:      m,
+		items:      make(map[string]*list.Element),
+		lru:        list.New(),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.cleanupInterval <= 0 {
+		c.cleanupInterval = ex
 	}
 	return c
 }
 
-func newCacheWithJanitor(ex time.Duration, m map[string]Item) *Cache {
-	c := newCache(ex, m)
+func newCacheWithJanitor(ex time.Duration, opts ...CacheOption) *Cache {
+	c := newCache(ex, opts...)
 	// This trick ensures that the janitor goroutine (which--granted it
 	// was enabled--is running DeleteExpired on c forever) does not keep
 	// the returned C object from being garbage collected. When it is
 	// garbage collected, the finalizer stops the janitor goroutine, after
 	// which c can be collected.
 	C := &Cache{c}
-	if ex > 0 {
-		runJanitor(c, ex)
+	if c.cleanupInterval > 0 {
+		runJanitor(c, c.cleanupInterval)
 		runtime.SetFinalizer(C, stopJanitor)
 	}
 	return C
@@ -239,9 +379,9 @@ func newCacheWithJanitor(ex time.Duration, m map[string]Item) *Cache {
 
 // NewCache return a new cache with a given expiration duration. If the
 // expiration duration is less than 1 (i.e. No Expiration),
-// the items in the cache never expire (by default), and must be deleted
-// manually. The OnExpired callback method is ignored, too.
-func NewCache(expiration time.Duration) *Cache {
-	items := make(map[string]Item)
-	return newCacheWithJanitor(expiration, items)
+// the items in the cache never expire by default, and must be deleted
+// manually or be set with SetWithTTL. Without a cleanup interval the
+// OnExpired callback method is ignored, too.
+func NewCache(expiration time.Duration, opts ...CacheOption) *Cache {
+	return newCacheWithJanitor(expiration, opts...)
 }
@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCacheExpiration(t *testing.T) {
+	c := NewCache(time.Hour)
+	c.SetWithTTL("short", 1, 10*time.Millisecond)
+	c.Set("default", 2)
+	c.SetWithTTL("forever", 3, NoExpiration)
+
+	time.Sleep(20 * time.Millisecond)
+
+	if _, found := c.Get("short"); found {
+		t.Errorf("Expected expired item to be hidden")
+	}
+	if x, found := c.Get("default"); !found || x.(int) != 2 {
+		t.Errorf("Expected item with the default expiration, got %v", x)
+	}
+	if _, found := c.GetAll()["short"]; found {
+		t.Errorf("Expected GetAll to skip expired items")
+	}
+
+	c.DeleteExpired()
+	if n := c.ItemCount(); n != 2 {
+		t.Errorf("Expected 2 items after DeleteExpired, got %d", n)
+	}
+}
+
+func TestCacheJanitor(t *testing.T) {
+	c := NewCache(time.Hour, WithCleanupInterval(5*time.Millisecond))
+	expired := make(chan struct{}, 1)
+	c.OnExpired(func() {
+		select {
+		case expired <- struct{}{}:
+		default:
+		}
+	})
+	c.SetWithTTL("short", 1, time.Millisecond)
+
+	select {
+	case <-expired:
+	case <-time.After(time.Second):
+		t.Fatal("janitor didn't run")
+	}
+	if n := c.ItemCount(); n != 0 {
+		t.Errorf("Expected the janitor to remove the expired item, got %d items", n)
+	}
+}
+
+func TestCacheLRU(t *testing.T) {
+	c := NewCache(NoExpiration, WithMaxItems(2))
+	c.Set("a", 1)
+	c.Set("b", 2)
+	// a is used more recently than b now
+	c.Get("a")
+	c.Set("c", 3)
+
+	if _, found := c.Get("b"); found {
+		t.Errorf("Expected the least recently used item to be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, found := c.Get(k); !found {
+			t.Errorf("Expected %s to be kept", k)
+		}
+	}
+	if n := c.ItemCount(); n != 2 {
+		t.Errorf("Expected 2 items, got %d", n)
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	c := NewCache(time.Hour, WithStaleWindow(time.Hour))
+	c.SetWithExpiration("expired", 1, time.Now().Add(-time.Minute))
+	c.SetWithExpiration("gone", 2, time.Now().Add(-2*time.Hour))
+
+	if _, found := c.Get("expired"); found {
+		t.Errorf("Expected Get to hide the stale item")
+	}
+	if x, stale, found := c.GetStale("expired"); !found || !stale || x.(int) != 1 {
+		t.Errorf("Expected the stale item, got %v %v %v", x, stale, found)
+	}
+	if _, _, found := c.GetStale("gone"); found {
+		t.Errorf("Expected items beyond the stale window to be hidden")
+	}
+
+	c.DeleteExpired()
+	items := c.Items()
+	if _, found := items["expired"]; !found || len(items) != 1 {
+		t.Errorf("Expected only the stale item to be kept, got %v", items)
+	}
+}
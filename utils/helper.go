@@ -3,14 +3,14 @@ package utils
 
 import (
 	"fmt"
-	"github.com/bepass-org/bepass/config"
 	"net"
 	"net/url"
 	"strings"
 )
 
-// WSEndpointHelper generates a WebSocket endpoint URL based on the workerAddress, rawDestAddress, and network.
-func WSEndpointHelper(workerAddress, rawDestAddress, network string) (string, error) {
+// WSEndpointHelper generates a WebSocket endpoint URL based on the workerAddress, rawDestAddress, network
+// and the session of the user.
+func WSEndpointHelper(workerAddress, rawDestAddress, network, session string) (string, error) {
 	u, err := url.Parse(workerAddress)
 	if err != nil {
 		return "", err
@@ -23,6 +23,38 @@ func WSEndpointHelper(workerAddress, rawDestAddress, network string) (string, er
 	if err != nil {
 		return "", err
 	}
-	endpoint := fmt.Sprintf("wss://%s/connect?host=%s&port=%s&net=%s&session=%s", u.Host, dh, dp, network, config.G.UserSession)
+	endpoint := fmt.Sprintf("wss://%s/connect?host=%s&port=%s&net=%s&session=%s", u.Host, dh, dp, network, url.QueryEscape(session))
 	return endpoint, nil
 }
+
+// UDPEndpointHelper generates the WebSocket endpoint URL of the udp tunnel whose packets carry
+// their own destination.
+func UDPEndpointHelper(workerAddress, session string) (string, error) {
+	u, err := url.Parse(workerAddress)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("wss://%s/connect?net=udp2&session=%s", u.Host, url.QueryEscape(session)), nil
+}
+
+// MuxEndpointHelper generates the WebSocket endpoint URL of the multiplexed connections to the worker.
+func MuxEndpointHelper(workerAddress, session string) (string, error) {
+	u, err := url.Parse(workerAddress)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("wss://%s/mux?session=%s", u.Host, url.QueryEscape(session)), nil
+}
+
+// DoHEndpointHelper adds the session to the DoH address of the worker, a self-hosted relay only
+// answers queries with its token.
+func DoHEndpointHelper(workerAddress, session string) (string, error) {
+	u, err := url.Parse(workerAddress)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	q.Set("session", session)
+	u.RawQuery = q.Encode()
+	return u.String(), nil
+}